@@ -16,23 +16,34 @@ package cmd
 
 import (
 	"bufio"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
+	"slices"
 	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/hashicorp/go-plugin"
 	"github.com/sftpgo/sdk/plugin/metadata"
 	"github.com/urfave/cli/v2"
+	"gorm.io/gorm"
 
 	"github.com/sftpgo/sftpgo-plugin-metadata/db"
 	"github.com/sftpgo/sftpgo-plugin-metadata/db/migration"
 	"github.com/sftpgo/sftpgo-plugin-metadata/logger"
+	"github.com/sftpgo/sftpgo-plugin-metadata/tracing"
+	"github.com/sftpgo/sftpgo-plugin-metadata/webhook"
 )
 
 const (
 	version   = "1.0.12"
 	envPrefix = "SFTPGO_PLUGIN_METADATA_"
+	// copyProgressInterval is the minimum interval between two copy
+	// progress reports
+	copyProgressInterval = 5 * time.Second
 )
 
 var (
@@ -41,9 +52,79 @@ var (
 )
 
 var (
-	driver          string
-	dsn             string
-	customTLSConfig string
+	driver            string
+	dsn               string
+	dsnFile           string
+	passwordFile      string
+	customTLSConfig   string
+	slowThreshold     time.Duration
+	queryTimeout      time.Duration
+	pathNormalization string
+
+	logLevel      string
+	logJSON       bool
+	logFile       string
+	logMaxSize    int
+	logMaxBackups int
+	logMaxAge     int
+	logCompress   bool
+
+	tracingExporter     string
+	tracingEndpoint     string
+	tracingInsecure     bool
+	tracingFile         string
+	tracingSamplerRatio float64
+
+	routingConfig        string
+	replicaDSNs          cli.StringSlice
+	readAfterWriteWindow time.Duration
+
+	auditSink string
+	auditFile string
+
+	changeEvents   bool
+	webhooksConfig string
+
+	redisURL       string
+	redisTTL       time.Duration
+	redisKeyPrefix string
+
+	auditQueryStorageID  string
+	auditQueryPathPrefix string
+	auditQueryFrom       string
+	auditQueryTo         string
+	auditQueryJSON       bool
+
+	dumpStorageID string
+	dumpFolders   cli.StringSlice
+	dumpPrefix    string
+
+	normalizeStorageID string
+	normalizeDryRun    bool
+
+	migrationTarget string
+	migrationDryRun bool
+
+	resetConfirmDatabases cli.StringSlice
+	resetYes              bool
+	resetBackupPath       string
+	resetStorageID        string
+
+	storageSourceID     string
+	storageTargetID     string
+	storageConflictRule string
+
+	copySourceStorageID string
+	copySourcePrefix    string
+	copyTargetStorageID string
+	copyTargetPrefix    string
+	copyConflictRule    string
+	copyDryRun          bool
+
+	statsStorageID      string
+	statsLargestFolders int
+	statsEstimate       bool
+	statsJSON           bool
 
 	dbFlags = []cli.Flag{
 		&cli.StringFlag{
@@ -55,18 +136,445 @@ var (
 		},
 		&cli.StringFlag{
 			Name:        "dsn",
-			Usage:       "Data source URI (required)",
+			Usage:       "Data source URI (required if dsn-file is not set)",
 			Destination: &dsn,
 			EnvVars:     []string{envPrefix + "DSN"},
-			Required:    true,
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "dsn-file",
+			Usage:       "Path to a file containing the data source URI (optional)",
+			Destination: &dsnFile,
+			EnvVars:     []string{envPrefix + "DSN_FILE"},
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "db-password-file",
+			Usage:       "Path to a file containing the database password, it overrides the DSN password (optional)",
+			Destination: &passwordFile,
+			EnvVars:     []string{envPrefix + "DB_PASSWORD_FILE"},
+			Required:    false,
 		},
 		&cli.StringFlag{
 			Name:        "custom-tls",
-			Usage:       "Custom TLS config for MySQL driver (optional)",
+			Usage:       "Custom TLS config (optional)",
 			Destination: &customTLSConfig,
 			EnvVars:     []string{envPrefix + "CUSTOM_TLS"},
 			Required:    false,
 		},
+		&cli.DurationFlag{
+			Name:        "db-slow-threshold",
+			Usage:       "SQL statements slower than this are logged as warnings, 0 disables (optional)",
+			Value:       time.Second,
+			Destination: &slowThreshold,
+			EnvVars:     []string{envPrefix + "DB_SLOW_THRESHOLD"},
+			Required:    false,
+		},
+		&cli.DurationFlag{
+			Name:        "query-timeout",
+			Usage:       "Timeout for a single metadata operation (optional)",
+			Value:       20 * time.Second,
+			Destination: &queryTimeout,
+			EnvVars:     []string{envPrefix + "QUERY_TIMEOUT"},
+			Required:    false,
+		},
+		&cli.StringSliceFlag{
+			Name:        "replica-dsn",
+			Usage:       "Data source URI for a read replica, repeat the flag to add more replicas (optional)",
+			Destination: &replicaDSNs,
+			EnvVars:     []string{envPrefix + "REPLICA_DSN"},
+			Required:    false,
+		},
+		&cli.DurationFlag{
+			Name:        "read-after-write-window",
+			Usage:       "Time after a write during which the written folders are read from the primary database (optional)",
+			Value:       5 * time.Second,
+			Destination: &readAfterWriteWindow,
+			EnvVars:     []string{envPrefix + "READ_AFTER_WRITE_WINDOW"},
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "routing-config",
+			Usage:       "Path to a JSON file defining the databases for the matching storage IDs (optional)",
+			Destination: &routingConfig,
+			EnvVars:     []string{envPrefix + "ROUTING_CONFIG"},
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "path-normalization",
+			Usage:       "Comma separated path normalization options: leading_slash, clean, nfc, case_fold (optional)",
+			Destination: &pathNormalization,
+			EnvVars:     []string{envPrefix + "PATH_NORMALIZATION"},
+			Required:    false,
+		},
+	}
+
+	logFlags = []cli.Flag{
+		&cli.StringFlag{
+			Name:        "log-level",
+			Usage:       "Log level: trace, debug, info, warn, error (optional)",
+			Value:       "debug",
+			Destination: &logLevel,
+			EnvVars:     []string{envPrefix + "LOG_LEVEL"},
+			Required:    false,
+		},
+		&cli.BoolFlag{
+			Name:        "log-json",
+			Usage:       "Log in JSON format (optional)",
+			Destination: &logJSON,
+			EnvVars:     []string{envPrefix + "LOG_JSON"},
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "log-file",
+			Usage:       "Log to this file instead of the standard error (optional)",
+			Destination: &logFile,
+			EnvVars:     []string{envPrefix + "LOG_FILE"},
+			Required:    false,
+		},
+		&cli.IntFlag{
+			Name:        "log-max-size",
+			Usage:       "Maximum size in megabytes of the log file before it gets rotated (optional)",
+			Value:       10,
+			Destination: &logMaxSize,
+			EnvVars:     []string{envPrefix + "LOG_MAX_SIZE"},
+			Required:    false,
+		},
+		&cli.IntFlag{
+			Name:        "log-max-backups",
+			Usage:       "Maximum number of rotated log files to retain, 0 means all (optional)",
+			Value:       5,
+			Destination: &logMaxBackups,
+			EnvVars:     []string{envPrefix + "LOG_MAX_BACKUPS"},
+			Required:    false,
+		},
+		&cli.IntFlag{
+			Name:        "log-max-age",
+			Usage:       "Maximum number of days to retain rotated log files, 0 means no limit (optional)",
+			Value:       28,
+			Destination: &logMaxAge,
+			EnvVars:     []string{envPrefix + "LOG_MAX_AGE"},
+			Required:    false,
+		},
+		&cli.BoolFlag{
+			Name:        "log-compress",
+			Usage:       "Compress the rotated log files (optional)",
+			Destination: &logCompress,
+			EnvVars:     []string{envPrefix + "LOG_COMPRESS"},
+			Required:    false,
+		},
+	}
+
+	tracingFlags = []cli.Flag{
+		&cli.StringFlag{
+			Name:        "tracing-exporter",
+			Usage:       "OpenTelemetry traces exporter: otlp, file. Empty means tracing disabled (optional)",
+			Destination: &tracingExporter,
+			EnvVars:     []string{envPrefix + "TRACING_EXPORTER"},
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "tracing-endpoint",
+			Usage:       "OTLP gRPC collector endpoint, for example localhost:4317 (optional)",
+			Destination: &tracingEndpoint,
+			EnvVars:     []string{envPrefix + "TRACING_ENDPOINT"},
+			Required:    false,
+		},
+		&cli.BoolFlag{
+			Name:        "tracing-insecure",
+			Usage:       "Disable TLS for the OTLP collector connection (optional)",
+			Destination: &tracingInsecure,
+			EnvVars:     []string{envPrefix + "TRACING_INSECURE"},
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "tracing-file",
+			Usage:       "Path of the file to write the spans to using the file exporter (optional)",
+			Destination: &tracingFile,
+			EnvVars:     []string{envPrefix + "TRACING_FILE"},
+			Required:    false,
+		},
+		&cli.Float64Flag{
+			Name:        "tracing-sampler-ratio",
+			Usage:       "Fraction of the traces to sample, between 0 and 1 (optional)",
+			Value:       1,
+			Destination: &tracingSamplerRatio,
+			EnvVars:     []string{envPrefix + "TRACING_SAMPLER_RATIO"},
+			Required:    false,
+		},
+	}
+
+	auditFlags = []cli.Flag{
+		&cli.StringFlag{
+			Name:        "audit-sink",
+			Usage:       "Audit log of metadata mutations: db, file. Empty means audit log disabled (optional)",
+			Destination: &auditSink,
+			EnvVars:     []string{envPrefix + "AUDIT_SINK"},
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "audit-file",
+			Usage:       "Path of the JSON lines file to write the audit records to using the file sink (optional)",
+			Destination: &auditFile,
+			EnvVars:     []string{envPrefix + "AUDIT_FILE"},
+			Required:    false,
+		},
+	}
+
+	eventFlags = []cli.Flag{
+		&cli.BoolFlag{
+			Name:        "change-events",
+			Usage:       "Publish and listen for change events using PostgreSQL LISTEN/NOTIFY (optional)",
+			Destination: &changeEvents,
+			EnvVars:     []string{envPrefix + "CHANGE_EVENTS"},
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "webhooks-config",
+			Usage:       "Path to a JSON file defining the webhooks to notify about metadata changes (optional)",
+			Destination: &webhooksConfig,
+			EnvVars:     []string{envPrefix + "WEBHOOKS_CONFIG"},
+			Required:    false,
+		},
+	}
+
+	publishEventFlags = []cli.Flag{
+		&cli.BoolFlag{
+			Name:        "change-events",
+			Usage:       "Publish a resync event using PostgreSQL NOTIFY once done, the running plugin instances discard their cached data (optional)",
+			Destination: &changeEvents,
+			EnvVars:     []string{envPrefix + "CHANGE_EVENTS"},
+			Required:    false,
+		},
+	}
+
+	cacheFlags = []cli.Flag{
+		&cli.StringFlag{
+			Name:        "redis-url",
+			Usage:       "URL of a Redis compatible server to use as shared cache and cleanup coordinator, SQL databases only (optional)",
+			Destination: &redisURL,
+			EnvVars:     []string{envPrefix + "REDIS_URL"},
+			Required:    false,
+		},
+		&cli.DurationFlag{
+			Name:        "redis-ttl",
+			Usage:       "Expiration for the data cached on the Redis server",
+			Value:       5 * time.Minute,
+			Destination: &redisTTL,
+			EnvVars:     []string{envPrefix + "REDIS_TTL"},
+			Required:    false,
+		},
+		&cli.StringFlag{
+			Name:        "redis-key-prefix",
+			Usage:       "Prefix for the keys stored on the Redis server",
+			Value:       "sftpgo-metadata:",
+			Destination: &redisKeyPrefix,
+			EnvVars:     []string{envPrefix + "REDIS_KEY_PREFIX"},
+			Required:    false,
+		},
+	}
+
+	auditQueryFlags = []cli.Flag{
+		&cli.StringFlag{
+			Name:        "audit-file",
+			Usage:       "Read the audit records from this JSON lines file instead of the database (optional)",
+			Destination: &auditFile,
+			EnvVars:     []string{envPrefix + "AUDIT_FILE"},
+		},
+		&cli.StringFlag{
+			Name:        "storage-id",
+			Usage:       "Show the records for this storage ID only (optional)",
+			Destination: &auditQueryStorageID,
+		},
+		&cli.StringFlag{
+			Name:        "path-prefix",
+			Usage:       "Show the records for the paths starting with this prefix only (optional)",
+			Destination: &auditQueryPathPrefix,
+		},
+		&cli.StringFlag{
+			Name:        "from",
+			Usage:       "Show the records from this time, RFC 3339 formatted, included (optional)",
+			Destination: &auditQueryFrom,
+		},
+		&cli.StringFlag{
+			Name:        "to",
+			Usage:       "Show the records up to this time, RFC 3339 formatted, included (optional)",
+			Destination: &auditQueryTo,
+		},
+		&cli.BoolFlag{
+			Name:        "json",
+			Usage:       "Print the records as JSON lines (optional)",
+			Destination: &auditQueryJSON,
+		},
+	}
+
+	dumpFlags = []cli.Flag{
+		&cli.StringFlag{
+			Name:        "storage-id",
+			Usage:       "Storage ID to dump the metadata for (required)",
+			Destination: &dumpStorageID,
+			Required:    true,
+		},
+		&cli.StringSliceFlag{
+			Name:        "folder",
+			Usage:       "Dump the metadata for this folder, can be repeated (optional)",
+			Destination: &dumpFolders,
+		},
+		&cli.StringFlag{
+			Name:        "prefix",
+			Usage:       "Dump the metadata for this folder and all its subfolders. Default: all the folders (optional)",
+			Destination: &dumpPrefix,
+		},
+	}
+
+	normalizeFlags = []cli.Flag{
+		&cli.StringFlag{
+			Name:        "storage-id",
+			Usage:       "Normalize the paths for this storage ID only. Default: all the storages (optional)",
+			Destination: &normalizeStorageID,
+		},
+		&cli.BoolFlag{
+			Name:        "dry-run",
+			Usage:       "Report the changes without applying them (optional)",
+			Destination: &normalizeDryRun,
+		},
+	}
+
+	migrateFlags = []cli.Flag{
+		&cli.StringFlag{
+			Name:        "to",
+			Usage:       "Migrate up to this migration ID, included. Default: latest (optional)",
+			Destination: &migrationTarget,
+		},
+		&cli.BoolFlag{
+			Name:        "dry-run",
+			Usage:       "Print the SQL statements that would be executed without changing the database (optional)",
+			Destination: &migrationDryRun,
+		},
+	}
+
+	rollbackFlags = []cli.Flag{
+		&cli.StringFlag{
+			Name:        "to",
+			Usage:       "Undo the migrations applied after this migration ID (required)",
+			Destination: &migrationTarget,
+			Required:    true,
+		},
+		&cli.BoolFlag{
+			Name:        "dry-run",
+			Usage:       "Print the SQL statements that would be executed without changing the database (optional)",
+			Destination: &migrationDryRun,
+		},
+	}
+
+	resetFlags = []cli.Flag{
+		&cli.StringSliceFlag{
+			Name: "confirm-database",
+			Usage: "Name of the database to reset, it must match the database the DSN points to. Repeat the flag to " +
+				"confirm each routed database affected by the reset (required)",
+			Destination: &resetConfirmDatabases,
+			Required:    true,
+		},
+		&cli.BoolFlag{
+			Name:        "yes",
+			Aliases:     []string{"y"},
+			Usage:       "Do not ask for confirmation (optional)",
+			Destination: &resetYes,
+		},
+		&cli.StringFlag{
+			Name:        "backup-to",
+			Usage:       "Path to a new file to export the metadata to, as JSON lines, before removing them (optional)",
+			Destination: &resetBackupPath,
+		},
+		&cli.StringFlag{
+			Name:        "storage-id",
+			Usage:       "Remove the metadata for this storage ID only, the schema is preserved (optional)",
+			Destination: &resetStorageID,
+		},
+	}
+
+	storageRenameFlags = []cli.Flag{
+		&cli.StringFlag{
+			Name:        "from",
+			Usage:       "Storage ID to move the metadata from (required)",
+			Destination: &storageSourceID,
+			Required:    true,
+		},
+		&cli.StringFlag{
+			Name:        "to",
+			Usage:       "Storage ID to move the metadata to (required)",
+			Destination: &storageTargetID,
+			Required:    true,
+		},
+	}
+
+	storageMergeFlags = []cli.Flag{
+		&cli.StringFlag{
+			Name:        "conflict",
+			Usage:       "How to resolve the files existing for both storage IDs: newer, source, target (optional)",
+			Value:       db.ConflictRuleNewer,
+			Destination: &storageConflictRule,
+		},
+	}
+
+	copyFlags = []cli.Flag{
+		&cli.StringFlag{
+			Name:        "from-storage-id",
+			Usage:       "Storage ID to copy the metadata from (required)",
+			Destination: &copySourceStorageID,
+			Required:    true,
+		},
+		&cli.StringFlag{
+			Name:        "from-prefix",
+			Usage:       "Copy the metadata for this folder and all its subfolders. Default: all the folders (optional)",
+			Destination: &copySourcePrefix,
+		},
+		&cli.StringFlag{
+			Name:        "to-storage-id",
+			Usage:       "Storage ID to copy the metadata to (required)",
+			Destination: &copyTargetStorageID,
+			Required:    true,
+		},
+		&cli.StringFlag{
+			Name:        "to-prefix",
+			Usage:       "Folder replacing the source prefix in the copied paths. Default: the root folder (optional)",
+			Destination: &copyTargetPrefix,
+		},
+		&cli.StringFlag{
+			Name:        "conflict",
+			Usage:       "How to resolve the files already existing in the target: newer, source, target (optional)",
+			Value:       db.ConflictRuleNewer,
+			Destination: &copyConflictRule,
+		},
+		&cli.BoolFlag{
+			Name:        "dry-run",
+			Usage:       "Report the changes without applying them (optional)",
+			Destination: &copyDryRun,
+		},
+	}
+
+	statsFlags = []cli.Flag{
+		&cli.StringFlag{
+			Name:        "storage-id",
+			Usage:       "Show the statistics for this storage ID only. Default: all the storages (optional)",
+			Destination: &statsStorageID,
+		},
+		&cli.IntFlag{
+			Name:        "largest-folders",
+			Usage:       "Number of folders with the most files to show (optional)",
+			Value:       10,
+			Destination: &statsLargestFolders,
+		},
+		&cli.BoolFlag{
+			Name:        "estimate",
+			Usage:       "Show the total number of folders and files estimated from the database catalog, the other statistics are not computed. Ignored if storage-id is set (optional)",
+			Destination: &statsEstimate,
+		},
+		&cli.BoolFlag{
+			Name:        "json",
+			Usage:       "Print the statistics as JSON (optional)",
+			Destination: &statsJSON,
+		},
 	}
 
 	rootCmd = &cli.App{
@@ -75,27 +583,106 @@ var (
 		Usage:   "SFTPGo metadata plugin",
 		Commands: []*cli.Command{
 			{
-				Name:  "serve",
-				Usage: "Launch the SFTPGo plugin, it must be called from an SFTPGo instance",
-				Flags: dbFlags,
+				Name:   "serve",
+				Usage:  "Launch the SFTPGo plugin, it must be called from an SFTPGo instance",
+				Flags:  getFlags(dbFlags, logFlags, tracingFlags, auditFlags, eventFlags, cacheFlags),
+				Before: initializeLogger,
 				Action: func(_ *cli.Context) error {
+					config := getDBConfig(false)
+					config.ChangeEvents = changeEvents
 					logger.AppLogger.Info("starting sftpgo-plugin-metadata", "version", getVersionString(),
-						"database driver", driver)
-					if err := db.Initialize(driver, dsn, customTLSConfig, false); err != nil {
+						"database driver", driver, "dsn", config.RedactedDSN())
+					shutdownTracing, err := tracing.Initialize(getTracingConfig(), version)
+					if err != nil {
+						logger.AppLogger.Error("unable to initialize tracing", "error", err)
+						return err
+					}
+					defer func() {
+						ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+						defer cancel()
+
+						if err := shutdownTracing(ctx); err != nil {
+							logger.AppLogger.Error("unable to flush traces", "error", err)
+						}
+					}()
+
+					redisCache, err := newRedisCache()
+					if err != nil {
+						return err
+					}
+					if redisCache != nil {
+						defer redisCache.Close()
+						config.FolderIDCache = redisCache
+					}
+
+					auditLog, err := db.NewAuditLog(getAuditConfig())
+					if err != nil {
+						logger.AppLogger.Error("unable to initialize audit log", "error", err)
+						return err
+					}
+					defer auditLog.Close()
+
+					changes := db.NewChangeDispatcher()
+					config.Hooks = db.StoreHooks{AuditLog: auditLog, Changes: changes}
+
+					store, err := db.NewStore(config)
+					if err != nil {
 						logger.AppLogger.Error("unable to initialize database", "error", err)
 						return err
 					}
-					if err := migration.MigrateDatabase(db.Handle); err != nil {
-						logger.AppLogger.Error("unable to migrate database", "error", err)
+					defer store.Close()
+
+					sqlStore, isSQL := store.(*db.SQLStore)
+					if !isSQL && redisCache != nil {
+						err := fmt.Errorf("the redis cache is not supported for database driver %v", driver)
+						logger.AppLogger.Error("unable to initialize cache", "error", err)
+						return err
+					}
+					if isSQL {
+						err = sqlStore.ForEachDatabase(func(_ string, handle *gorm.DB) error {
+							return migration.MigrateDatabase(handle)
+						})
+						if err != nil {
+							logger.AppLogger.Error("unable to migrate database", "error", err)
+							return err
+						}
+					} else if auditSink == db.AuditSinkDB {
+						err := fmt.Errorf("the audit sink %q is not supported for database driver %v", auditSink, driver)
+						logger.AppLogger.Error("unable to initialize audit log", "error", err)
 						return err
 					}
 
-					go db.ScheduleCleanup()
+					if webhooksConfig != "" {
+						webhooks, err := initializeWebhooks(changes)
+						if err != nil {
+							logger.AppLogger.Error("unable to initialize webhooks", "error", err)
+							return err
+						}
+						defer webhooks.Close()
+					}
+
+					metadater, err := newMetadater(store, redisCache)
+					if err != nil {
+						return err
+					}
+
+					if cleanupStore, ok := store.(db.CleanupStore); ok {
+						var locker db.Locker
+						if redisCache != nil {
+							locker = redisCache
+						}
+						go db.ScheduleCleanup(cleanupStore, locker)
+					}
+					if changeEvents && isSQL {
+						changes.AddConsumer(db.ChangeConsumerFunc(logChangeEvent))
+						changes.AddConsumer(metadater)
+						go sqlStore.ListenForChanges(context.Background()) //nolint:errcheck
+					}
 
 					plugin.Serve(&plugin.ServeConfig{
 						HandshakeConfig: metadata.Handshake,
 						Plugins: map[string]plugin.Plugin{
-							metadata.PluginName: &metadata.Plugin{Impl: &db.Metadater{}},
+							metadata.PluginName: &metadata.Plugin{Impl: metadater},
 						},
 						GRPCServer: plugin.DefaultGRPCServer,
 					})
@@ -104,48 +691,88 @@ var (
 				},
 			},
 			{
-				Name:  "migrate",
-				Usage: "Apply database schema migrations",
-				Flags: dbFlags,
-				Action: func(_ *cli.Context) error {
-					if err := db.Initialize(driver, dsn, customTLSConfig, true); err != nil {
-						logger.AppLogger.Error("unable to initialize database", "error", err)
-						return err
-					}
-					if err := migration.MigrateDatabase(db.Handle); err != nil {
-						logger.AppLogger.Error("unable to migrate database", "error", err)
-						return err
-					}
-					return nil
+				Name:   "migrate",
+				Usage:  "Apply database schema migrations",
+				Flags:  getFlags(migrateFlags, withoutRequiredFlags(dbFlags), logFlags),
+				Before: initializeLogger,
+				Action: migrateDatabase,
+				Subcommands: []*cli.Command{
+					{
+						Name:   "status",
+						Usage:  "Show the applied and pending migrations",
+						Flags:  getFlags(dbFlags, logFlags),
+						Before: initializeLogger,
+						Action: showMigrationStatus,
+					},
+					{
+						Name:   "rollback",
+						Usage:  "Undo the migrations applied after the specified one",
+						Flags:  getFlags(rollbackFlags, dbFlags, logFlags),
+						Before: initializeLogger,
+						Action: rollbackDatabase,
+					},
 				},
 			},
 			{
-				Name:  "reset",
-				Usage: "Reset the database schema, any data will be lost",
-				Flags: dbFlags,
-				Action: func(_ *cli.Context) error {
-					fmt.Println("You are about to delete all database data and schema", "driver", fmt.Sprintf("%#v", driver),
-						"dsn", fmt.Sprintf("%#v", dsn), "Are you sure?")
-					fmt.Println("Y/n")
-					reader := bufio.NewReader(os.Stdin)
-					answer, err := reader.ReadString('\n')
-					if err != nil {
-						fmt.Println("unexpected error", err)
-						return err
-					}
-					if strings.ToUpper(strings.TrimSpace(answer)) != "Y" {
-						fmt.Println("Aborted!")
-						return errors.New("command aborted")
-					}
-					if err := db.Initialize(driver, dsn, customTLSConfig, true); err != nil {
-						logger.AppLogger.Error("unable to initialize database", "error", err)
-						return err
-					}
-					if err := migration.ResetDatabase(db.Handle); err != nil {
-						logger.AppLogger.Error("unable to reset database", "error", err)
-						return err
-					}
-					return nil
+				Name:   "dump",
+				Usage:  "Print the modification times for the files within the specified folders as JSON",
+				Flags:  getFlags(dumpFlags, dbFlags, logFlags),
+				Before: initializeLogger,
+				Action: dumpModificationTimes,
+			},
+			{
+				Name:   "normalize",
+				Usage:  "Apply the path normalization policy to the stored metadata merging duplicates",
+				Flags:  getFlags(normalizeFlags, dbFlags, logFlags, cacheFlags, auditFlags),
+				Before: initializeLogger,
+				Action: normalizePaths,
+			},
+			{
+				Name:   "audit",
+				Usage:  "Show the audit log of metadata mutations",
+				Flags:  getFlags(auditQueryFlags, withoutRequiredFlags(dbFlags), logFlags),
+				Before: initializeLogger,
+				Action: showAuditLog,
+			},
+			{
+				Name:   "reset",
+				Usage:  "Reset the database schema, any data will be lost",
+				Flags:  getFlags(resetFlags, dbFlags, logFlags, cacheFlags, auditFlags),
+				Before: initializeLogger,
+				Action: resetDatabase,
+			},
+			{
+				Name:   "stats",
+				Usage:  "Show statistics about the stored metadata",
+				Flags:  getFlags(statsFlags, dbFlags, logFlags),
+				Before: initializeLogger,
+				Action: showStatistics,
+			},
+			{
+				Name:   "copy",
+				Usage:  "Copy the metadata for a storage ID and path prefix to another storage ID and path prefix",
+				Flags:  getFlags(copyFlags, dbFlags, logFlags, cacheFlags, auditFlags),
+				Before: initializeLogger,
+				Action: copyMetadata,
+			},
+			{
+				Name:  "storage",
+				Usage: "Move the metadata between storage IDs, for example after moving a bucket",
+				Subcommands: []*cli.Command{
+					{
+						Name:   "rename",
+						Usage:  "Move all the metadata to a storage ID without metadata",
+						Flags:  getFlags(storageRenameFlags, dbFlags, logFlags, cacheFlags, auditFlags, publishEventFlags),
+						Before: initializeLogger,
+						Action: renameStorage,
+					},
+					{
+						Name:   "merge",
+						Usage:  "Move all the metadata to a storage ID merging the existing folders and files",
+						Flags:  getFlags(storageRenameFlags, storageMergeFlags, dbFlags, logFlags, cacheFlags, auditFlags, publishEventFlags),
+						Before: initializeLogger,
+						Action: mergeStorage,
+					},
 				},
 			},
 		},
@@ -157,6 +784,705 @@ func Execute() error {
 	return rootCmd.Run(os.Args)
 }
 
+func migrateDatabase(_ *cli.Context) error {
+	if driver == "" {
+		err := errors.New(`required flag "driver" not set`)
+		logger.AppLogger.Error("unable to migrate database", "error", err)
+		return err
+	}
+	store, err := openStore(!migrationDryRun)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	if migrationDryRun {
+		err := store.ForEachDatabase(func(name string, handle *gorm.DB) error {
+			statements, err := migration.DryRunMigrate(handle, migrationTarget)
+			if err != nil {
+				return err
+			}
+			printDatabaseName(name)
+			printStatements(statements)
+			return nil
+		})
+		if err != nil {
+			logger.AppLogger.Error("unable to simulate database migration", "error", err)
+		}
+		return err
+	}
+	err = store.ForEachDatabase(func(_ string, handle *gorm.DB) error {
+		return migration.MigrateDatabaseTo(handle, migrationTarget)
+	})
+	if err != nil {
+		logger.AppLogger.Error("unable to migrate database", "error", err)
+	}
+	return err
+}
+
+func rollbackDatabase(_ *cli.Context) error {
+	store, err := openStore(!migrationDryRun)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	if migrationDryRun {
+		err := store.ForEachDatabase(func(name string, handle *gorm.DB) error {
+			statements, err := migration.DryRunRollback(handle, migrationTarget)
+			if err != nil {
+				return err
+			}
+			printDatabaseName(name)
+			printStatements(statements)
+			return nil
+		})
+		if err != nil {
+			logger.AppLogger.Error("unable to simulate database rollback", "error", err)
+		}
+		return err
+	}
+	err = store.ForEachDatabase(func(_ string, handle *gorm.DB) error {
+		return migration.RollbackDatabaseTo(handle, migrationTarget)
+	})
+	if err != nil {
+		logger.AppLogger.Error("unable to rollback database", "error", err)
+	}
+	return err
+}
+
+func showMigrationStatus(_ *cli.Context) error {
+	store, err := openStore(false)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	err = store.ForEachDatabase(func(name string, handle *gorm.DB) error {
+		statuses, err := migration.GetStatus(handle)
+		if err != nil {
+			return err
+		}
+		printDatabaseName(name)
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tSTATUS")
+		for _, status := range statuses {
+			switch {
+			case status.Unknown:
+				fmt.Fprintf(w, "%s\tapplied, unknown to this version\n", status.ID)
+			case status.Applied:
+				fmt.Fprintf(w, "%s\tapplied\n", status.ID)
+			default:
+				fmt.Fprintf(w, "%s\tpending\n", status.ID)
+			}
+		}
+		return w.Flush()
+	})
+	if err != nil {
+		logger.AppLogger.Error("unable to get migrations status", "error", err)
+	}
+	return err
+}
+
+// printDatabaseName prints the name of the database the following output
+// refers to, if storage routing is configured
+func printDatabaseName(name string) {
+	if routingConfig != "" {
+		fmt.Printf("-- database: %s\n", name)
+	}
+}
+
+func printStatements(statements []string) {
+	if len(statements) == 0 {
+		fmt.Println("-- nothing to do")
+		return
+	}
+	for _, statement := range statements {
+		fmt.Printf("%s;\n", statement)
+	}
+}
+
+func resetDatabase(_ *cli.Context) error {
+	config := getDBConfig(true)
+	store, err := openCachedStore(true)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	// each database affected by the reset, including the routed ones, must
+	// be confirmed
+	dbNames, err := store.GetDatabaseNames(resetStorageID)
+	if err != nil {
+		logger.AppLogger.Error("unable to get the database names", "error", err)
+		return err
+	}
+	for _, dbName := range dbNames {
+		if !slices.Contains(resetConfirmDatabases.Value(), dbName) {
+			fmt.Printf("The reset affects the database %q, not confirmed by %q. Aborted!\n", dbName,
+				resetConfirmDatabases.Value())
+			return errors.New("database name mismatch")
+		}
+	}
+	if !resetYes {
+		if resetStorageID != "" {
+			fmt.Println("You are about to delete all the metadata for the storage ID", fmt.Sprintf("%#v", resetStorageID),
+				"driver", fmt.Sprintf("%#v", driver), "dsn", fmt.Sprintf("%#v", config.RedactedDSN()), "Are you sure?")
+		} else {
+			fmt.Println("You are about to delete all database data and schema", "driver", fmt.Sprintf("%#v", driver),
+				"dsn", fmt.Sprintf("%#v", config.RedactedDSN()), "Are you sure?")
+		}
+		fmt.Println("Y/n")
+		reader := bufio.NewReader(os.Stdin)
+		answer, err := reader.ReadString('\n')
+		if err != nil {
+			fmt.Println("unexpected error", err)
+			return err
+		}
+		if strings.ToUpper(strings.TrimSpace(answer)) != "Y" {
+			fmt.Println("Aborted!")
+			return errors.New("command aborted")
+		}
+	}
+	if resetBackupPath != "" {
+		if err := backupMetadata(store.SQLStore, resetBackupPath, resetStorageID); err != nil {
+			logger.AppLogger.Error("unable to backup metadata", "path", resetBackupPath, "error", err)
+			return err
+		}
+	}
+	if resetStorageID != "" {
+		removed, err := store.RemoveStorage(resetStorageID)
+		invalidateCachedStorages(store.cache, resetStorageID)
+		if err != nil {
+			logger.AppLogger.Error("unable to remove storage metadata", "storage id", resetStorageID, "error", err)
+			return err
+		}
+		fmt.Printf("Removed %d folders for storage ID %q\n", removed, resetStorageID)
+		return nil
+	}
+	err = store.ForEachDatabase(func(_ string, handle *gorm.DB) error {
+		return migration.ResetDatabase(handle)
+	})
+	invalidateCachedStorages(store.cache)
+	if err != nil {
+		logger.AppLogger.Error("unable to reset database", "error", err)
+		return err
+	}
+	return nil
+}
+
+// backupMetadata exports the metadata to a new file, an existing file is never overwritten.
+// If the export fails, the partially written file is removed
+func backupMetadata(store *db.SQLStore, name, storageID string) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	exported, err := store.ExportMetadata(f, storageID)
+	if err != nil {
+		f.Close()
+		os.Remove(name)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(name)
+		return err
+	}
+	fmt.Printf("Exported %d records to %q\n", exported, name)
+	return nil
+}
+
+func initializeWebhooks(changes *db.ChangeDispatcher) (*webhook.Manager, error) {
+	config, err := webhook.LoadConfig(webhooksConfig)
+	if err != nil {
+		return nil, err
+	}
+	manager, err := webhook.NewManager(config)
+	if err != nil {
+		return nil, err
+	}
+	changes.AddLocalConsumer(manager)
+	return manager, nil
+}
+
+func logChangeEvent(event db.ChangeEvent) {
+	if event.IsLocal() {
+		return
+	}
+	logger.AppLogger.Trace("change event received", "operation", event.Operation, "storage_id", event.StorageID,
+		"folder", event.FolderPath, "name", event.FileName, "origin", event.Origin)
+}
+
+func normalizePaths(_ *cli.Context) error {
+	if pathNormalization == "" {
+		err := errors.New(`required flag "path-normalization" not set`)
+		logger.AppLogger.Error("unable to normalize paths", "error", err)
+		return err
+	}
+	policy, err := db.ParseNormalizationPolicy(pathNormalization)
+	if err != nil {
+		logger.AppLogger.Error("invalid path normalization", "error", err)
+		return err
+	}
+	store, err := openCachedStore(false)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	result, err := store.NormalizeStoredPaths(policy, normalizeStorageID, normalizeDryRun)
+	if !normalizeDryRun {
+		invalidateCachedStorages(store.cache, normalizeStorageID)
+	}
+	if err != nil {
+		logger.AppLogger.Error("unable to normalize paths", "error", err)
+		return err
+	}
+	action := "normalized"
+	if normalizeDryRun {
+		action = "would be normalized, dry run"
+	}
+	fmt.Printf("paths %s: %d files moved or renamed, %d files merged, %d folders removed\n", action,
+		result.Files, result.MergedFiles, result.Folders)
+	return nil
+}
+
+func renameStorage(_ *cli.Context) error {
+	store, err := openCachedStore(false)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	renamed, err := store.RenameStorage(storageSourceID, storageTargetID)
+	invalidateCachedStorages(store.cache, storageSourceID, storageTargetID)
+	if err != nil {
+		logger.AppLogger.Error("unable to rename storage", "source", storageSourceID, "target", storageTargetID,
+			"renamed folders", renamed, "error", err)
+		return err
+	}
+	fmt.Printf("Moved %d folders from storage ID %q to %q\n", renamed, storageSourceID, storageTargetID)
+	return nil
+}
+
+func mergeStorage(_ *cli.Context) error {
+	if err := db.ValidateConflictRule(storageConflictRule); err != nil {
+		logger.AppLogger.Error("invalid conflict rule", "error", err)
+		return err
+	}
+	store, err := openCachedStore(false)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	result, err := store.MergeStorage(storageSourceID, storageTargetID, storageConflictRule)
+	invalidateCachedStorages(store.cache, storageSourceID, storageTargetID)
+	if err != nil {
+		logger.AppLogger.Error("unable to merge storage", "source", storageSourceID, "target", storageTargetID,
+			"error", err)
+		return err
+	}
+	fmt.Printf("Merged storage ID %q into %q: %d folders moved, %d folders merged, %d files moved, %d files merged\n",
+		storageSourceID, storageTargetID, result.Folders, result.MergedFolders, result.Files, result.MergedFiles)
+	return nil
+}
+
+func copyMetadata(_ *cli.Context) error {
+	store, err := openCachedStore(false)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	// the copied folders are invalidated by the Metadater
+	m, err := newMetadater(store.SQLStore, store.cache)
+	if err != nil {
+		return err
+	}
+	var lastReport time.Time
+	options := db.CopyOptions{
+		SourceStorageID: copySourceStorageID,
+		SourcePrefix:    copySourcePrefix,
+		TargetStorageID: copyTargetStorageID,
+		TargetPrefix:    copyTargetPrefix,
+		ConflictRule:    copyConflictRule,
+		DryRun:          copyDryRun,
+		Progress: func(folderPath string, result db.CopyResult) {
+			if time.Since(lastReport) < copyProgressInterval {
+				return
+			}
+			lastReport = time.Now()
+			logger.AppLogger.Info("copy in progress", "folder", folderPath, "folders", result.Folders,
+				"files", result.Files, "updated files", result.UpdatedFiles, "skipped files", result.SkippedFiles)
+		},
+	}
+	result, err := m.CopyMetadata(context.Background(), options)
+	if err != nil {
+		logger.AppLogger.Error("unable to copy metadata", "folders", result.Folders, "error", err)
+		return err
+	}
+	action := "copied"
+	if copyDryRun {
+		action = "would be copied, dry run"
+	}
+	fmt.Printf("metadata %s: %d folders, %d files added, %d files updated, %d files skipped\n", action,
+		result.Folders, result.Files, result.UpdatedFiles, result.SkippedFiles)
+	return nil
+}
+
+func showStatistics(_ *cli.Context) error {
+	store, err := openStore(false)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	stats, err := store.GetStatistics(db.StatisticsOptions{
+		StorageID:      statsStorageID,
+		LargestFolders: statsLargestFolders,
+		Estimate:       statsEstimate,
+	})
+	if err != nil {
+		logger.AppLogger.Error("unable to get statistics", "error", err)
+		return err
+	}
+	if statsJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(stats)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	if stats.Estimated {
+		fmt.Fprintf(w, "Folders (estimated):\t%d\n", stats.Folders)
+		fmt.Fprintf(w, "Files (estimated):\t%d\n", stats.Files)
+		return w.Flush()
+	}
+	fmt.Fprintf(w, "Folders:\t%d\n", stats.Folders)
+	fmt.Fprintf(w, "Files:\t%d\n", stats.Files)
+	fmt.Fprintf(w, "Orphan folders:\t%d\n", stats.OrphanFolders)
+	fmt.Fprintf(w, "Oldest modification:\t%s\n", formatMsTime(stats.OldestModification))
+	fmt.Fprintf(w, "Newest modification:\t%s\n", formatMsTime(stats.NewestModification))
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "STORAGE ID\tFOLDERS\tFILES\tORPHAN FOLDERS\tOLDEST MTIME\tNEWEST MTIME")
+	for _, storage := range stats.Storages {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%s\t%s\n", storage.StorageID, storage.Folders, storage.Files,
+			storage.OrphanFolders, formatMsTime(storage.OldestModification), formatMsTime(storage.NewestModification))
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Largest folders:")
+	fmt.Fprintln(w, "STORAGE ID\tPATH\tFILES")
+	for _, folder := range stats.LargestFolders {
+		fmt.Fprintf(w, "%s\t%s\t%d\n", folder.StorageID, folder.Path, folder.Files)
+	}
+	return w.Flush()
+}
+
+func dumpModificationTimes(_ *cli.Context) error {
+	folders := dumpFolders.Value()
+	if len(folders) > 0 && dumpPrefix != "" {
+		err := errors.New(`the "folder" and "prefix" flags are mutually exclusive`)
+		logger.AppLogger.Error("unable to dump modification times", "error", err)
+		return err
+	}
+	store, err := openStore(false)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	m, err := newMetadater(store, nil)
+	if err != nil {
+		return err
+	}
+	var result map[string]map[string]int64
+	if len(folders) > 0 {
+		result, err = m.GetModificationTimesBulk(dumpStorageID, folders)
+	} else {
+		result, err = m.GetModificationTimesByPrefix(dumpStorageID, dumpPrefix)
+	}
+	if err != nil {
+		logger.AppLogger.Error("unable to dump modification times", "error", err)
+		return err
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(result)
+}
+
+func showAuditLog(_ *cli.Context) error {
+	filter, err := getAuditFilter()
+	if err != nil {
+		logger.AppLogger.Error("invalid audit log filter", "error", err)
+		return err
+	}
+	var w *tabwriter.Writer
+	var encoder *json.Encoder
+	if auditQueryJSON {
+		encoder = json.NewEncoder(os.Stdout)
+	} else {
+		w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "TIME\tOPERATION\tSTORAGE ID\tPATH\tOLD MTIME\tNEW MTIME\tNODE\tDETAILS")
+	}
+	printRecord := func(record *db.AuditRecord) error {
+		if encoder != nil {
+			return encoder.Encode(record)
+		}
+		_, err := fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", formatMsTime(&record.Timestamp),
+			record.Operation, record.StorageID, record.Path, formatMsTime(record.OldLastModified),
+			formatMsTime(record.NewLastModified), record.Node, record.Details)
+		return err
+	}
+
+	if auditFile != "" {
+		err = db.QueryAuditFile(auditFile, filter, printRecord)
+	} else {
+		if driver == "" {
+			err := errors.New(`required flag "driver" or "audit-file" not set`)
+			logger.AppLogger.Error("unable to query audit log", "error", err)
+			return err
+		}
+		store, storeErr := openStore(false)
+		if storeErr != nil {
+			return storeErr
+		}
+		defer store.Close()
+
+		err = store.QueryAuditLog(filter, printRecord)
+	}
+	if err != nil {
+		logger.AppLogger.Error("unable to query audit log", "error", err)
+		return err
+	}
+	if w != nil {
+		return w.Flush()
+	}
+	return nil
+}
+
+func getAuditFilter() (db.AuditFilter, error) {
+	filter := db.AuditFilter{
+		StorageID:  auditQueryStorageID,
+		PathPrefix: auditQueryPathPrefix,
+	}
+	var err error
+	if auditQueryFrom != "" {
+		filter.From, err = time.Parse(time.RFC3339, auditQueryFrom)
+		if err != nil {
+			return filter, err
+		}
+	}
+	if auditQueryTo != "" {
+		filter.To, err = time.Parse(time.RFC3339, auditQueryTo)
+		if err != nil {
+			return filter, err
+		}
+	}
+	return filter, nil
+}
+
+// formatMsTime formats a time expressed as milliseconds since epoch, nil is
+// formatted as "-"
+func formatMsTime(ms *int64) string {
+	if ms == nil {
+		return "-"
+	}
+	return time.UnixMilli(*ms).UTC().Format(time.RFC3339Nano)
+}
+
+func initializeLogger(_ *cli.Context) error {
+	err := logger.Initialize(logger.Config{
+		Level:      logLevel,
+		JSON:       logJSON,
+		File:       logFile,
+		MaxSize:    logMaxSize,
+		MaxBackups: logMaxBackups,
+		MaxAge:     logMaxAge,
+		Compress:   logCompress,
+	})
+	if err != nil {
+		logger.AppLogger.Error("unable to initialize logger", "error", err)
+	}
+	return err
+}
+
+// getFlags returns the concatenation of the specified flag sets
+func getFlags(sets ...[]cli.Flag) []cli.Flag {
+	var result []cli.Flag
+	for _, set := range sets {
+		result = append(result, set...)
+	}
+	return result
+}
+
+// withoutRequiredFlags returns a copy of the specified flags with none of them
+// required. urfave/cli checks the required flags of a command before dispatching
+// to its subcommands, so a command with subcommands must check them itself
+func withoutRequiredFlags(flags []cli.Flag) []cli.Flag {
+	result := make([]cli.Flag, 0, len(flags))
+	for _, flag := range flags {
+		if f, ok := flag.(*cli.StringFlag); ok && f.Required {
+			optional := *f
+			optional.Required = false
+			flag = &optional
+		}
+		result = append(result, flag)
+	}
+	return result
+}
+
+func getDBConfig(debug bool) db.Config {
+	return db.Config{
+		Driver:               driver,
+		DSN:                  dsn,
+		DSNFile:              dsnFile,
+		PasswordFile:         passwordFile,
+		CustomTLSConfig:      customTLSConfig,
+		Debug:                debug,
+		SlowThreshold:        slowThreshold,
+		RoutingConfig:        routingConfig,
+		ReplicaDSNs:          replicaDSNs.Value(),
+		ReadAfterWriteWindow: readAfterWriteWindow,
+	}
+}
+
+// openStore returns the SQL store for the configured databases
+func openStore(debug bool) (*db.SQLStore, error) {
+	store, err := db.NewSQLStore(getDBConfig(debug))
+	if err != nil {
+		logger.AppLogger.Error("unable to initialize database", "error", err)
+	}
+	return store, err
+}
+
+// cachedStore is the SQL store used by the commands changing the stored
+// metadata, with the configured Redis cache and audit log, nil if not
+// configured. The cache is used to invalidate the data cached by the running
+// plugin instances
+type cachedStore struct {
+	*db.SQLStore
+	cache    *db.RedisCache
+	auditLog *db.AuditLog
+}
+
+// Close releases the store, the cache and the audit log
+func (s *cachedStore) Close() {
+	s.SQLStore.Close()
+	if s.cache != nil {
+		s.cache.Close()
+	}
+	s.auditLog.Close()
+}
+
+// openCachedStore returns the SQL store for the configured databases with the
+// configured Redis cache and audit log
+func openCachedStore(debug bool) (*cachedStore, error) {
+	cache, err := newRedisCache()
+	if err != nil {
+		return nil, err
+	}
+	auditLog, err := db.NewAuditLog(getAuditConfig())
+	if err != nil {
+		logger.AppLogger.Error("unable to initialize audit log", "error", err)
+		if cache != nil {
+			cache.Close()
+		}
+		return nil, err
+	}
+	config := getDBConfig(debug)
+	config.ChangeEvents = changeEvents
+	config.Hooks.AuditLog = auditLog
+	if cache != nil {
+		config.FolderIDCache = cache
+	}
+	store, err := db.NewSQLStore(config)
+	if err != nil {
+		logger.AppLogger.Error("unable to initialize database", "error", err)
+		if cache != nil {
+			cache.Close()
+		}
+		auditLog.Close()
+		return nil, err
+	}
+	return &cachedStore{
+		SQLStore: store,
+		cache:    cache,
+		auditLog: auditLog,
+	}, nil
+}
+
+// invalidateCachedStorages discards the cached folder listings for the
+// specified storage IDs, for all the storages if none is specified. The
+// listings are invalidated even after a failure, the metadata could be
+// partially changed
+func invalidateCachedStorages(cache *db.RedisCache, storageIDs ...string) {
+	if cache == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if len(storageIDs) == 0 || (len(storageIDs) == 1 && storageIDs[0] == "") {
+		cache.Invalidate(ctx, "", "")
+		return
+	}
+	for _, storageID := range storageIDs {
+		cache.Invalidate(ctx, storageID, "")
+	}
+}
+
+// newMetadater returns a Metadater for the specified store and the
+// configured path normalization and timeouts. The cache is optional
+func newMetadater(store db.Store, cache *db.RedisCache) (*db.Metadater, error) {
+	policy, err := db.ParseNormalizationPolicy(pathNormalization)
+	if err != nil {
+		logger.AppLogger.Error("invalid path normalization", "error", err)
+		return nil, err
+	}
+	config := db.MetadaterConfig{
+		PathPolicy:   policy,
+		QueryTimeout: queryTimeout,
+		Logger:       logger.AppLogger,
+	}
+	if cache != nil {
+		config.Cache = cache
+	}
+	return db.NewMetadater(store, config), nil
+}
+
+// newRedisCache returns the configured Redis cache, nil if not configured
+func newRedisCache() (*db.RedisCache, error) {
+	if redisURL == "" {
+		return nil, nil
+	}
+	cache, err := db.NewRedisCache(db.RedisCacheConfig{
+		URL:       redisURL,
+		TTL:       redisTTL,
+		KeyPrefix: redisKeyPrefix,
+	})
+	if err != nil {
+		logger.AppLogger.Error("unable to initialize redis cache", "error", err)
+	}
+	return cache, err
+}
+
+func getAuditConfig() db.AuditConfig {
+	return db.AuditConfig{
+		Sink: auditSink,
+		File: auditFile,
+	}
+}
+
+func getTracingConfig() tracing.Config {
+	return tracing.Config{
+		Exporter:     tracingExporter,
+		Endpoint:     tracingEndpoint,
+		Insecure:     tracingInsecure,
+		File:         tracingFile,
+		SamplerRatio: tracingSamplerRatio,
+	}
+}
+
 func getVersionString() string {
 	var sb strings.Builder
 	sb.WriteString(version)
@@ -0,0 +1,394 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/sftpgo/sftpgo-plugin-metadata/logger"
+)
+
+// Supported audit sinks
+const (
+	AuditSinkNone = ""
+	AuditSinkDB   = "db"
+	AuditSinkFile = "file"
+)
+
+// Audited operations
+const (
+	AuditOperationSet    = "set"
+	AuditOperationRemove = "remove"
+	// the bulk operations are recorded once completed, with the affected
+	// counts in the record details
+	AuditOperationRemoveStorage = "remove_storage"
+	AuditOperationRenameStorage = "rename_storage"
+	AuditOperationMergeStorage  = "merge_storage"
+	AuditOperationNormalize     = "normalize"
+	AuditOperationCopy          = "copy"
+)
+
+// AuditConfig defines the audit log configuration
+type AuditConfig struct {
+	// Sink defines where the audit records are written, empty means audit log disabled
+	Sink string
+	// File is the path of the JSON lines file used by the file sink
+	File string
+}
+
+// AuditRecord defines an audit log entry for a metadata mutation
+type AuditRecord struct {
+	ID int64 `json:"-" gorm:"primarykey"`
+	// Timestamp is the mutation time as milliseconds since epoch
+	Timestamp int64  `json:"timestamp" gorm:"column:event_time"`
+	Operation string `json:"operation"`
+	StorageID string `json:"storage_id"`
+	Path      string `json:"path"`
+	// OldLastModified is nil if the metadata did not exist
+	OldLastModified *int64 `json:"old_last_modified"`
+	// NewLastModified is nil if the metadata were removed
+	NewLastModified *int64 `json:"new_last_modified"`
+	// Node is the host name of the plugin instance that applied the mutation
+	Node string `json:"node"`
+	// Details is a JSON object with the target storage ID and the affected
+	// counts for the bulk operations, empty for the other ones
+	Details string `json:"details,omitempty"`
+}
+
+func (*AuditRecord) TableName() string {
+	return "metadata_audit_logs"
+}
+
+// AuditFilter defines the criteria to query the audit log
+type AuditFilter struct {
+	// StorageID, if not empty, restricts the records to this storage ID
+	StorageID string
+	// PathPrefix, if not empty, restricts the records to this path and its descendants
+	PathPrefix string
+	// From and To, if not zero, restrict the records to this time range, both included
+	From time.Time
+	To   time.Time
+}
+
+func (f *AuditFilter) match(record *AuditRecord) bool {
+	if f.StorageID != "" && record.StorageID != f.StorageID {
+		return false
+	}
+	if f.PathPrefix != "" && !strings.HasPrefix(record.Path, f.PathPrefix) {
+		return false
+	}
+	if !f.From.IsZero() && record.Timestamp < f.From.UnixMilli() {
+		return false
+	}
+	if !f.To.IsZero() && record.Timestamp > f.To.UnixMilli() {
+		return false
+	}
+	return true
+}
+
+// auditSink defines an append-only destination for audit records
+type auditSink interface {
+	// writeTx is called within the transaction applying the mutation
+	writeTx(tx *gorm.DB, record *AuditRecord) error
+	// write is called after the transaction applying the mutation is committed
+	write(record *AuditRecord) error
+	close() error
+}
+
+// AuditLog records the metadata mutations applied by the stores using it. A nil
+// AuditLog means audit log disabled
+type AuditLog struct {
+	sink auditSink
+	// node is the host name of this plugin instance
+	node string
+}
+
+// NewAuditLog returns the audit log for the specified configuration, nil if
+// the audit log is disabled. The database sink requires an initialized and
+// migrated database
+func NewAuditLog(config AuditConfig) (*AuditLog, error) {
+	var sink auditSink
+	switch config.Sink {
+	case AuditSinkNone:
+		return nil, nil
+	case AuditSinkDB:
+		sink = &dbAuditSink{}
+	case AuditSinkFile:
+		if config.File == "" {
+			return nil, errors.New("the file audit sink requires a file path")
+		}
+		f, err := os.OpenFile(config.File, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return nil, err
+		}
+		sink = &fileAuditSink{
+			file: f,
+		}
+	default:
+		return nil, fmt.Errorf("unsupported audit sink %q", config.Sink)
+	}
+	return &AuditLog{
+		sink: sink,
+		node: getNodeName(),
+	}, nil
+}
+
+// Close releases the resources used by the audit sink
+func (l *AuditLog) Close() error {
+	if l == nil {
+		return nil
+	}
+	return l.sink.close()
+}
+
+// newRecord returns an audit record for the current time and node
+func (l *AuditLog) newRecord(operation, storageID, objectPath string, oldMTime, newMTime *int64) *AuditRecord {
+	return &AuditRecord{
+		Timestamp:       time.Now().UnixMilli(),
+		Operation:       operation,
+		StorageID:       storageID,
+		Path:            objectPath,
+		OldLastModified: oldMTime,
+		NewLastModified: newMTime,
+		Node:            l.node,
+	}
+}
+
+// writeTx sends the record to the audit sink within the transaction applying
+// the mutation
+func (l *AuditLog) writeTx(tx *gorm.DB, record *AuditRecord) error {
+	if l == nil || record == nil {
+		return nil
+	}
+	return l.sink.writeTx(tx, record)
+}
+
+// write sends the record to the audit sink after a committed mutation. The
+// mutation cannot be undone, so errors are logged
+func (l *AuditLog) write(record *AuditRecord) {
+	if l == nil || record == nil {
+		return
+	}
+	if err := l.sink.write(record); err != nil {
+		logger.AppLogger.Error("unable to write audit record", "operation", record.Operation,
+			"storage_id", record.StorageID, "path", record.Path, "error", err)
+	}
+}
+
+// writeBulk records a bulk operation, once applied. The details are encoded as
+// a JSON object. The database sink writes the record using sess, it is nil
+// for the stores without a database
+func (l *AuditLog) writeBulk(sess *gorm.DB, operation, storageID, objectPath string, details map[string]any) {
+	if l == nil {
+		return
+	}
+	data, err := json.Marshal(details)
+	if err != nil {
+		logger.AppLogger.Error("unable to encode audit record details", "operation", operation,
+			"storage_id", storageID, "error", err)
+		return
+	}
+	record := l.newRecord(operation, storageID, objectPath, nil, nil)
+	record.Details = string(data)
+	if sess != nil {
+		if err := l.sink.writeTx(sess, record); err != nil {
+			logger.AppLogger.Error("unable to write audit record", "operation", operation,
+				"storage_id", storageID, "path", objectPath, "error", err)
+		}
+	}
+	l.write(record)
+}
+
+// bulkAuditor is implemented by the stores able to record the bulk operations
+// applied outside of them, such as a metadata copy
+type bulkAuditor interface {
+	auditBulkOperation(operation, storageID, objectPath string, details map[string]any)
+}
+
+// auditBulkOperation records a bulk operation in the database routed for the
+// storage ID, the default one if empty
+func (s *SQLStore) auditBulkOperation(operation, storageID, objectPath string, details map[string]any) {
+	if s.hooks.AuditLog == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), maintenanceQueryTimeout)
+	defer cancel()
+
+	s.hooks.AuditLog.writeBulk(s.getHandle(storageID).WithContext(ctx), operation, storageID, objectPath, details)
+}
+
+// getNodeName returns the host name of this plugin instance
+func getNodeName() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+	return hostname
+}
+
+// dbAuditSink writes the audit records to the database, within the same
+// transaction as the mutation
+type dbAuditSink struct{}
+
+func (s *dbAuditSink) writeTx(tx *gorm.DB, record *AuditRecord) error {
+	return tx.Create(record).Error
+}
+
+func (s *dbAuditSink) write(_ *AuditRecord) error {
+	return nil
+}
+
+func (s *dbAuditSink) close() error {
+	return nil
+}
+
+// fileAuditSink appends the audit records to a file as JSON lines, once the
+// mutation is committed
+type fileAuditSink struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func (s *fileAuditSink) writeTx(_ *gorm.DB, _ *AuditRecord) error {
+	return nil
+}
+
+func (s *fileAuditSink) write(record *AuditRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err = s.file.Write(data)
+	return err
+}
+
+func (s *fileAuditSink) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.file.Close()
+}
+
+// getLastModified returns the modification time for the specified file or nil
+// if it does not exist
+func getLastModified(tx *gorm.DB, name string, folderID int64) (*int64, error) {
+	var files []File
+	err := tx.Where("name = ? AND folder_id = ?", name, folderID).Select("last_modified").Limit(1).Find(&files).Error
+	if err != nil || len(files) == 0 {
+		return nil, err
+	}
+	return &files[0].LastModified, nil
+}
+
+// QueryAuditLog calls fn for each audit record stored in the database matching
+// the specified filter, ordered by timestamp. Without a storage ID filter the
+// routed databases are read in turn after the default one
+func (s *SQLStore) QueryAuditLog(filter AuditFilter, fn func(record *AuditRecord) error) error {
+	for _, handle := range s.getHandles(filter.StorageID) {
+		if err := queryAuditLog(handle, filter, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func queryAuditLog(handle *gorm.DB, filter AuditFilter, fn func(record *AuditRecord) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), maintenanceQueryTimeout)
+	defer cancel()
+
+	sess := handle.WithContext(ctx)
+
+	if filter.StorageID != "" {
+		sess = sess.Where("storage_id = ?", filter.StorageID)
+	}
+	if filter.PathPrefix != "" {
+		sess = sess.Where("path LIKE ? ESCAPE '!'", escapeLikePattern(filter.PathPrefix)+"%")
+	}
+	if !filter.From.IsZero() {
+		sess = sess.Where("event_time >= ?", filter.From.UnixMilli())
+	}
+	if !filter.To.IsZero() {
+		sess = sess.Where("event_time <= ?", filter.To.UnixMilli())
+	}
+	rows, err := sess.Model(&AuditRecord{}).Order("event_time ASC, id ASC").Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var record AuditRecord
+		if err := sess.ScanRows(rows, &record); err != nil {
+			return err
+		}
+		if err := fn(&record); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// QueryAuditFile calls fn for each audit record stored in the specified JSON
+// lines file matching the specified filter, in the order they were written
+func QueryAuditFile(name string, filter AuditFilter, fn func(record *AuditRecord) error) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var record AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return fmt.Errorf("invalid audit record at line %d: %w", line, err)
+		}
+		if !filter.match(&record) {
+			continue
+		}
+		if err := fn(&record); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// escapeLikePattern escapes the LIKE wildcards using "!" as escape character,
+// it has no special meaning in string literals for any supported database
+func escapeLikePattern(s string) string {
+	r := strings.NewReplacer("!", "!!", "%", "!%", "_", "!_")
+	return r.Replace(s)
+}
@@ -0,0 +1,225 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuditLog(t *testing.T) {
+	_, err := NewAuditLog(AuditConfig{Sink: "unknown"})
+	assert.Error(t, err)
+	_, err = NewAuditLog(AuditConfig{Sink: AuditSinkFile})
+	assert.Error(t, err)
+	auditLog, err := NewAuditLog(AuditConfig{})
+	assert.NoError(t, err)
+	assert.Nil(t, auditLog)
+	assert.NoError(t, auditLog.Close())
+	defer func() {
+		testStore.hooks.AuditLog = nil
+	}()
+
+	auditFile := filepath.Join(t.TempDir(), "audit.jsonl")
+	for _, config := range []AuditConfig{{Sink: AuditSinkDB}, {Sink: AuditSinkFile, File: auditFile}} {
+		auditLog, err := NewAuditLog(config)
+		require.NoError(t, err)
+		testStore.hooks.AuditLog = auditLog
+
+		query := func(filter AuditFilter) []AuditRecord {
+			var records []AuditRecord
+			fn := func(record *AuditRecord) error {
+				records = append(records, *record)
+				return nil
+			}
+			if config.Sink == AuditSinkFile {
+				err := QueryAuditFile(auditFile, filter, fn)
+				require.NoError(t, err)
+			} else {
+				err := testStore.QueryAuditLog(filter, fn)
+				require.NoError(t, err)
+			}
+			return records
+		}
+
+		m := testMetadater
+		// the audit log is append-only, so use a new storage ID for each run
+		storageID := fmt.Sprintf("s3://audit-%v-%v", config.Sink, time.Now().UnixNano())
+		path1 := "/audit_dir/file%_1.txt"
+		path2 := "/audit_dir/sub/file2.txt"
+		start := time.Now().Add(-time.Second)
+		mTime := getTimeAsMsSinceEpoch(time.Now())
+		err = m.SetModificationTime(storageID, path1, mTime)
+		assert.NoError(t, err)
+		err = m.SetModificationTime(storageID, path1, mTime+100)
+		assert.NoError(t, err)
+		err = m.SetModificationTime(storageID, path2, mTime)
+		assert.NoError(t, err)
+		err = m.RemoveMetadata(storageID, path1)
+		assert.NoError(t, err)
+		err = m.RemoveMetadata(storageID, path1)
+		checkNotFoundError(t, err)
+
+		records := query(AuditFilter{StorageID: storageID})
+		require.Len(t, records, 4)
+		assert.Equal(t, AuditOperationSet, records[0].Operation)
+		assert.Equal(t, path1, records[0].Path)
+		assert.Nil(t, records[0].OldLastModified)
+		if assert.NotNil(t, records[0].NewLastModified) {
+			assert.Equal(t, mTime, *records[0].NewLastModified)
+		}
+		if assert.NotNil(t, records[1].OldLastModified) && assert.NotNil(t, records[1].NewLastModified) {
+			assert.Equal(t, mTime, *records[1].OldLastModified)
+			assert.Equal(t, mTime+100, *records[1].NewLastModified)
+		}
+		assert.Equal(t, AuditOperationRemove, records[3].Operation)
+		if assert.NotNil(t, records[3].OldLastModified) {
+			assert.Equal(t, mTime+100, *records[3].OldLastModified)
+		}
+		assert.Nil(t, records[3].NewLastModified)
+		assert.NotEmpty(t, records[3].Node)
+
+		records = query(AuditFilter{StorageID: storageID, PathPrefix: "/audit_dir/file%_"})
+		assert.Len(t, records, 3)
+		records = query(AuditFilter{StorageID: storageID, PathPrefix: "/audit_dir/file_"})
+		assert.Len(t, records, 0)
+		records = query(AuditFilter{StorageID: storageID, PathPrefix: "/audit_dir/sub/"})
+		assert.Len(t, records, 1)
+		records = query(AuditFilter{StorageID: storageID, From: start, To: time.Now().Add(time.Second)})
+		assert.Len(t, records, 4)
+		records = query(AuditFilter{StorageID: storageID, To: start})
+		assert.Len(t, records, 0)
+		records = query(AuditFilter{StorageID: storageID, From: time.Now().Add(time.Second)})
+		assert.Len(t, records, 0)
+
+		err = m.RemoveMetadata(storageID, path2)
+		assert.NoError(t, err)
+		assert.NoError(t, auditLog.Close())
+	}
+}
+
+func TestAuditBulkOperations(t *testing.T) {
+	defer func() {
+		testStore.hooks.AuditLog = nil
+	}()
+
+	auditFile := filepath.Join(t.TempDir(), "audit.jsonl")
+	for _, config := range []AuditConfig{{Sink: AuditSinkDB}, {Sink: AuditSinkFile, File: auditFile}} {
+		auditLog, err := NewAuditLog(config)
+		require.NoError(t, err)
+		testStore.hooks.AuditLog = auditLog
+
+		// getDetails returns the details of the only bulk record for the
+		// specified operation and storage ID
+		getDetails := func(operation, storageID, objectPath string) map[string]any {
+			var details []map[string]any
+			fn := func(record *AuditRecord) error {
+				if record.Operation != operation {
+					return nil
+				}
+				assert.Equal(t, objectPath, record.Path)
+				assert.Nil(t, record.OldLastModified)
+				assert.Nil(t, record.NewLastModified)
+				assert.NotEmpty(t, record.Node)
+				var d map[string]any
+				if err := json.Unmarshal([]byte(record.Details), &d); err != nil {
+					return err
+				}
+				details = append(details, d)
+				return nil
+			}
+			filter := AuditFilter{StorageID: storageID}
+			if config.Sink == AuditSinkFile {
+				require.NoError(t, QueryAuditFile(auditFile, filter, fn))
+			} else {
+				require.NoError(t, testStore.QueryAuditLog(filter, fn))
+			}
+			require.Len(t, details, 1, "operation %q, storage ID %q", operation, storageID)
+			return details[0]
+		}
+
+		m := testMetadater
+		suffix := fmt.Sprintf("%v-%v", config.Sink, time.Now().UnixNano())
+		sourceID := "s3://audit-bulk-src-" + suffix
+		renamedID := "s3://audit-bulk-renamed-" + suffix
+		targetID := "s3://audit-bulk-dst-" + suffix
+		mTime := getTimeAsMsSinceEpoch(time.Now())
+		require.NoError(t, m.SetModificationTime(sourceID, "/bulk/f1.txt", mTime))
+		require.NoError(t, m.SetModificationTime(sourceID, "/bulk/sub/f2.txt", mTime))
+
+		// a dry run is not recorded
+		_, err = m.CopyMetadata(context.Background(), CopyOptions{
+			SourceStorageID: sourceID,
+			SourcePrefix:    "/bulk",
+			TargetStorageID: targetID,
+			TargetPrefix:    "/copy",
+			DryRun:          true,
+		})
+		require.NoError(t, err)
+		_, err = m.CopyMetadata(context.Background(), CopyOptions{
+			SourceStorageID: sourceID,
+			SourcePrefix:    "/bulk",
+			TargetStorageID: targetID,
+			TargetPrefix:    "/copy",
+		})
+		require.NoError(t, err)
+		details := getDetails(AuditOperationCopy, sourceID, "/bulk")
+		assert.Equal(t, targetID, details["target_storage_id"])
+		assert.Equal(t, "/copy", details["target_path"])
+		assert.Equal(t, float64(2), details["folders"])
+		assert.Equal(t, float64(2), details["files"])
+		assert.Equal(t, true, details["completed"])
+
+		renamed, err := testStore.RenameStorage(sourceID, renamedID)
+		require.NoError(t, err)
+		details = getDetails(AuditOperationRenameStorage, sourceID, "")
+		assert.Equal(t, renamedID, details["target_storage_id"])
+		assert.Equal(t, float64(renamed), details["folders"])
+
+		result, err := testStore.MergeStorage(renamedID, targetID, ConflictRuleNewer)
+		require.NoError(t, err)
+		details = getDetails(AuditOperationMergeStorage, renamedID, "")
+		assert.Equal(t, targetID, details["target_storage_id"])
+		assert.Equal(t, ConflictRuleNewer, details["conflict_rule"])
+		assert.Equal(t, float64(result.Folders), details["folders"])
+		assert.Equal(t, float64(result.MergedFolders), details["merged_folders"])
+		assert.Equal(t, float64(result.Files), details["files"])
+		assert.Equal(t, float64(result.MergedFiles), details["merged_files"])
+
+		policy := NormalizationPolicy{Clean: true}
+		_, err = testStore.NormalizeStoredPaths(policy, targetID, true)
+		require.NoError(t, err)
+		_, err = testStore.NormalizeStoredPaths(policy, targetID, false)
+		require.NoError(t, err)
+		details = getDetails(AuditOperationNormalize, targetID, "")
+		assert.Equal(t, policy.String(), details["policy"])
+		assert.Equal(t, float64(0), details["files"])
+
+		removed, err := testStore.RemoveStorage(targetID)
+		require.NoError(t, err)
+		assert.Greater(t, removed, int64(0))
+		details = getDetails(AuditOperationRemoveStorage, targetID, "")
+		assert.Equal(t, float64(removed), details["folders"])
+
+		assert.NoError(t, auditLog.Close())
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"testing"
+	"time"
+)
+
+// The benchmarks compare the single query lookups with the previous two
+// queries implementation. Run them for each driver, for example:
+//
+//	SFTPGO_PLUGIN_METADATA_DRIVER=postgres SFTPGO_PLUGIN_METADATA_DSN=... go test -run '^$' -bench . ./db
+
+const benchStorageID = "s3://bench-bucket"
+
+func setupBenchmark(b *testing.B, files int) []string {
+	b.Helper()
+
+	m := testMetadater
+	mTime := getTimeAsMsSinceEpoch(time.Now())
+	paths := make([]string, 0, files)
+	for i := 0; i < files; i++ {
+		p := fmt.Sprintf("/bench/dir%d/file%d.txt", i%10, i)
+		if err := m.SetModificationTime(benchStorageID, p, mTime); err != nil {
+			b.Fatal(err)
+		}
+		paths = append(paths, p)
+	}
+	b.Cleanup(func() {
+		if _, err := testStore.RemoveStorage(benchStorageID); err != nil {
+			b.Error(err)
+		}
+	})
+	b.ResetTimer()
+	return paths
+}
+
+func BenchmarkGetModificationTime(b *testing.B) {
+	paths := setupBenchmark(b, 100)
+	m := testMetadater
+	for i := 0; i < b.N; i++ {
+		if _, err := m.GetModificationTime(benchStorageID, paths[i%len(paths)]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGetModificationTimeTwoQueries(b *testing.B) {
+	paths := setupBenchmark(b, 100)
+	for i := 0; i < b.N; i++ {
+		objectPath := paths[i%len(paths)]
+		sess, cancel := testStore.getSessionWithTimeout(context.Background(), benchStorageID, defaultQueryTimeout)
+		folder := Folder{}
+		err := sess.Where("path = ? AND storage_id = ?", path.Dir(objectPath), benchStorageID).Select("id").First(&folder).Error
+		if err == nil {
+			file := File{}
+			err = sess.Where("name = ? AND folder_id = ?", path.Base(objectPath), folder.ID).Select("last_modified").
+				First(&file).Error
+		}
+		cancel()
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkRemoveMetadata(b *testing.B) {
+	paths := setupBenchmark(b, b.N)
+	m := testMetadater
+	for i := 0; i < b.N; i++ {
+		if err := m.RemoveMetadata(benchStorageID, paths[i]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkRemoveMetadataTwoQueries(b *testing.B) {
+	paths := setupBenchmark(b, b.N)
+	for i := 0; i < b.N; i++ {
+		objectPath := paths[i]
+		sess, cancel := testStore.getSessionWithTimeout(context.Background(), benchStorageID, defaultQueryTimeout)
+		folder := Folder{}
+		err := sess.Where("path = ? AND storage_id = ?", path.Dir(objectPath), benchStorageID).Select("id").First(&folder).Error
+		if err == nil {
+			err = checkRowsAffected(sess.Where("name = ? AND folder_id = ?", path.Base(objectPath), folder.ID).
+				Delete(&File{}))
+		}
+		cancel()
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
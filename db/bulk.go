@@ -0,0 +1,154 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"context"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"gorm.io/gorm"
+)
+
+const (
+	bulkQuery = `SELECT metadata_folders.path, metadata_files.name, metadata_files.last_modified
+ FROM metadata_files INNER JOIN metadata_folders ON metadata_folders.id = metadata_files.folder_id
+ WHERE metadata_folders.storage_id = ?`
+)
+
+var (
+	// bulkQueryChunkSize is the maximum number of folder paths for a single
+	// query, it keeps the number of bind parameters well below the limits of
+	// the supported databases
+	bulkQueryChunkSize = 500
+)
+
+// GetModificationTimesBulk returns the modification times for the files
+// within the specified folders as a map of folder paths to maps of file names
+// to modification times. Folders without files are not included. Each chunk
+// of folders is fetched using a single joined query
+func (m *Metadater) GetModificationTimesBulk(storageID string, folders []string) (result map[string]map[string]int64, err error) {
+	if m.pathPolicy.IsEnabled() {
+		normalized := make([]string, 0, len(folders))
+		for _, folder := range folders {
+			normalized = append(normalized, m.pathPolicy.Path(folder))
+		}
+		folders = normalized
+	}
+	ctx, span := startSpan("GetModificationTimesBulk", storageID, "", attribute.Int("metadata.folders", len(folders)))
+	defer func() { endSpan(span, countBulkResult(result), err) }()
+
+	store, ok := m.store.(BulkStore)
+	if !ok {
+		return nil, m.checkError(ErrUnsupported)
+	}
+	ctx, cancel := context.WithTimeout(ctx, m.bulkQueryTimeout)
+	defer cancel()
+
+	result, err = store.GetModificationTimesBulk(ctx, storageID, folders)
+	if err != nil {
+		return nil, m.checkError(err)
+	}
+	return result, nil
+}
+
+// GetModificationTimesByPrefix returns the modification times for the files
+// within the specified folder and all its subfolders as a map of folder paths
+// to maps of file names to modification times. The prefix is normalized using
+// the configured path policy and it matches whole folder names, empty or "/"
+// means all the folders. Folders without files are not included
+func (m *Metadater) GetModificationTimesByPrefix(storageID, prefix string) (result map[string]map[string]int64, err error) {
+	prefix = m.pathPolicy.Path(prefix)
+	ctx, span := startSpan("GetModificationTimesByPrefix", storageID, prefix)
+	defer func() { endSpan(span, countBulkResult(result), err) }()
+
+	store, ok := m.store.(BulkStore)
+	if !ok {
+		return nil, m.checkError(ErrUnsupported)
+	}
+	ctx, cancel := context.WithTimeout(ctx, m.bulkQueryTimeout)
+	defer cancel()
+
+	result, err = store.GetModificationTimesByPrefix(ctx, storageID, prefix)
+	if err != nil {
+		return nil, m.checkError(err)
+	}
+	return result, nil
+}
+
+// GetModificationTimesBulk implements BulkStore
+func (s *SQLStore) GetModificationTimesBulk(ctx context.Context, storageID string, folders []string) (map[string]map[string]int64, error) {
+	var result map[string]map[string]int64
+	err := s.executeRead(ctx, s.getHandle(storageID), storageID, folders, func(sess *gorm.DB) error {
+		result = make(map[string]map[string]int64)
+		for start := 0; start < len(folders); start += bulkQueryChunkSize {
+			chunk := folders[start:min(start+bulkQueryChunkSize, len(folders))]
+			err := scanBulkQuery(sess.Raw(bulkQuery+" AND metadata_folders.path IN ?", storageID, chunk), result)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return result, err
+}
+
+// GetModificationTimesByPrefix implements BulkStore
+func (s *SQLStore) GetModificationTimesByPrefix(ctx context.Context, storageID, prefix string) (map[string]map[string]int64, error) {
+	query := bulkQuery
+	args := []any{storageID}
+	prefix = strings.TrimSuffix(prefix, "/")
+	if prefix != "" {
+		query += " AND (metadata_folders.path = ? OR metadata_folders.path LIKE ? ESCAPE '!')"
+		args = append(args, prefix, escapeLikePattern(prefix)+"/%")
+	}
+	var result map[string]map[string]int64
+	err := s.executeRead(ctx, s.getHandle(storageID), storageID, nil, func(sess *gorm.DB) error {
+		result = make(map[string]map[string]int64)
+		return scanBulkQuery(sess.Raw(query, args...), result)
+	})
+	return result, err
+}
+
+func scanBulkQuery(query *gorm.DB, result map[string]map[string]int64) error {
+	rows, err := query.Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var folderPath, name string
+		var lastModified int64
+		if err := rows.Scan(&folderPath, &name, &lastModified); err != nil {
+			return err
+		}
+		files, ok := result[folderPath]
+		if !ok {
+			files = make(map[string]int64)
+			result[folderPath] = files
+		}
+		files[name] = lastModified
+	}
+	return rows.Err()
+}
+
+func countBulkResult(result map[string]map[string]int64) int {
+	count := 0
+	for _, files := range result {
+		count += len(files)
+	}
+	return count
+}
@@ -0,0 +1,83 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetModificationTimesBulk(t *testing.T) {
+	m := testMetadater
+	storageID := "s3://bulk-bucket"
+	mTime := getTimeAsMsSinceEpoch(time.Now())
+	var folders []string
+	for i := 0; i < 5; i++ {
+		folder := fmt.Sprintf("/bulk/dir%d", i)
+		folders = append(folders, folder)
+		for j := 0; j < 3; j++ {
+			err := m.SetModificationTime(storageID, fmt.Sprintf("%s/file%d.txt", folder, j), mTime+int64(j))
+			assert.NoError(t, err)
+		}
+	}
+	err := m.SetModificationTime(storageID, "/bulk/dir0/sub/file.txt", mTime)
+	assert.NoError(t, err)
+	err = m.SetModificationTime(storageID, "/bulk_other/file.txt", mTime)
+	assert.NoError(t, err)
+	err = m.SetModificationTime("s3://other-bulk-bucket", "/bulk/dir0/file0.txt", mTime)
+	assert.NoError(t, err)
+
+	chunkSize := bulkQueryChunkSize
+	bulkQueryChunkSize = 2
+	defer func() {
+		bulkQueryChunkSize = chunkSize
+	}()
+
+	result, err := m.GetModificationTimesBulk(storageID, append(folders, "/bulk/missing"))
+	require.NoError(t, err)
+	require.Len(t, result, 5)
+	for _, folder := range folders {
+		if assert.Len(t, result[folder], 3) {
+			assert.Equal(t, mTime+2, result[folder]["file2.txt"])
+		}
+	}
+	result, err = m.GetModificationTimesBulk(storageID, nil)
+	require.NoError(t, err)
+	assert.Len(t, result, 0)
+
+	result, err = m.GetModificationTimesByPrefix(storageID, "/bulk/")
+	require.NoError(t, err)
+	assert.Len(t, result, 6)
+	assert.Len(t, result["/bulk/dir0/sub"], 1)
+	result, err = m.GetModificationTimesByPrefix(storageID, "/bulk/dir0")
+	require.NoError(t, err)
+	assert.Len(t, result, 2)
+	result, err = m.GetModificationTimesByPrefix(storageID, "/bulk/dir_")
+	require.NoError(t, err)
+	assert.Len(t, result, 0)
+	result, err = m.GetModificationTimesByPrefix(storageID, "/")
+	require.NoError(t, err)
+	assert.Len(t, result, 7)
+
+	// cleanup
+	_, err = testStore.RemoveStorage(storageID)
+	assert.NoError(t, err)
+	_, err = testStore.RemoveStorage("s3://other-bulk-bucket")
+	assert.NoError(t, err)
+}
@@ -0,0 +1,111 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"gorm.io/gorm"
+
+	"github.com/sftpgo/sftpgo-plugin-metadata/logger"
+)
+
+const (
+	gormCockroachPlugin = "cockroach"
+	// cockroachRestartSavepoint is the savepoint name defined by the
+	// CockroachDB client-side retry protocol
+	cockroachRestartSavepoint = "cockroach_restart"
+	cockroachMaxTxAttempts    = 10
+	cockroachMaxRetryDelay    = time.Second
+	// serializationFailureCode is the SQL state for retryable transaction
+	// errors
+	serializationFailureCode = "40001"
+)
+
+var cockroachRetryDelay = 10 * time.Millisecond
+
+// cockroachPlugin is registered on the handles for CockroachDB and compatible
+// databases, their transactions use the client-side retry protocol
+type cockroachPlugin struct{}
+
+func (p *cockroachPlugin) Name() string {
+	return gormCockroachPlugin
+}
+
+func (p *cockroachPlugin) Initialize(_ *gorm.DB) error {
+	return nil
+}
+
+// executeTx runs txFn inside a transaction. If a statement or the commit fail
+// with a retryable error, the transaction is rolled back to the restart
+// savepoint and txFn is called again, so txFn must not keep state across
+// attempts
+func (p *cockroachPlugin) executeTx(db *gorm.DB, txFn func(tx *gorm.DB) error) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("SAVEPOINT " + cockroachRestartSavepoint).Error; err != nil {
+			return err
+		}
+		for attempt := 1; ; attempt++ {
+			err := txFn(tx)
+			if err == nil {
+				// releasing the restart savepoint commits the transaction
+				err = tx.Exec("RELEASE SAVEPOINT " + cockroachRestartSavepoint).Error
+			}
+			if err == nil || !isRetryableTxError(err) || attempt >= cockroachMaxTxAttempts {
+				return err
+			}
+			logger.AppLogger.Debug("retrying transaction", "attempt", attempt, "error", err)
+			if err := tx.Exec("ROLLBACK TO SAVEPOINT " + cockroachRestartSavepoint).Error; err != nil {
+				return err
+			}
+			if err := waitRetryDelay(tx.Statement.Context, attempt); err != nil {
+				return err
+			}
+		}
+	})
+}
+
+// waitRetryDelay waits before the specified retry, the delay doubles for
+// each attempt
+func waitRetryDelay(ctx context.Context, attempt int) error {
+	delay := min(cockroachRetryDelay<<(attempt-1), cockroachMaxRetryDelay)
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func isRetryableTxError(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == serializationFailureCode
+}
+
+// getCockroachPlugin returns the plugin registered on the specified handle or
+// session, if any
+func getCockroachPlugin(db *gorm.DB) (*cockroachPlugin, bool) {
+	plugin, ok := db.Config.Plugins[gormCockroachPlugin].(*cockroachPlugin)
+	return plugin, ok
+}
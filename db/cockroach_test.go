@@ -0,0 +1,95 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+func TestRetryableTxError(t *testing.T) {
+	err := &pgconn.PgError{Code: serializationFailureCode}
+	assert.True(t, isRetryableTxError(err))
+	assert.True(t, isRetryableTxError(fmt.Errorf("wrapped: %w", err)))
+	assert.False(t, isRetryableTxError(&pgconn.PgError{Code: "23505"}))
+	assert.False(t, isRetryableTxError(errors.New(serializationFailureCode)))
+	assert.False(t, isRetryableTxError(gorm.ErrRecordNotFound))
+}
+
+func TestWaitRetryDelay(t *testing.T) {
+	defer func(delay time.Duration) {
+		cockroachRetryDelay = delay
+	}(cockroachRetryDelay)
+
+	cockroachRetryDelay = 5 * time.Millisecond
+	start := time.Now()
+	err := waitRetryDelay(context.Background(), 3)
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, time.Since(start), 20*time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	cockroachRetryDelay = time.Hour
+	err = waitRetryDelay(ctx, 1)
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestCockroachTransactionRetry(t *testing.T) {
+	if os.Getenv("SFTPGO_PLUGIN_METADATA_DRIVER") != driverNameCockroachDB {
+		t.Skip("transaction retries require CockroachDB")
+	}
+	_, ok := getCockroachPlugin(testStore.handle)
+	assert.True(t, ok)
+
+	m := testMetadater
+	storageID := "s3://cockroach-bucket"
+	mTime := getTimeAsMsSinceEpoch(time.Now())
+	attempts := 0
+	err := executeTx(testStore.handle, func(tx *gorm.DB) error {
+		attempts++
+		folderID, err := getOrCreateFolder(tx, storageID, "/retry", false)
+		if err != nil {
+			return err
+		}
+		if attempts == 1 {
+			return &pgconn.PgError{Code: serializationFailureCode}
+		}
+		return tx.Create(&File{Name: "file.txt", LastModified: mTime, FolderID: folderID}).Error
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, attempts)
+	value, err := m.GetModificationTime(storageID, "/retry/file.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, mTime, value)
+	// non retryable errors roll back the transaction
+	attempts = 0
+	err = executeTx(testStore.handle, func(_ *gorm.DB) error {
+		attempts++
+		return &pgconn.PgError{Code: "23505"}
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 1, attempts)
+
+	_, err = testStore.RemoveStorage(storageID)
+	assert.NoError(t, err)
+}
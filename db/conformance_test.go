@@ -0,0 +1,279 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// testStoreConformance checks the Metadater contract for the specified store.
+// The storage IDs are prefixed with the test name, so the store can be shared
+// with other tests. The optional capabilities are checked if implemented
+func testStoreConformance(t *testing.T, store Store) {
+	m := NewMetadater(store, MetadaterConfig{})
+	storageID := t.Name() + "-s1"
+	otherStorageID := t.Name() + "-s2"
+
+	t.Run("Metadata", func(t *testing.T) {
+		_, err := m.GetModificationTime(storageID, "/d1/f1")
+		assert.Equal(t, codes.NotFound, status.Code(err))
+		assert.Equal(t, codes.NotFound, status.Code(m.RemoveMetadata(storageID, "/d1/f1")))
+
+		require.NoError(t, m.SetModificationTime(storageID, "/d1/f1", 100))
+		require.NoError(t, m.SetModificationTime(storageID, "/d1/f1", 101))
+		require.NoError(t, m.SetModificationTime(storageID, "/d1/f2", 102))
+		require.NoError(t, m.SetModificationTime(storageID, "/d1/s1/f1", 103))
+		require.NoError(t, m.SetModificationTime(otherStorageID, "/d1/f1", 104))
+
+		mTime, err := m.GetModificationTime(storageID, "/d1/f1")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(101), mTime)
+		files, err := m.GetModificationTimes(storageID, "/d1")
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]int64{"f1": 101, "f2": 102}, files)
+		files, err = m.GetModificationTimes(storageID, "/missing")
+		assert.NoError(t, err)
+		assert.NotNil(t, files)
+		assert.Empty(t, files)
+
+		require.NoError(t, m.RemoveMetadata(storageID, "/d1/f1"))
+		_, err = m.GetModificationTime(storageID, "/d1/f1")
+		assert.Equal(t, codes.NotFound, status.Code(err))
+		mTime, err = m.GetModificationTime(otherStorageID, "/d1/f1")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(104), mTime)
+	})
+
+	t.Run("GetFolders", func(t *testing.T) {
+		storageID := t.Name()
+		// inserted out of order, the ancestors of /d5/s1/s2 are not listed
+		expected := []string{"/d1", "/d1/s1", "/d2", "/d3", "/d4", "/d5/s1/s2"}
+		for _, folder := range []string{"/d4", "/d1/s1", "/d2", "/d5/s1/s2", "/d1", "/d3"} {
+			require.NoError(t, m.SetModificationTime(storageID, folder+"/f1", 1))
+		}
+		folders, err := m.GetFolders(storageID, 0, "")
+		assert.NoError(t, err)
+		assert.Equal(t, expected, folders)
+
+		var paged []string
+		from := ""
+		for {
+			folders, err := m.GetFolders(storageID, 4, from)
+			require.NoError(t, err)
+			paged = append(paged, folders...)
+			if len(folders) < 4 {
+				break
+			}
+			from = folders[len(folders)-1]
+		}
+		assert.Equal(t, expected, paged)
+
+		folders, err = m.GetFolders(storageID+"-missing", 0, "")
+		assert.NoError(t, err)
+		assert.Empty(t, folders)
+	})
+
+	t.Run("Cleanup", func(t *testing.T) {
+		storageID := t.Name()
+		require.NoError(t, m.SetModificationTime(storageID, "/d1/f1", 1))
+		require.NoError(t, m.SetModificationTime(storageID, "/d2/f1", 1))
+		require.NoError(t, m.RemoveMetadata(storageID, "/d1/f1"))
+		// the folders without files are listed until the cleanup
+		folders, err := m.GetFolders(storageID, 0, "")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"/d1", "/d2"}, folders)
+
+		cleanupStore, ok := store.(CleanupStore)
+		if !ok {
+			return
+		}
+		require.NoError(t, cleanupStore.Cleanup(context.Background()))
+		folders, err = m.GetFolders(storageID, 0, "")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"/d2"}, folders)
+	})
+
+	t.Run("Copy", func(t *testing.T) {
+		sourceID := t.Name() + "-source"
+		targetID := t.Name() + "-target"
+		// the SQL store can have the files copied by a previous run
+		for _, p := range []string{"/dst/f1", "/dst/f2", "/dst/s1/f1"} {
+			m.RemoveMetadata(targetID, p) //nolint:errcheck
+		}
+		m.RemoveMetadata(sourceID, "/copy/f1") //nolint:errcheck
+		require.NoError(t, m.SetModificationTime(sourceID, "/src/f1", 10))
+		require.NoError(t, m.SetModificationTime(sourceID, "/src/f2", 20))
+		require.NoError(t, m.SetModificationTime(sourceID, "/src/s1/f1", 30))
+		require.NoError(t, m.SetModificationTime(sourceID, "/src1/f1", 40))
+		// the siblings sorting between the source prefix and its subfolders
+		require.NoError(t, m.SetModificationTime(sourceID, "/src-a/f1", 50))
+		require.NoError(t, m.SetModificationTime(sourceID, "/src0/f1", 60))
+		require.NoError(t, m.SetModificationTime(targetID, "/dst/f1", 15))
+		require.NoError(t, m.SetModificationTime(targetID, "/dst/f2", 15))
+
+		options := CopyOptions{
+			SourceStorageID: sourceID,
+			SourcePrefix:    "/src",
+			TargetStorageID: targetID,
+			TargetPrefix:    "/dst/",
+			DryRun:          true,
+		}
+		var progress []string
+		options.Progress = func(folderPath string, _ CopyResult) {
+			progress = append(progress, folderPath)
+		}
+		result, err := m.CopyMetadata(context.Background(), options)
+		assert.NoError(t, err)
+		assert.Equal(t, CopyResult{Folders: 2, Files: 1, UpdatedFiles: 1, SkippedFiles: 1}, result)
+		assert.Equal(t, []string{"/src", "/src/s1"}, progress)
+		files, err := m.GetModificationTimes(targetID, "/dst")
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]int64{"f1": 15, "f2": 15}, files)
+
+		options.DryRun = false
+		options.ConflictRule = ConflictRuleSource
+		result, err = m.CopyMetadata(context.Background(), options)
+		assert.NoError(t, err)
+		assert.Equal(t, CopyResult{Folders: 2, Files: 1, UpdatedFiles: 2}, result)
+		files, err = m.GetModificationTimes(targetID, "/dst")
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]int64{"f1": 10, "f2": 20}, files)
+		mTime, err := m.GetModificationTime(targetID, "/dst/s1/f1")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(30), mTime)
+		for _, p := range []string{"/dst1/f1", "/dst-a/f1", "/dst0/f1"} {
+			_, err = m.GetModificationTime(targetID, p)
+			assert.Equal(t, codes.NotFound, status.Code(err), p)
+		}
+		if prefixStore, ok := store.(PrefixStore); ok {
+			// the results follow the store ordering
+			folders, err := prefixStore.GetFoldersByPrefix(context.Background(), sourceID, "/src/", 0, "")
+			assert.NoError(t, err)
+			assert.ElementsMatch(t, []string{"/src", "/src/s1"}, folders)
+			first, err := prefixStore.GetFoldersByPrefix(context.Background(), sourceID, "/src", 1, "")
+			assert.NoError(t, err)
+			require.Len(t, first, 1)
+			next, err := prefixStore.GetFoldersByPrefix(context.Background(), sourceID, "/src", 1, first[0])
+			assert.NoError(t, err)
+			assert.ElementsMatch(t, folders, append(first, next...))
+			// the LIKE wildcards are escaped
+			folders, err = prefixStore.GetFoldersByPrefix(context.Background(), sourceID, "/sr_", 0, "")
+			assert.NoError(t, err)
+			assert.Len(t, folders, 0)
+		}
+		// the source metadata are preserved
+		files, err = m.GetModificationTimes(sourceID, "/src")
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]int64{"f1": 10, "f2": 20}, files)
+
+		// the whole storage, within the same storage the prefixes must not overlap
+		_, err = m.CopyMetadata(context.Background(), CopyOptions{SourceStorageID: sourceID, TargetStorageID: sourceID,
+			TargetPrefix: "/copy"})
+		assert.Error(t, err)
+		result, err = m.CopyMetadata(context.Background(), CopyOptions{SourceStorageID: sourceID, SourcePrefix: "/src1",
+			TargetStorageID: sourceID, TargetPrefix: "/copy"})
+		assert.NoError(t, err)
+		assert.Equal(t, CopyResult{Folders: 1, Files: 1}, result)
+		mTime, err = m.GetModificationTime(sourceID, "/copy/f1")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(40), mTime)
+		_, err = m.CopyMetadata(context.Background(), CopyOptions{SourceStorageID: sourceID, TargetStorageID: targetID,
+			ConflictRule: "unknown"})
+		assert.Error(t, err)
+	})
+
+	if _, ok := store.(BulkStore); ok {
+		t.Run("Bulk", func(t *testing.T) {
+			storageID := t.Name()
+			require.NoError(t, m.SetModificationTime(storageID, "/d1/f1", 1))
+			require.NoError(t, m.SetModificationTime(storageID, "/d1/s1/f1", 2))
+			require.NoError(t, m.SetModificationTime(storageID, "/d10/f1", 3))
+
+			result, err := m.GetModificationTimesBulk(storageID, []string{"/d1/s1", "/d10", "/missing"})
+			assert.NoError(t, err)
+			assert.Equal(t, map[string]map[string]int64{"/d1/s1": {"f1": 2}, "/d10": {"f1": 3}}, result)
+			result, err = m.GetModificationTimesByPrefix(storageID, "/d1/")
+			assert.NoError(t, err)
+			assert.Equal(t, map[string]map[string]int64{"/d1": {"f1": 1}, "/d1/s1": {"f1": 2}}, result)
+		})
+	}
+
+	if _, ok := store.(ListingStore); ok {
+		t.Run("Listing", func(t *testing.T) {
+			storageID := t.Name()
+			for i := 0; i < 5; i++ {
+				require.NoError(t, m.SetModificationTime(storageID, fmt.Sprintf("/d1/f%d", i), int64(i)))
+			}
+			files, cursor, err := m.GetModificationTimesPage(storageID, "/d1", "f1", 2)
+			assert.NoError(t, err)
+			assert.Equal(t, []FileModificationTime{{Name: "f2", LastModified: 2}, {Name: "f3", LastModified: 3}}, files)
+			assert.Equal(t, "f3", cursor)
+
+			it, err := m.IterateModificationTimes(context.Background(), storageID, "/d1")
+			require.NoError(t, err)
+			var names []string
+			for it.Next() {
+				names = append(names, it.File().Name)
+			}
+			assert.NoError(t, it.Err())
+			assert.NoError(t, it.Close())
+			assert.Equal(t, []string{"f0", "f1", "f2", "f3", "f4"}, names)
+		})
+	}
+
+	if _, ok := store.(HierarchyStore); ok {
+		t.Run("Hierarchy", func(t *testing.T) {
+			storageID := t.Name()
+			for _, folder := range []string{"/d1/s2/s1", "/d1/s1", "/d2"} {
+				require.NoError(t, m.SetModificationTime(storageID, folder+"/f1", 1))
+			}
+			children, err := m.GetChildFolders(storageID, "/")
+			assert.NoError(t, err)
+			assert.Equal(t, []string{"/d1", "/d2"}, children)
+			children, err = m.GetChildFolders(storageID, "/d1")
+			assert.NoError(t, err)
+			assert.Equal(t, []string{"/d1/s1", "/d1/s2"}, children)
+
+			var visited []string
+			err = m.WalkFolders(storageID, "/", func(folderPath string) error {
+				visited = append(visited, folderPath)
+				return nil
+			})
+			assert.NoError(t, err)
+			assert.Equal(t, []string{"/", "/d1", "/d2", "/d1/s1", "/d1/s2", "/d1/s2/s1"}, visited)
+		})
+	}
+}
+
+func TestSQLStoreConformance(t *testing.T) {
+	testStoreConformance(t, testStore)
+}
+
+func TestKVStoreConformance(t *testing.T) {
+	testStoreConformance(t, newTestKVStore(t))
+}
+
+func TestMemoryStoreConformance(t *testing.T) {
+	store, err := NewMemoryStore("", StoreHooks{})
+	require.NoError(t, err)
+	testStoreConformance(t, store)
+}
@@ -0,0 +1,237 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	copyFoldersBatchSize = 1000
+)
+
+// CopyOptions defines the metadata to copy and how to copy them
+type CopyOptions struct {
+	// SourceStorageID is the storage ID to copy the metadata from
+	SourceStorageID string
+	// SourcePrefix is the folder to copy, including all its subfolders.
+	// Empty or "/" means all the folders
+	SourcePrefix string
+	// TargetStorageID is the storage ID to copy the metadata to, it can be
+	// the source one if the prefixes do not overlap
+	TargetStorageID string
+	// TargetPrefix is the folder replacing the source prefix in the copied
+	// paths. Empty or "/" means the root folder
+	TargetPrefix string
+	// ConflictRule defines how to resolve the files already existing within
+	// the target, empty means ConflictRuleNewer
+	ConflictRule string
+	// DryRun reports the changes without applying them
+	DryRun bool
+	// Progress, if set, is called after each copied folder with the
+	// results so far
+	Progress func(folderPath string, result CopyResult)
+}
+
+// CopyResult defines the changes applied copying the metadata
+type CopyResult struct {
+	// Folders is the number of source folders copied
+	Folders int64
+	// Files is the number of files added to the target
+	Files int64
+	// UpdatedFiles is the number of existing target files updated
+	UpdatedFiles int64
+	// SkippedFiles is the number of existing target files left unchanged
+	SkippedFiles int64
+}
+
+// validate checks and normalizes the options
+func (o *CopyOptions) validate(policy NormalizationPolicy) error {
+	if o.SourceStorageID == "" || o.TargetStorageID == "" {
+		return errors.New("the source and target storage IDs are required")
+	}
+	if o.ConflictRule == "" {
+		o.ConflictRule = ConflictRuleNewer
+	}
+	if err := ValidateConflictRule(o.ConflictRule); err != nil {
+		return err
+	}
+	o.SourcePrefix = strings.TrimSuffix(policy.Path(o.SourcePrefix), "/")
+	o.TargetPrefix = strings.TrimSuffix(policy.Path(o.TargetPrefix), "/")
+	if o.SourceStorageID != o.TargetStorageID {
+		return nil
+	}
+	// the copied folders would be copied again
+	if isWithinPrefix(o.TargetPrefix, o.SourcePrefix) || isWithinPrefix(o.SourcePrefix, o.TargetPrefix) {
+		return fmt.Errorf("the source prefix %q and the target prefix %q overlap", o.SourcePrefix, o.TargetPrefix)
+	}
+	return nil
+}
+
+// isWithinPrefix returns true if the specified folder is the prefix folder or
+// one of its subfolders, the prefix has no trailing slash
+func isWithinPrefix(folderPath, prefix string) bool {
+	return prefix == "" || folderPath == prefix || strings.HasPrefix(folderPath, prefix+"/")
+}
+
+// isAfterPrefix returns true if, in byte order, the specified folder sorts
+// after the prefix folder and all its subfolders. The databases can use a
+// different ordering
+func isAfterPrefix(folderPath, prefix string) bool {
+	return prefix != "" && folderPath > prefix+"/" && !isWithinPrefix(folderPath, prefix)
+}
+
+// getTargetPath returns the target path for the specified source folder and
+// false if the folder is not within the source prefix
+func (o *CopyOptions) getTargetPath(folderPath string) (string, bool) {
+	if !isWithinPrefix(folderPath, o.SourcePrefix) {
+		return "", false
+	}
+	targetPath := o.TargetPrefix + strings.TrimSuffix(folderPath[len(o.SourcePrefix):], "/")
+	if targetPath == "" {
+		targetPath = "/"
+	}
+	return targetPath, true
+}
+
+// CopyMetadata copies the metadata for all the files within the source prefix
+// to the target storage ID and prefix, for example after copying the objects
+// to another storage. The files are written as by SetModificationTime, the
+// files already existing within the target are resolved using the conflict
+// rule. The source folders are scanned in batches, restricted to the source
+// prefix if the store supports it, and each folder is copied before reading
+// the next one, so an interrupted copy can be run again
+func (m *Metadater) CopyMetadata(ctx context.Context, options CopyOptions) (result CopyResult, err error) {
+	if err := options.validate(m.pathPolicy); err != nil {
+		return result, err
+	}
+	_, span := startSpan("CopyMetadata", options.SourceStorageID, options.SourcePrefix)
+	defer func() { endSpan(span, int(result.Files+result.UpdatedFiles), err) }()
+
+	ctx = trace.ContextWithSpan(ctx, span)
+	if !options.DryRun {
+		// the copied files are recorded one by one as they are written, the
+		// whole copy is recorded once completed or interrupted
+		defer func() { m.auditCopy(&options, result, err) }()
+	}
+	var from string
+	for {
+		folders, err := m.getCopyFolders(ctx, &options, from)
+		if err != nil {
+			return result, m.checkError(err)
+		}
+		for _, folderPath := range folders {
+			if !isWithinPrefix(folderPath, options.SourcePrefix) {
+				continue
+			}
+			if err := m.copyFolder(ctx, &options, folderPath, &result); err != nil {
+				return result, m.checkError(err)
+			}
+		}
+		if len(folders) < copyFoldersBatchSize {
+			return result, nil
+		}
+		from = folders[len(folders)-1]
+	}
+}
+
+// auditCopy records an applied copy, an interrupted one is recorded only if
+// some files were written
+func (m *Metadater) auditCopy(options *CopyOptions, result CopyResult, err error) {
+	store, ok := m.store.(bulkAuditor)
+	if !ok || (err != nil && result.Files == 0 && result.UpdatedFiles == 0) {
+		return
+	}
+	store.auditBulkOperation(AuditOperationCopy, options.SourceStorageID, options.SourcePrefix, map[string]any{
+		"target_storage_id": options.TargetStorageID,
+		"target_path":       options.TargetPrefix,
+		"conflict_rule":     options.ConflictRule,
+		"folders":           result.Folders,
+		"files":             result.Files,
+		"updated_files":     result.UpdatedFiles,
+		"skipped_files":     result.SkippedFiles,
+		"completed":         err == nil,
+	})
+}
+
+func (m *Metadater) getCopyFolders(ctx context.Context, options *CopyOptions, from string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout)
+	defer cancel()
+
+	if store, ok := m.store.(PrefixStore); ok {
+		return store.GetFoldersByPrefix(ctx, options.SourceStorageID, options.SourcePrefix, copyFoldersBatchSize, from)
+	}
+	return m.store.GetFolders(ctx, options.SourceStorageID, copyFoldersBatchSize, from)
+}
+
+func (m *Metadater) copyFolder(ctx context.Context, options *CopyOptions, folderPath string, result *CopyResult) error {
+	files, err := m.getCopyFiles(ctx, options.SourceStorageID, folderPath)
+	if err != nil {
+		return err
+	}
+	targetPath, _ := options.getTargetPath(folderPath)
+	existing, err := m.getCopyFiles(ctx, options.TargetStorageID, targetPath)
+	if err != nil {
+		return err
+	}
+	copied := 0
+	for name, mTime := range files {
+		if targetMTime, ok := existing[name]; ok {
+			var update bool
+			mTime, update = resolveConflict(options.ConflictRule, mTime, targetMTime)
+			if !update {
+				result.SkippedFiles++
+				continue
+			}
+			result.UpdatedFiles++
+		} else {
+			result.Files++
+		}
+		copied++
+		if options.DryRun {
+			continue
+		}
+		if err := m.copyFile(ctx, options.TargetStorageID, joinStoredPath(targetPath, name), mTime); err != nil {
+			return err
+		}
+	}
+	if copied > 0 && !options.DryRun {
+		m.invalidateCache(ctx, options.TargetStorageID, targetPath)
+	}
+	result.Folders++
+	if options.Progress != nil {
+		options.Progress(folderPath, *result)
+	}
+	return nil
+}
+
+func (m *Metadater) getCopyFiles(ctx context.Context, storageID, folderPath string) (map[string]int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout*4)
+	defer cancel()
+
+	return m.store.GetModificationTimes(ctx, storageID, folderPath)
+}
+
+func (m *Metadater) copyFile(ctx context.Context, storageID, objectPath string, mTime int64) error {
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout)
+	defer cancel()
+
+	return m.store.SetModificationTime(ctx, storageID, objectPath, mTime)
+}
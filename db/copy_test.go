@@ -0,0 +1,144 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCopyOptionsPaths(t *testing.T) {
+	policy := NormalizationPolicy{LeadingSlash: true, Clean: true}
+	tests := []struct {
+		name         string
+		sourcePrefix string
+		targetPrefix string
+		sameStorage  bool
+		policy       NormalizationPolicy
+		wantErr      bool
+		// source folder to target path, an empty target means outside
+		paths map[string]string
+		// source folders sorted after the prefix and its subfolders
+		after []string
+	}{
+		{
+			name:  "root prefix",
+			paths: map[string]string{"/": "/", "/a": "/a", "/a/b": "/a/b"},
+		},
+		{
+			name:         "slash prefixes",
+			sourcePrefix: "/",
+			targetPrefix: "/",
+			paths:        map[string]string{"/": "/", "/a": "/a"},
+		},
+		{
+			name:         "root to folder",
+			targetPrefix: "/dst/",
+			paths:        map[string]string{"/": "/dst", "/a": "/dst/a", "/a/b": "/dst/a/b"},
+		},
+		{
+			name:         "folder to root",
+			sourcePrefix: "/src/",
+			targetPrefix: "/",
+			paths:        map[string]string{"/src": "/", "/src/a": "/a", "/src1": "", "/sr": "", "/": ""},
+			after:        []string{"/src1", "/src0/a", "/t"},
+		},
+		{
+			name:         "trailing slashes",
+			sourcePrefix: "/src/",
+			targetPrefix: "/dst/",
+			paths:        map[string]string{"/src": "/dst", "/src/a": "/dst/a", "/src-a": "", "/src1/a": ""},
+			after:        []string{"/src1", "/src0"},
+		},
+		{
+			name:         "normalized prefixes",
+			sourcePrefix: "src//",
+			targetPrefix: "dst/./a/",
+			policy:       policy,
+			paths:        map[string]string{"/src": "/dst/a", "/src/b": "/dst/a/b"},
+		},
+		{
+			name:         "same storage",
+			sourcePrefix: "/src",
+			targetPrefix: "/src1",
+			sameStorage:  true,
+			paths:        map[string]string{"/src": "/src1", "/src/a": "/src1/a", "/src1": ""},
+		},
+		{
+			name:         "same storage target within source",
+			sourcePrefix: "/src/",
+			targetPrefix: "/src/copy",
+			sameStorage:  true,
+			wantErr:      true,
+		},
+		{
+			name:         "same storage source within target",
+			sourcePrefix: "/src/a",
+			targetPrefix: "/src/",
+			sameStorage:  true,
+			wantErr:      true,
+		},
+		{
+			name:        "same storage root",
+			sameStorage: true,
+			wantErr:     true,
+		},
+		{
+			name:         "same storage same prefix",
+			sourcePrefix: "src",
+			targetPrefix: "/src/",
+			sameStorage:  true,
+			policy:       policy,
+			wantErr:      true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			options := CopyOptions{
+				SourceStorageID: "s3://source",
+				SourcePrefix:    tc.sourcePrefix,
+				TargetStorageID: "s3://target",
+				TargetPrefix:    tc.targetPrefix,
+			}
+			if tc.sameStorage {
+				options.TargetStorageID = options.SourceStorageID
+			}
+			err := options.validate(tc.policy)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, ConflictRuleNewer, options.ConflictRule)
+			for folderPath, want := range tc.paths {
+				got, ok := options.getTargetPath(folderPath)
+				assert.Equal(t, want != "", ok, folderPath)
+				assert.Equal(t, want, got, folderPath)
+				if ok {
+					assert.False(t, isAfterPrefix(folderPath, options.SourcePrefix), folderPath)
+				}
+			}
+			for _, folderPath := range tc.after {
+				assert.True(t, isAfterPrefix(folderPath, options.SourcePrefix), folderPath)
+			}
+		})
+	}
+
+	options := CopyOptions{SourceStorageID: "s3://source"}
+	assert.Error(t, options.validate(policy))
+	options = CopyOptions{SourceStorageID: "s3://source", TargetStorageID: "s3://target", ConflictRule: "unknown"}
+	assert.Error(t, options.validate(policy))
+}
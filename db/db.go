@@ -16,20 +16,17 @@ package db
 
 import (
 	"context"
-	"crypto/tls"
-	"crypto/x509"
+	"database/sql"
+	"errors"
 	"fmt"
-	"log"
-	"net/url"
-	"os"
-	"runtime"
 	"time"
 
 	mysqldriver "github.com/go-sql-driver/mysql"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/stdlib"
 	"gorm.io/driver/mysql"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
-	gormlogger "gorm.io/gorm/logger"
 
 	"github.com/sftpgo/sftpgo-plugin-metadata/logger"
 )
@@ -37,109 +34,342 @@ import (
 const (
 	driverNamePostgreSQL = "postgres"
 	driverNameMySQL      = "mysql"
-	cleanupQuery         = `DELETE FROM metadata_folders WHERE NOT EXISTS
- (SELECT id FROM metadata_files WHERE metadata_files.folder_id = metadata_folders.id)`
+	// driverNameCockroachDB uses the PostgreSQL protocol, the transactions
+	// are retried using the CockroachDB client-side protocol
+	driverNameCockroachDB = "cockroach"
+	// driverNameBolt is the embedded key-value store, the data source name
+	// is the path of the database file
+	driverNameBolt = "bolt"
+	// driverNameMemory keeps the metadata in memory, the optional data
+	// source name is the path of the snapshot file
+	driverNameMemory = "memory"
+	// the subfolders are read using a derived table, MySQL does not allow to
+	// reference the table being deleted from within a subquery
+	cleanupQuery = `DELETE FROM metadata_folders WHERE NOT EXISTS
+ (SELECT id FROM metadata_files WHERE metadata_files.folder_id = metadata_folders.id) AND NOT EXISTS
+ (SELECT parent_id FROM (SELECT parent_id FROM metadata_folders WHERE parent_id IS NOT NULL) children
+ WHERE children.parent_id = metadata_folders.id)`
+	// maxCleanupIterations limits the passes needed to remove the ancestors
+	// left without subfolders by the previous pass
+	maxCleanupIterations = 32
 )
 
 var (
-	Handle              *gorm.DB
 	defaultQueryTimeout = 20 * time.Second
 )
 
-// Initialize initializes the database engine
-func Initialize(driver, dsn, customTLSConfig string, dbDebug bool) error {
-	var err error
+// Config defines the database configuration
+type Config struct {
+	// Driver is the database driver name
+	Driver string
+	// DSN is the data source name, it is ignored if DSNFile is set
+	DSN string
+	// DSNFile is the path to a file containing the data source name
+	DSNFile string
+	// PasswordFile is the path to a file containing the database password.
+	// If set, it replaces any password included in the data source name
+	PasswordFile string
+	// CustomTLSConfig defines a custom TLS configuration
+	CustomTLSConfig string
+	// Debug enables SQL logging at debug level, by default the SQL statements
+	// are logged at trace level
+	Debug bool
+	// SlowThreshold defines the execution time after which a SQL statement is
+	// logged as slow, 0 disables slow statements logging
+	SlowThreshold time.Duration
+	// ChangeEvents enables publishing the change events using pg_notify,
+	// PostgreSQL only
+	ChangeEvents bool
+	// RoutingConfig is the path to a JSON file defining the databases used for
+	// the matching storage IDs, the storage IDs not matching any route use
+	// this database
+	RoutingConfig string
+	// ReplicaDSNs defines the data source names for the read replicas, the
+	// other connection settings are inherited
+	ReplicaDSNs []string
+	// ReadAfterWriteWindow is the time after a write during which the reads
+	// for the written folders use the primary database, 0 disables
+	ReadAfterWriteWindow time.Duration
+	// FolderIDCache is an optional cache for the folder IDs, shared by all
+	// the databases
+	FolderIDCache FolderIDCache
+	// Hooks defines the audit log and the change consumers for the store
+	Hooks StoreHooks
+	// isReplica is true for read replicas, they can be unreachable when
+	// opened so the server version is not queried
+	isReplica bool
+}
+
+// SQLStore is a Store backed by PostgreSQL or MySQL databases. The storage
+// IDs can be routed to separate databases and each database can have read
+// replicas
+type SQLStore struct {
+	// handle is the default database
+	handle *gorm.DB
+	// the configured routes, the first matching route is used
+	routes []*route
+	// the replicas for each database handle
+	replicas map[*gorm.DB]*replicaSet
+	// the folders recently written by this store
+	writes *writeTracker
+	// the databases to listen on for change events, nil if disabled
+	listeners []*changeListener
+	// changeEvents is true if the changes are published using pg_notify
+	changeEvents bool
+	// folderIDs caches the folder IDs, nil if disabled
+	folderIDs FolderIDCache
+	// hooks defines the audit log and the change consumers
+	hooks StoreHooks
+	// origin identifies this store in the published change events
+	origin string
+}
+
+// NewSQLStore returns a store for the specified configuration, the
+// migrations are not applied
+func NewSQLStore(config Config) (*SQLStore, error) {
+	var routeConfigs []RouteConfig
+	if config.RoutingConfig != "" {
+		var err error
+		routeConfigs, err = LoadRoutingConfig(config.RoutingConfig)
+		if err != nil {
+			logger.AppLogger.Error("unable to load routing config", "error", err)
+			return nil, err
+		}
+	}
+
+	s := &SQLStore{
+		replicas:     make(map[*gorm.DB]*replicaSet),
+		writes:       newWriteTracker(config.ReadAfterWriteWindow),
+		changeEvents: config.ChangeEvents,
+		folderIDs:    config.FolderIDCache,
+		hooks:        config.Hooks,
+		origin:       newChangeOrigin(),
+	}
+	handle, err := s.openDatabase(config)
+	if err != nil {
+		s.closeHandle(handle)
+		return nil, err
+	}
+	s.handle = handle
+	if err := s.initializeRoutes(config, routeConfigs); err != nil {
+		s.closeHandle(handle)
+		return nil, err
+	}
+	return s, nil
+}
+
+// Close closes the connection pools for all the databases
+func (s *SQLStore) Close() error {
+	s.closeRoutes()
+	s.closeHandle(s.handle)
+	return nil
+}
+
+// openDatabase returns a handle, with its own connection pool, for the
+// specified configuration. If change events are enabled, the database is
+// added to the ones to listen on
+func (s *SQLStore) openDatabase(config Config) (*gorm.DB, error) {
+	var handle *gorm.DB
+	newLogger := newGormLogger(config.Debug, config.SlowThreshold)
 
-	newLogger := gormlogger.Discard
+	dsn, err := config.loadDSN()
+	if err != nil {
+		logger.AppLogger.Error("unable to load data source name", "error", err)
+		return nil, err
+	}
 
-	if dbDebug {
-		newLogger = gormlogger.New(
-			log.New(os.Stdout, "\r\n", log.LstdFlags), // io writer
-			gormlogger.Config{
-				SlowThreshold: time.Second,     // Slow SQL threshold
-				LogLevel:      gormlogger.Info, // Log level
-				Colorful:      runtime.GOOS != "windows",
-			},
-		)
+	if config.ChangeEvents && config.Driver != driverNamePostgreSQL {
+		return nil, fmt.Errorf("change events are not supported for database driver %v", config.Driver)
 	}
 
-	switch driver {
-	case driverNamePostgreSQL:
-		Handle, err = gorm.Open(postgres.New(postgres.Config{
-			DSN: dsn,
+	switch config.Driver {
+	case driverNamePostgreSQL, driverNameCockroachDB:
+		connConfig, err := pgx.ParseConfig(dsn)
+		if err != nil {
+			logger.AppLogger.Error("unable to parse data source name", "error", err)
+			return nil, err
+		}
+		if err := applyPostgreSQLCustomTLSConfig(config.CustomTLSConfig, connConfig); err != nil {
+			logger.AppLogger.Error("unable to apply custom tls config", "error", err)
+			return nil, err
+		}
+		if config.ChangeEvents {
+			s.addListener(config, connConfig)
+		}
+		handle, err = gorm.Open(postgres.New(postgres.Config{
+			Conn: stdlib.OpenDB(*connConfig, stdlib.OptionBeforeConnect(config.reloadPostgreSQLCredentials)),
 		}), &gorm.Config{
 			SkipDefaultTransaction: true,
+			DisableAutomaticPing:   config.isReplica,
 			Logger:                 newLogger,
 		})
 		if err != nil {
 			logger.AppLogger.Error("unable to create db handle", "error", err)
-			return err
+			return nil, err
 		}
 	case driverNameMySQL:
-		if err := handleCustomTLSConfig(customTLSConfig); err != nil {
+		if err := handleCustomTLSConfig(config.CustomTLSConfig); err != nil {
 			logger.AppLogger.Error("unable to register custom tls config", "error", err)
-			return err
+			return nil, err
+		}
+		mysqlConfig, err := mysqldriver.ParseDSN(dsn)
+		if err != nil {
+			logger.AppLogger.Error("unable to parse data source name", "error", err)
+			return nil, err
+		}
+		if err := checkMySQLCustomTLSConfig(config.CustomTLSConfig, mysqlConfig); err != nil {
+			logger.AppLogger.Error("unable to apply custom tls config", "error", err)
+			return nil, err
+		}
+		if err := mysqlConfig.Apply(mysqldriver.BeforeConnect(config.reloadMySQLCredentials)); err != nil {
+			return nil, err
 		}
-		Handle, err = gorm.Open(mysql.New(mysql.Config{
-			DSN: dsn,
+		connector, err := mysqldriver.NewConnector(mysqlConfig)
+		if err != nil {
+			logger.AppLogger.Error("unable to create db connector", "error", err)
+			return nil, err
+		}
+		handle, err = gorm.Open(mysql.New(mysql.Config{
+			Conn:                      sql.OpenDB(connector),
+			SkipInitializeWithVersion: config.isReplica,
 		}), &gorm.Config{
 			SkipDefaultTransaction: true,
+			DisableAutomaticPing:   config.isReplica,
 			Logger:                 newLogger,
 		})
 		if err != nil {
 			logger.AppLogger.Error("unable to create db handle", "error", err)
-			return err
+			return nil, err
 		}
 	default:
-		return fmt.Errorf("unsupported database driver %v", driver)
+		return nil, fmt.Errorf("unsupported database driver %v", config.Driver)
+	}
+
+	if err := handle.Use(newTracingPlugin(config.Driver)); err != nil {
+		logger.AppLogger.Error("unable to register tracing plugin", "error", err)
+		return nil, err
+	}
+	if config.Driver == driverNameCockroachDB {
+		if err := handle.Use(&cockroachPlugin{}); err != nil {
+			logger.AppLogger.Error("unable to register cockroach plugin", "error", err)
+			return nil, err
+		}
 	}
 
-	sqlDB, err := Handle.DB()
+	sqlDB, err := handle.DB()
 	if err != nil {
 		logger.AppLogger.Error("unable to get sql db handle", "error", err)
-		return err
+		return nil, err
 	}
 
 	sqlDB.SetMaxIdleConns(10)
 	sqlDB.SetConnMaxIdleTime(3 * time.Minute)
 
-	return sqlDB.Ping()
+	if err := s.initializeReplicas(config, handle); err != nil {
+		return handle, err
+	}
+
+	return handle, sqlDB.Ping()
 }
 
-// ScheduleCleanup tries to periodically remove unreferenced folders
-func ScheduleCleanup() {
-	for range time.Tick(12 * time.Hour) {
-		logger.AppLogger.Debug("removing unreferenced folders")
-		err := removeUnreferencedFolders()
-		logger.AppLogger.Info("removing unreferenced folders completed", "error", err)
+// reloadPostgreSQLCredentials updates the credentials used for new PostgreSQL
+// connections if they are loaded from files
+func (c *Config) reloadPostgreSQLCredentials(_ context.Context, connConfig *pgx.ConnConfig) error {
+	if !c.hasCredentialFiles() {
+		return nil
+	}
+	dsn, err := c.loadDSN()
+	if err != nil {
+		logger.AppLogger.Error("unable to reload data source name", "error", err)
+		return err
+	}
+	updated, err := pgx.ParseConfig(dsn)
+	if err != nil {
+		logger.AppLogger.Error("unable to parse reloaded data source name", "error", err)
+		return err
 	}
+	connConfig.User = updated.User
+	connConfig.Password = updated.Password
+	return nil
 }
 
-func removeUnreferencedFolders() error {
-	sess, cancel := getSessionWithTimeout(defaultQueryTimeout * 4)
+// reloadMySQLCredentials updates the credentials used for new MySQL
+// connections if they are loaded from files
+func (c *Config) reloadMySQLCredentials(_ context.Context, mysqlConfig *mysqldriver.Config) error {
+	if !c.hasCredentialFiles() {
+		return nil
+	}
+	dsn, err := c.loadDSN()
+	if err != nil {
+		logger.AppLogger.Error("unable to reload data source name", "error", err)
+		return err
+	}
+	updated, err := mysqldriver.ParseDSN(dsn)
+	if err != nil {
+		logger.AppLogger.Error("unable to parse reloaded data source name", "error", err)
+		return err
+	}
+	mysqlConfig.User = updated.User
+	mysqlConfig.Passwd = updated.Passwd
+	return nil
+}
+
+// Cleanup implements CleanupStore, the unreferenced folders are removed from
+// all the databases
+func (s *SQLStore) Cleanup(ctx context.Context) error {
+	defer s.invalidateFolderIDs()
+
+	for _, handle := range s.getHandles("") {
+		if err := removeUnreferencedFoldersFrom(ctx, handle); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SQLStore) removeUnreferencedFolders() error {
+	return s.Cleanup(context.Background())
+}
+
+func removeUnreferencedFoldersFrom(ctx context.Context, handle *gorm.DB) error {
+	ctx, cancel := context.WithTimeout(ctx, defaultQueryTimeout*4)
 	defer cancel()
 
-	return sess.Exec(cleanupQuery).Error
+	sess := handle.WithContext(ctx)
+	for i := 0; i < maxCleanupIterations; i++ {
+		res := sess.Exec(cleanupQuery)
+		if res.Error != nil || res.RowsAffected == 0 {
+			return res.Error
+		}
+	}
+	return nil
 }
 
-// getDefaultSession returns a database session with the default timeout.
-// Don't forget to cancel the returned context
-func getDefaultSession() (*gorm.DB, context.CancelFunc) {
-	return getSessionWithTimeout(defaultQueryTimeout)
+// getSession returns a session for the database of the specified storage ID,
+// the context carries the timeout
+func (s *SQLStore) getSession(ctx context.Context, storageID string) *gorm.DB {
+	return s.getHandle(storageID).WithContext(ctx)
 }
 
-// getSessionWithTimeout returns a database session with the specified timeout.
+// getSessionWithTimeout returns a session, for the database of the specified
+// storage ID, with the specified timeout derived from the given context.
 // Don't forget to cancel the returned context
-func getSessionWithTimeout(timeout time.Duration) (*gorm.DB, context.CancelFunc) {
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+func (s *SQLStore) getSessionWithTimeout(ctx context.Context, storageID string, timeout time.Duration) (*gorm.DB, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
 
-	return Handle.WithContext(ctx), cancel
+	return s.getSession(ctx, storageID), cancel
 }
 
-// executeTx runs txFn inside a transaction
+// executeTx runs txFn inside a transaction. For CockroachDB the transaction
+// is retried, so txFn must not keep state across calls
 func executeTx(db *gorm.DB, txFn func(tx *gorm.DB) error) error {
-	err := db.Transaction(txFn)
-	if err != nil {
+	var err error
+	if plugin, ok := getCockroachPlugin(db); ok {
+		err = plugin.executeTx(db, txFn)
+	} else {
+		err = db.Transaction(txFn)
+	}
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
 		logger.AppLogger.Error("unable to execute transaction", "error", err)
 	}
 	return err
@@ -154,51 +384,3 @@ func checkRowsAffected(tx *gorm.DB) error {
 	}
 	return nil
 }
-
-func handleCustomTLSConfig(config string) error {
-	if config == "" {
-		return nil
-	}
-	values, err := url.ParseQuery(config)
-	if err != nil {
-		logger.AppLogger.Error("unable to parse custom tls config", "value", config, "error", err)
-		return fmt.Errorf("unable to parse tls config: %w", err)
-	}
-	rootCert := values.Get("root_cert")
-	clientCert := values.Get("client_cert")
-	clientKey := values.Get("client_key")
-	tlsMode := values.Get("tls_mode")
-
-	tlsConfig := &tls.Config{}
-	if rootCert != "" {
-		rootCAs, err := x509.SystemCertPool()
-		if err != nil {
-			rootCAs = x509.NewCertPool()
-		}
-		rootCrt, err := os.ReadFile(rootCert)
-		if err != nil {
-			return fmt.Errorf("unable to load root certificate %q: %v", rootCert, err)
-		}
-		if !rootCAs.AppendCertsFromPEM(rootCrt) {
-			return fmt.Errorf("unable to parse root certificate %q", rootCert)
-		}
-		tlsConfig.RootCAs = rootCAs
-	}
-	if clientCert != "" && clientKey != "" {
-		cert := make([]tls.Certificate, 0, 1)
-		tlsCert, err := tls.LoadX509KeyPair(clientCert, clientKey)
-		if err != nil {
-			return fmt.Errorf("unable to load key pair %q, %q: %v", clientCert, clientKey, err)
-		}
-		cert = append(cert, tlsCert)
-		tlsConfig.Certificates = cert
-	}
-	if tlsMode == "1" {
-		tlsConfig.InsecureSkipVerify = true
-	}
-
-	if err := mysqldriver.RegisterTLSConfig("custom", tlsConfig); err != nil {
-		return fmt.Errorf("unable to register tls config: %v", err)
-	}
-	return nil
-}
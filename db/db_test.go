@@ -20,9 +20,16 @@ import (
 	"testing"
 	"time"
 
+	"github.com/stretchr/testify/assert"
+
 	"github.com/sftpgo/sftpgo-plugin-metadata/db/migration"
 )
 
+var (
+	testStore     *SQLStore
+	testMetadater *Metadater
+)
+
 func TestMain(m *testing.M) {
 	driver := os.Getenv("SFTPGO_PLUGIN_METADATA_DRIVER")
 	dsn := os.Getenv("SFTPGO_PLUGIN_METADATA_DSN")
@@ -30,11 +37,14 @@ func TestMain(m *testing.M) {
 		fmt.Println("Driver and/or DSN not set, unable to execute test")
 		os.Exit(1)
 	}
-	if err := Initialize(driver, dsn, "", true); err != nil {
+	var err error
+	testStore, err = NewSQLStore(Config{Driver: driver, DSN: dsn, Debug: true})
+	if err != nil {
 		fmt.Printf("unable to initialize database: %v\n", err)
 		os.Exit(1)
 	}
-	if err := migration.MigrateDatabase(Handle); err != nil {
+	testMetadater = NewMetadater(testStore, MetadaterConfig{})
+	if err := migration.MigrateDatabase(testStore.handle); err != nil {
 		fmt.Printf("unable to migrate database: %v\n", err)
 		os.Exit(1)
 	}
@@ -42,6 +52,27 @@ func TestMain(m *testing.M) {
 	os.Exit(exitCode)
 }
 
+func TestMigrationStatus(t *testing.T) {
+	statuses, err := migration.GetStatus(testStore.handle)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, statuses)
+	for _, status := range statuses {
+		assert.True(t, status.Applied, status.ID)
+		assert.False(t, status.Unknown, status.ID)
+	}
+	statements, err := migration.DryRunMigrate(testStore.handle, "")
+	assert.NoError(t, err)
+	assert.Len(t, statements, 0)
+	_, err = migration.DryRunMigrate(testStore.handle, "unknown")
+	assert.Error(t, err)
+	_, err = migration.DryRunRollback(testStore.handle, "unknown")
+	assert.Error(t, err)
+	// rolling back to the latest migration is a no-op
+	statements, err = migration.DryRunRollback(testStore.handle, statuses[len(statuses)-1].ID)
+	assert.NoError(t, err)
+	assert.Len(t, statements, 0)
+}
+
 func getTimeAsMsSinceEpoch(t time.Time) int64 {
 	return t.UnixNano() / 1000000
 }
@@ -0,0 +1,155 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+
+	mysqldriver "github.com/go-sql-driver/mysql"
+)
+
+const (
+	redactedValue = "xxxxx"
+)
+
+var (
+	// matches password and sslpassword in PostgreSQL key/value DSNs, quoted values can contain escaped quotes
+	keyValuePasswordRegex = regexp.MustCompile(`(?i)\b((?:ssl)?password)\s*=\s*('(?:[^'\\]|\\.)*'|[^\s']\S*)`)
+	// matches the user info in URL DSNs that cannot be parsed
+	urlUserInfoRegex = regexp.MustCompile(`^([a-zA-Z][a-zA-Z0-9+.-]*://[^:@/]*):[^/]*@`)
+	// matches the user info in MySQL DSNs, the password can contain "@" so we match up to the last one
+	mysqlUserInfoRegex = regexp.MustCompile(`^([^:@/]*):.*@`)
+)
+
+// RedactDSN returns the specified data source name with any credential masked,
+// so that it can be safely printed and logged
+func RedactDSN(driver, dsn string) string {
+	if driver == driverNameMySQL {
+		cfg, err := mysqldriver.ParseDSN(dsn)
+		if err != nil {
+			return mysqlUserInfoRegex.ReplaceAllString(dsn, "${1}:"+redactedValue+"@")
+		}
+		if cfg.Passwd != "" {
+			cfg.Passwd = redactedValue
+		}
+		return cfg.FormatDSN()
+	}
+	if isURLDSN(dsn) {
+		u, err := url.Parse(dsn)
+		if err != nil {
+			return urlUserInfoRegex.ReplaceAllString(dsn, "${1}:"+redactedValue+"@")
+		}
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), redactedValue)
+		}
+		query := u.Query()
+		for key := range query {
+			if strings.EqualFold(key, "password") || strings.EqualFold(key, "sslpassword") {
+				query.Set(key, redactedValue)
+				u.RawQuery = query.Encode()
+			}
+		}
+		return u.String()
+	}
+	return keyValuePasswordRegex.ReplaceAllString(dsn, "${1}="+redactedValue)
+}
+
+// RedactedDSN returns the configured data source name with any credential masked
+func (c *Config) RedactedDSN() string {
+	dsn, err := c.loadDSN()
+	if err != nil {
+		dsn = c.DSN
+	}
+	return RedactDSN(c.Driver, dsn)
+}
+
+// loadDSN returns the data source name to use. The DSN is read from DSNFile,
+// if set, and the password read from PasswordFile, if set, is merged into it.
+// Files are read each time, so rotated credentials are picked up on reconnect
+func (c *Config) loadDSN() (string, error) {
+	dsn := c.DSN
+	if c.DSNFile != "" {
+		content, err := os.ReadFile(c.DSNFile)
+		if err != nil {
+			return "", fmt.Errorf("unable to read dsn file %q: %w", c.DSNFile, err)
+		}
+		dsn = strings.TrimSpace(string(content))
+	}
+	if dsn == "" {
+		return "", errors.New("a data source name or a data source name file is required")
+	}
+	if c.PasswordFile == "" {
+		return dsn, nil
+	}
+	content, err := os.ReadFile(c.PasswordFile)
+	if err != nil {
+		return "", fmt.Errorf("unable to read password file %q: %w", c.PasswordFile, err)
+	}
+	// secret files are usually terminated by a newline, it is never part of the password
+	return mergeDSNPassword(c.Driver, dsn, strings.TrimRight(string(content), "\r\n"))
+}
+
+// hasCredentialFiles returns true if the credentials are loaded from files
+// and so they must be reloaded before establishing new connections
+func (c *Config) hasCredentialFiles() bool {
+	return c.DSNFile != "" || c.PasswordFile != ""
+}
+
+// mergeDSNPassword returns the specified dsn with the password replaced
+func mergeDSNPassword(driver, dsn, password string) (string, error) {
+	switch driver {
+	case driverNamePostgreSQL, driverNameCockroachDB:
+		if isURLDSN(dsn) {
+			u, err := url.Parse(dsn)
+			if err != nil {
+				return "", fmt.Errorf("unable to parse dsn: %w", err)
+			}
+			var username string
+			if u.User != nil {
+				username = u.User.Username()
+			}
+			u.User = url.UserPassword(username, password)
+			return u.String(), nil
+		}
+		// in key/value DSNs the last occurrence of a key wins
+		return fmt.Sprintf("%s password=%s", dsn, quoteDSNValue(password)), nil
+	case driverNameMySQL:
+		cfg, err := mysqldriver.ParseDSN(dsn)
+		if err != nil {
+			return "", fmt.Errorf("unable to parse dsn: %w", err)
+		}
+		cfg.Passwd = password
+		return cfg.FormatDSN(), nil
+	default:
+		return "", fmt.Errorf("unsupported database driver %v", driver)
+	}
+}
+
+// isURLDSN returns true if the specified PostgreSQL dsn uses the URL format
+func isURLDSN(dsn string) bool {
+	return strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://")
+}
+
+// quoteDSNValue returns the specified value quoted as required
+// for PostgreSQL key/value DSNs
+func quoteDSNValue(value string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+	return "'" + replacer.Replace(value) + "'"
+}
@@ -0,0 +1,342 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"gorm.io/gorm"
+
+	"github.com/sftpgo/sftpgo-plugin-metadata/logger"
+)
+
+// Change operations
+const (
+	ChangeOperationSet    = "set"
+	ChangeOperationRemove = "remove"
+	// ChangeOperationResync means that some events may have been lost, for
+	// example while the listener was disconnected, or that an event was too
+	// large to be sent. Any cached data for the event storage ID, or for all
+	// the storages if empty, must be discarded
+	ChangeOperationResync = "resync"
+)
+
+const (
+	changeEventsChannel = "sftpgo_metadata_changes"
+	// PostgreSQL limits the notification payload to 8000 bytes
+	maxChangePayloadSize = 7999
+	maxListenerBackoff   = time.Minute
+)
+
+// ChangeEvent defines a metadata change notification
+type ChangeEvent struct {
+	Operation  string `json:"o"`
+	StorageID  string `json:"s,omitempty"`
+	FolderPath string `json:"p,omitempty"`
+	FileName   string `json:"n,omitempty"`
+	// LastModified is the new modification time, as milliseconds since epoch,
+	// for set operations
+	LastModified int64 `json:"m,omitempty"`
+	// Origin identifies the plugin instance that applied the change, it is
+	// empty for events generated by the listener itself
+	Origin string `json:"i,omitempty"`
+	// local is true if the change was applied by the store dispatching it
+	local bool
+}
+
+// IsLocal returns true if the change was applied by the store dispatching the
+// event
+func (e *ChangeEvent) IsLocal() bool {
+	return e.local
+}
+
+// ChangeConsumer defines the interface to receive the change events, for
+// example to invalidate a local cache or to forward the events elsewhere.
+// HandleChange is called sequentially from the listener goroutine, so it
+// should not block
+type ChangeConsumer interface {
+	HandleChange(event ChangeEvent)
+}
+
+// ChangeConsumerFunc adapts a function to the ChangeConsumer interface
+type ChangeConsumerFunc func(event ChangeEvent)
+
+// HandleChange implements ChangeConsumer
+func (f ChangeConsumerFunc) HandleChange(event ChangeEvent) {
+	f(event)
+}
+
+// ChangeDispatcher delivers the change events of the stores using it to the
+// added consumers. A nil ChangeDispatcher has no consumers
+type ChangeDispatcher struct {
+	mu             sync.RWMutex
+	consumers      []ChangeConsumer
+	localConsumers []ChangeConsumer
+}
+
+// NewChangeDispatcher returns a dispatcher without consumers
+func NewChangeDispatcher() *ChangeDispatcher {
+	return &ChangeDispatcher{}
+}
+
+// AddConsumer adds a consumer for the change events received by the listeners
+func (d *ChangeDispatcher) AddConsumer(consumer ChangeConsumer) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.consumers = append(d.consumers, consumer)
+}
+
+// AddLocalConsumer adds a consumer for the changes applied by the stores
+// using the dispatcher. Consumers are notified once the change is committed
+// and the change events do not need to be enabled
+func (d *ChangeDispatcher) AddLocalConsumer(consumer ChangeConsumer) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.localConsumers = append(d.localConsumers, consumer)
+}
+
+func (d *ChangeDispatcher) dispatch(event ChangeEvent) {
+	if d == nil {
+		return
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	for _, consumer := range d.consumers {
+		consumer.HandleChange(event)
+	}
+}
+
+// dispatchLocal notifies the local consumers about a committed change, the
+// object path is empty for resync events. The origin is set if the change is
+// also published to the other instances
+func (d *ChangeDispatcher) dispatchLocal(operation, storageID, objectPath string, mTime int64, origin string) {
+	if d == nil {
+		return
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if len(d.localConsumers) == 0 {
+		return
+	}
+	event := ChangeEvent{
+		Operation:    operation,
+		StorageID:    storageID,
+		LastModified: mTime,
+		Origin:       origin,
+		local:        true,
+	}
+	if objectPath != "" {
+		event.FolderPath = path.Dir(objectPath)
+		event.FileName = path.Base(objectPath)
+	}
+	for _, consumer := range d.localConsumers {
+		consumer.HandleChange(event)
+	}
+}
+
+// changeListener receives the change events published on a database
+type changeListener struct {
+	config     Config
+	connConfig *pgx.ConnConfig
+	// dispatch delivers the received events to the store consumers
+	dispatch func(event ChangeEvent)
+}
+
+func newChangeOrigin() string {
+	origin := make([]byte, 8)
+	if _, err := rand.Read(origin); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(origin)
+}
+
+// addListener adds a database to listen on, the events are published on the
+// database storing the changed metadata
+func (s *SQLStore) addListener(config Config, connConfig *pgx.ConnConfig) {
+	s.listeners = append(s.listeners, &changeListener{
+		config:     config,
+		connConfig: connConfig.Copy(),
+		dispatch:   s.dispatchChange,
+	})
+}
+
+// dispatchChange notifies the store consumers about an event received by a
+// listener
+func (s *SQLStore) dispatchChange(event ChangeEvent) {
+	event.local = event.Origin != "" && event.Origin == s.origin
+	s.hooks.Changes.dispatch(event)
+}
+
+// getChangeOrigin returns the origin for the changes applied using this
+// store, it is empty if the changes are not published
+func (s *SQLStore) getChangeOrigin() string {
+	if s.changeEvents {
+		return s.origin
+	}
+	return ""
+}
+
+// publishChange sends the change event within the specified transaction, so
+// it is delivered only if the transaction is committed
+func (s *SQLStore) publishChange(tx *gorm.DB, operation, storageID, folderPath, fileName string, mTime int64) error {
+	if !s.changeEvents {
+		return nil
+	}
+	payload, err := encodeChangeEvent(ChangeEvent{
+		Operation:    operation,
+		StorageID:    storageID,
+		FolderPath:   folderPath,
+		FileName:     fileName,
+		LastModified: mTime,
+		Origin:       s.origin,
+	})
+	if err != nil {
+		return err
+	}
+	return tx.Exec("SELECT pg_notify(?, ?)", changeEventsChannel, payload).Error
+}
+
+// publishResync notifies all the plugin instances, including this one, that
+// the metadata for the specified storage IDs were changed in bulk, so any
+// cached data must be discarded. The changes are already committed, so errors
+// are logged
+func (s *SQLStore) publishResync(handle *gorm.DB, storageIDs ...string) {
+	ctx, cancel := context.WithTimeout(context.Background(), maintenanceQueryTimeout)
+	defer cancel()
+
+	for _, storageID := range storageIDs {
+		if err := s.publishChange(handle.WithContext(ctx), ChangeOperationResync, storageID, "", "", 0); err != nil {
+			logger.AppLogger.Warn("unable to publish resync event", "storage_id", storageID, "error", err)
+		}
+		s.hooks.Changes.dispatchLocal(ChangeOperationResync, storageID, "", 0, s.getChangeOrigin())
+	}
+}
+
+// encodeChangeEvent returns the notification payload for the specified event.
+// Events too large to be sent are replaced by a resync event for the storage
+func encodeChangeEvent(event ChangeEvent) (string, error) {
+	data, err := json.Marshal(&event)
+	if err != nil {
+		return "", err
+	}
+	if len(data) > maxChangePayloadSize {
+		data, err = json.Marshal(&ChangeEvent{
+			Operation: ChangeOperationResync,
+			StorageID: event.StorageID,
+			Origin:    event.Origin,
+		})
+		if err != nil {
+			return "", err
+		}
+		if len(data) > maxChangePayloadSize {
+			data, err = json.Marshal(&ChangeEvent{
+				Operation: ChangeOperationResync,
+				Origin:    event.Origin,
+			})
+		}
+	}
+	return string(data), err
+}
+
+// ListenForChanges receives the change events published by all the plugin
+// instances, including this one, and dispatches them to the consumers of the
+// store change dispatcher until ctx is done. The connection is reestablished
+// on errors and a resync event is dispatched after each reconnection, since
+// the events sent in the meantime are lost. A connection is used for each
+// routed database, so the consumers may be called concurrently
+func (s *SQLStore) ListenForChanges(ctx context.Context) error {
+	if !s.changeEvents {
+		return errors.New("change events are not enabled")
+	}
+	var wg sync.WaitGroup
+	for _, listener := range s.listeners {
+		wg.Add(1)
+		go func(listener *changeListener) {
+			defer wg.Done()
+
+			listener.run(ctx)
+		}(listener)
+	}
+	wg.Wait()
+	return nil
+}
+
+func (l *changeListener) run(ctx context.Context) {
+	backoff := time.Second
+	connected := false
+	for {
+		err := l.listen(ctx, func() {
+			if connected {
+				l.dispatch(ChangeEvent{Operation: ChangeOperationResync})
+			}
+			connected = true
+			backoff = time.Second
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		logger.AppLogger.Warn("change events listener disconnected", "error", err, "retry_in", backoff)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxListenerBackoff)
+	}
+}
+
+func (l *changeListener) listen(ctx context.Context, onConnect func()) error {
+	connConfig := l.connConfig.Copy()
+	if err := l.config.reloadPostgreSQLCredentials(ctx, connConfig); err != nil {
+		return err
+	}
+	conn, err := pgx.ConnectConfig(ctx, connConfig)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+
+	if _, err := conn.Exec(ctx, "LISTEN "+changeEventsChannel); err != nil {
+		return err
+	}
+	logger.AppLogger.Debug("listening for change events", "channel", changeEventsChannel)
+	onConnect()
+
+	for {
+		notification, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		var event ChangeEvent
+		if err := json.Unmarshal([]byte(notification.Payload), &event); err != nil {
+			logger.AppLogger.Warn("invalid change event", "payload", notification.Payload, "error", err)
+			continue
+		}
+		l.dispatch(event)
+	}
+}
@@ -0,0 +1,250 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncodeChangeEvent(t *testing.T) {
+	event := ChangeEvent{
+		Operation:  ChangeOperationSet,
+		StorageID:  "s3://bucket",
+		FolderPath: "/dir",
+		FileName:   "file.txt",
+		Origin:     "abcd",
+	}
+	payload, err := encodeChangeEvent(event)
+	require.NoError(t, err)
+	var decoded ChangeEvent
+	err = json.Unmarshal([]byte(payload), &decoded)
+	require.NoError(t, err)
+	assert.Equal(t, event, decoded)
+	// too large events are replaced by a resync event for the storage
+	event.FolderPath = "/" + strings.Repeat("a", maxChangePayloadSize)
+	payload, err = encodeChangeEvent(event)
+	require.NoError(t, err)
+	assert.LessOrEqual(t, len(payload), maxChangePayloadSize)
+	decoded = ChangeEvent{}
+	err = json.Unmarshal([]byte(payload), &decoded)
+	require.NoError(t, err)
+	assert.Equal(t, ChangeEvent{Operation: ChangeOperationResync, StorageID: event.StorageID, Origin: "abcd"}, decoded)
+	event.StorageID = strings.Repeat("s", maxChangePayloadSize)
+	payload, err = encodeChangeEvent(event)
+	require.NoError(t, err)
+	decoded = ChangeEvent{}
+	err = json.Unmarshal([]byte(payload), &decoded)
+	require.NoError(t, err)
+	assert.Equal(t, ChangeEvent{Operation: ChangeOperationResync, Origin: "abcd"}, decoded)
+}
+
+func TestChangeEvents(t *testing.T) {
+	if os.Getenv("SFTPGO_PLUGIN_METADATA_DRIVER") != driverNamePostgreSQL {
+		t.Skip("change events require PostgreSQL")
+	}
+	connConfig, err := pgx.ParseConfig(os.Getenv("SFTPGO_PLUGIN_METADATA_DSN"))
+	require.NoError(t, err)
+	testStore.changeEvents = true
+	testStore.addListener(Config{}, connConfig)
+	defer func() {
+		testStore.changeEvents = false
+		testStore.listeners = nil
+	}()
+
+	events := make(chan ChangeEvent, 10)
+	changes := NewChangeDispatcher()
+	changes.AddConsumer(ChangeConsumerFunc(func(event ChangeEvent) {
+		events <- event
+	}))
+	testStore.hooks.Changes = changes
+	defer func() {
+		testStore.hooks.Changes = nil
+	}()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go testStore.ListenForChanges(ctx) //nolint:errcheck
+	// wait for the listener to connect
+	time.Sleep(500 * time.Millisecond)
+
+	m := testMetadater
+	storageID := "s3://events-bucket"
+	objectPath := "/events/file.txt"
+	err = m.SetModificationTime(storageID, objectPath, getTimeAsMsSinceEpoch(time.Now()))
+	assert.NoError(t, err)
+	err = m.RemoveMetadata(storageID, objectPath)
+	assert.NoError(t, err)
+	err = m.RemoveMetadata(storageID, objectPath)
+	checkNotFoundError(t, err)
+
+	for _, operation := range []string{ChangeOperationSet, ChangeOperationRemove} {
+		select {
+		case event := <-events:
+			assert.Equal(t, operation, event.Operation)
+			assert.Equal(t, storageID, event.StorageID)
+			assert.Equal(t, "/events", event.FolderPath)
+			assert.Equal(t, "file.txt", event.FileName)
+			assert.True(t, event.IsLocal())
+		case <-time.After(5 * time.Second):
+			t.Fatalf("change event %q not received", operation)
+		}
+	}
+	// the folders are still there, a resync event is published for both
+	// storage IDs once renamed
+	targetID := fmt.Sprintf("s3://events-bucket-%d", time.Now().UnixNano())
+	renamed, err := testStore.RenameStorage(storageID, targetID)
+	require.NoError(t, err)
+	assert.Greater(t, renamed, int64(0))
+	for _, id := range []string{storageID, targetID} {
+		select {
+		case event := <-events:
+			assert.Equal(t, ChangeEvent{Operation: ChangeOperationResync, StorageID: id, Origin: testStore.origin,
+				local: true}, event)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("resync event for %q not received", id)
+		}
+	}
+	select {
+	case event := <-events:
+		t.Errorf("unexpected change event %+v", event)
+	case <-time.After(200 * time.Millisecond):
+	}
+	_, err = testStore.RemoveStorage(targetID)
+	assert.NoError(t, err)
+}
+
+func TestLocalChangeConsumers(t *testing.T) {
+	storageID := "s3://local-events-bucket"
+	var mu sync.Mutex
+	var events []ChangeEvent
+	changes := NewChangeDispatcher()
+	changes.AddLocalConsumer(ChangeConsumerFunc(func(event ChangeEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		events = append(events, event)
+	}))
+	testStore.hooks.Changes = changes
+	defer func() {
+		testStore.hooks.Changes = nil
+	}()
+
+	m := testMetadater
+	objectPath := "/local/events/file.txt"
+	mTime := getTimeAsMsSinceEpoch(time.Now())
+	err := m.SetModificationTime(storageID, objectPath, mTime)
+	assert.NoError(t, err)
+	err = m.RemoveMetadata(storageID, objectPath)
+	assert.NoError(t, err)
+	err = m.RemoveMetadata(storageID, objectPath)
+	checkNotFoundError(t, err)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	require.Len(t, events, 2)
+	assert.Equal(t, ChangeEvent{Operation: ChangeOperationSet, StorageID: storageID, FolderPath: "/local/events",
+		FileName: "file.txt", LastModified: mTime, local: true}, events[0])
+	assert.Equal(t, ChangeEvent{Operation: ChangeOperationRemove, StorageID: storageID, FolderPath: "/local/events",
+		FileName: "file.txt", local: true}, events[1])
+	assert.True(t, events[0].IsLocal())
+}
+
+func TestStorageResyncEvents(t *testing.T) {
+	var events []ChangeEvent
+	changes := NewChangeDispatcher()
+	changes.AddLocalConsumer(ChangeConsumerFunc(func(event ChangeEvent) {
+		events = append(events, event)
+	}))
+	testStore.hooks.Changes = changes
+	defer func() {
+		testStore.hooks.Changes = nil
+	}()
+
+	m := testMetadater
+	sourceID := "s3://resync-source"
+	renamedID := "s3://resync-renamed"
+	targetID := "s3://resync-target"
+	mTime := getTimeAsMsSinceEpoch(time.Now())
+	require.NoError(t, m.SetModificationTime(sourceID, "/resync/file.txt", mTime))
+	require.NoError(t, m.SetModificationTime(targetID, "/resync/other.txt", mTime))
+	events = nil
+
+	_, err := testStore.RenameStorage(sourceID, renamedID)
+	require.NoError(t, err)
+	_, err = testStore.MergeStorage(renamedID, targetID, ConflictRuleNewer)
+	require.NoError(t, err)
+	// nothing to merge, no event
+	_, err = testStore.MergeStorage(renamedID, targetID, ConflictRuleNewer)
+	require.NoError(t, err)
+	require.Len(t, events, 4)
+	for idx, id := range []string{sourceID, renamedID, renamedID, targetID} {
+		assert.Equal(t, ChangeEvent{Operation: ChangeOperationResync, StorageID: id, local: true}, events[idx])
+	}
+
+	_, err = testStore.RemoveStorage(targetID)
+	assert.NoError(t, err)
+}
+
+func TestStoreHooksIsolation(t *testing.T) {
+	var events1, events2 []ChangeEvent
+	changes1 := NewChangeDispatcher()
+	changes1.AddLocalConsumer(ChangeConsumerFunc(func(event ChangeEvent) {
+		events1 = append(events1, event)
+	}))
+	changes2 := NewChangeDispatcher()
+	changes2.AddLocalConsumer(ChangeConsumerFunc(func(event ChangeEvent) {
+		events2 = append(events2, event)
+	}))
+	auditFile := filepath.Join(t.TempDir(), "audit.jsonl")
+	auditLog, err := NewAuditLog(AuditConfig{Sink: AuditSinkFile, File: auditFile})
+	require.NoError(t, err)
+	defer auditLog.Close()
+
+	// two stores in the same process, only the first one is audited
+	store1, err := NewMemoryStore("", StoreHooks{AuditLog: auditLog, Changes: changes1})
+	require.NoError(t, err)
+	store2, err := NewMemoryStore("", StoreHooks{Changes: changes2})
+	require.NoError(t, err)
+	m1 := NewMetadater(store1, MetadaterConfig{})
+	m2 := NewMetadater(store2, MetadaterConfig{})
+	assert.NoError(t, m1.SetModificationTime("s3://bucket", "/dir/file1.txt", 100))
+	assert.NoError(t, m2.SetModificationTime("s3://bucket", "/dir/file2.txt", 200))
+	assert.NoError(t, m2.RemoveMetadata("s3://bucket", "/dir/file2.txt"))
+
+	require.Len(t, events1, 1)
+	assert.Equal(t, "file1.txt", events1[0].FileName)
+	require.Len(t, events2, 2)
+	assert.Equal(t, "file2.txt", events2[0].FileName)
+	var records []AuditRecord
+	err = QueryAuditFile(auditFile, AuditFilter{}, func(record *AuditRecord) error {
+		records = append(records, *record)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, "/dir/file1.txt", records[0].Path)
+}
@@ -18,6 +18,13 @@ type Folder struct {
 	ID        int64 `gorm:"primarykey"`
 	Path      string
 	StorageID string
+	// ParentID is the ID of the parent folder, nil for root folders
+	ParentID *int64
+	// Name is the last element of the path, empty for the "/" folder
+	Name string
+	// Implicit is true for the ancestors created to link the hierarchy, they
+	// are not listed until a file is added
+	Implicit bool
 }
 
 func (*Folder) TableName() string {
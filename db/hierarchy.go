@@ -0,0 +1,165 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"context"
+	"errors"
+	"path"
+	"sort"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+const (
+	childFoldersQuery = `SELECT children.path FROM metadata_folders children
+ INNER JOIN metadata_folders parents ON parents.id = children.parent_id
+ WHERE parents.path = ? AND parents.storage_id = ? ORDER BY children.name ASC`
+)
+
+// GetChildFolders returns the paths of the immediate subfolders of the
+// specified folder ordered by name
+func (m *Metadater) GetChildFolders(storageID, folderPath string) (results []string, err error) {
+	folderPath = m.pathPolicy.Path(folderPath)
+	ctx, span := startSpan("GetChildFolders", storageID, folderPath)
+	defer func() { endSpan(span, len(results), err) }()
+
+	store, ok := m.store.(HierarchyStore)
+	if !ok {
+		return nil, m.checkError(ErrUnsupported)
+	}
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout)
+	defer cancel()
+
+	results, err = store.GetChildFolders(ctx, storageID, folderPath)
+	if err != nil {
+		return nil, m.checkError(err)
+	}
+	return results, nil
+}
+
+// WalkFolders calls fn for the specified folder, if it exists, and for all
+// its descendants. The tree is walked one level at a time and the folders
+// within a level are visited ordered by path. If fn returns an error the
+// walk is stopped and the error is returned
+func (m *Metadater) WalkFolders(storageID, folderPath string, fn func(folderPath string) error) (err error) {
+	folderPath = m.pathPolicy.Path(folderPath)
+	ctx, span := startSpan("WalkFolders", storageID, folderPath)
+	visited := 0
+	defer func() { endSpan(span, visited, err) }()
+
+	store, ok := m.store.(HierarchyStore)
+	if !ok {
+		return m.checkError(ErrUnsupported)
+	}
+	ctx, cancel := context.WithTimeout(ctx, m.bulkQueryTimeout)
+	defer cancel()
+
+	var fnErr error
+	err = store.WalkFolders(ctx, storageID, folderPath, func(folderPath string) error {
+		fnErr = fn(folderPath)
+		if fnErr == nil {
+			visited++
+		}
+		return fnErr
+	})
+	// the errors returned by fn are not converted
+	if err != nil && fnErr == nil {
+		return m.checkError(err)
+	}
+	return err
+}
+
+// GetChildFolders implements HierarchyStore
+func (s *SQLStore) GetChildFolders(ctx context.Context, storageID, folderPath string) ([]string, error) {
+	var results []string
+	// the subfolders can be created by writes within any descendant, so the
+	// recent writes are checked for the whole storage
+	err := s.executeRead(ctx, s.getHandle(storageID), storageID, nil, func(sess *gorm.DB) error {
+		results = []string{}
+		return sess.Raw(childFoldersQuery, folderPath, storageID).Scan(&results).Error
+	})
+	return results, err
+}
+
+// WalkFolders implements HierarchyStore. Each level is fetched using a query
+// for each chunk of parent folders
+func (s *SQLStore) WalkFolders(ctx context.Context, storageID, folderPath string, fn func(folderPath string) error) error {
+	// an unreachable replica is excluded but the walk is not retried, fn
+	// could have been already called for some folders
+	handle, r := s.getReadHandle(s.getHandle(storageID), storageID, nil)
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Bool("metadata.replica", r != nil))
+
+	queryFailed := func(err error) error {
+		if r != nil && ctx.Err() == nil && r.isUnreachable(ctx, err) {
+			r.setHealthy(false, err)
+		}
+		return err
+	}
+
+	sess := handle.WithContext(ctx)
+	var root Folder
+	err := sess.Where("path = ? AND storage_id = ?", folderPath, storageID).Select("id,path").First(&root).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		return queryFailed(err)
+	}
+	level := []Folder{root}
+	for len(level) > 0 {
+		parentIDs := make([]int64, 0, len(level))
+		for idx := range level {
+			if err := fn(level[idx].Path); err != nil {
+				return err
+			}
+			parentIDs = append(parentIDs, level[idx].ID)
+		}
+		level = nil
+		for start := 0; start < len(parentIDs); start += bulkQueryChunkSize {
+			end := min(start+bulkQueryChunkSize, len(parentIDs))
+			var children []Folder
+			err := sess.Where("parent_id IN ?", parentIDs[start:end]).Select("id,path").Find(&children).Error
+			if err != nil {
+				return queryFailed(err)
+			}
+			level = append(level, children...)
+		}
+		sort.Slice(level, func(i, j int) bool {
+			return level[i].Path < level[j].Path
+		})
+	}
+	return nil
+}
+
+// getFolderName returns the name stored for the specified folder path
+func getFolderName(folderPath string) string {
+	if folderPath == "/" {
+		return ""
+	}
+	return path.Base(folderPath)
+}
+
+// getParentPath returns the path of the parent folder, if any. The "/" folder
+// and the top level relative folders have no parent
+func getParentPath(folderPath string) (string, bool) {
+	parentPath := path.Dir(folderPath)
+	if parentPath == folderPath || parentPath == "." {
+		return "", false
+	}
+	return parentPath, true
+}
@@ -0,0 +1,223 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sftpgo/sftpgo-plugin-metadata/db/migration"
+)
+
+func TestFolderHierarchy(t *testing.T) {
+	m := testMetadater
+	storageID := "s3://hierarchy-bucket"
+	mTime := getTimeAsMsSinceEpoch(time.Now())
+	files := []string{"/h/a/b/c/file.txt", "/h/a/file.txt", "/h/d/file.txt", "/h/d/file1.txt"}
+	for _, p := range files {
+		err := m.SetModificationTime(storageID, p, mTime)
+		assert.NoError(t, err)
+	}
+
+	children, err := m.GetChildFolders(storageID, "/h")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/h/a", "/h/d"}, children)
+	children, err = m.GetChildFolders(storageID, "/h/a")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/h/a/b"}, children)
+	children, err = m.GetChildFolders(storageID, "/")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/h"}, children)
+	children, err = m.GetChildFolders(storageID, "/h/a/b/c")
+	assert.NoError(t, err)
+	assert.Len(t, children, 0)
+	children, err = m.GetChildFolders(storageID, "/missing")
+	assert.NoError(t, err)
+	assert.Len(t, children, 0)
+
+	var visited []string
+	err = m.WalkFolders(storageID, "/h", func(folderPath string) error {
+		visited = append(visited, folderPath)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/h", "/h/a", "/h/d", "/h/a/b", "/h/a/b/c"}, visited)
+	errStop := errors.New("stop")
+	visited = nil
+	err = m.WalkFolders(storageID, "/h", func(folderPath string) error {
+		visited = append(visited, folderPath)
+		if folderPath == "/h/d" {
+			return errStop
+		}
+		return nil
+	})
+	assert.ErrorIs(t, err, errStop)
+	assert.Equal(t, []string{"/h", "/h/a", "/h/d"}, visited)
+	err = m.WalkFolders(storageID, "/missing", func(folderPath string) error {
+		return errors.New("unexpected folder")
+	})
+	assert.NoError(t, err)
+
+	// the ancestors without files are not returned
+	folders, err := m.GetFolders(storageID, 0, "")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/h/a", "/h/a/b/c", "/h/d"}, folders)
+	// an ancestor is returned once a file is added
+	err = m.SetModificationTime(storageID, "/h/file.txt", mTime)
+	assert.NoError(t, err)
+	folders, err = m.GetFolders(storageID, 0, "")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/h", "/h/a", "/h/a/b/c", "/h/d"}, folders)
+	err = m.RemoveMetadata(storageID, "/h/file.txt")
+	assert.NoError(t, err)
+
+	// removing a file keeps the folder until the cleanup
+	err = m.RemoveMetadata(storageID, "/h/a/b/c/file.txt")
+	assert.NoError(t, err)
+	folders, err = m.GetFolders(storageID, 0, "")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/h", "/h/a", "/h/a/b/c", "/h/d"}, folders)
+	err = testStore.removeUnreferencedFolders()
+	assert.NoError(t, err)
+	children, err = m.GetChildFolders(storageID, "/h/a")
+	assert.NoError(t, err)
+	assert.Len(t, children, 0)
+	// the folders are recreated on demand
+	err = m.SetModificationTime(storageID, "/h/a/b/c/file.txt", mTime)
+	assert.NoError(t, err)
+	visited = nil
+	err = m.WalkFolders(storageID, "/h/a", func(folderPath string) error {
+		visited = append(visited, folderPath)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/h/a", "/h/a/b", "/h/a/b/c"}, visited)
+
+	for _, p := range files {
+		err = m.RemoveMetadata(storageID, p)
+		assert.NoError(t, err)
+	}
+	err = testStore.removeUnreferencedFolders()
+	assert.NoError(t, err)
+	var count int64
+	err = testStore.handle.Model(&Folder{}).Where("storage_id = ?", storageID).Count(&count).Error
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), count)
+}
+
+func TestFolderHierarchyBackfill(t *testing.T) {
+	storageID := "s3://backfill-bucket"
+	err := migration.RollbackDatabaseTo(testStore.handle, "2")
+	require.NoError(t, err)
+	defer func() {
+		err := migration.MigrateDatabase(testStore.handle)
+		require.NoError(t, err)
+	}()
+
+	for _, p := range []string{"/b/c/d", "/b", "relative/dir"} {
+		err = testStore.handle.Exec("INSERT INTO metadata_folders (path, storage_id) VALUES (?, ?)", p, storageID).Error
+		require.NoError(t, err)
+	}
+	err = migration.MigrateDatabase(testStore.handle)
+	require.NoError(t, err)
+
+	var folders []Folder
+	err = testStore.handle.Where("storage_id = ?", storageID).Order("path ASC").Find(&folders).Error
+	require.NoError(t, err)
+	ids := make(map[string]int64)
+	for _, folder := range folders {
+		ids[folder.Path] = folder.ID
+	}
+	expected := map[string]string{
+		"/":            "",
+		"/b":           "/",
+		"/b/c":         "/b",
+		"/b/c/d":       "/b/c",
+		"relative":     "",
+		"relative/dir": "relative",
+	}
+	// the existing folders without files and with subfolders are implicit
+	implicit := map[string]bool{"/": true, "/b": true, "/b/c": true, "relative": true}
+	require.Len(t, folders, len(expected))
+	for _, folder := range folders {
+		parentPath, ok := expected[folder.Path]
+		require.True(t, ok, folder.Path)
+		assert.Equal(t, getFolderName(folder.Path), folder.Name)
+		assert.Equal(t, implicit[folder.Path], folder.Implicit, folder.Path)
+		if parentPath == "" {
+			assert.Nil(t, folder.ParentID, folder.Path)
+		} else if assert.NotNil(t, folder.ParentID, folder.Path) {
+			assert.Equal(t, ids[parentPath], *folder.ParentID, folder.Path)
+		}
+	}
+
+	_, err = testStore.RemoveStorage(storageID)
+	assert.NoError(t, err)
+}
+
+func TestFolderHierarchyBackfillDryRun(t *testing.T) {
+	storageID := "s3://backfill-dry-run-bucket"
+	err := migration.RollbackDatabaseTo(testStore.handle, "2")
+	require.NoError(t, err)
+	defer func() {
+		err := migration.MigrateDatabase(testStore.handle)
+		require.NoError(t, err)
+		_, err = testStore.RemoveStorage(storageID)
+		assert.NoError(t, err)
+	}()
+
+	for _, p := range []string{"/b/c/d", "relative/dir"} {
+		err = testStore.handle.Exec("INSERT INTO metadata_folders (path, storage_id) VALUES (?, ?)", p, storageID).Error
+		require.NoError(t, err)
+	}
+	statements, err := migration.DryRunMigrate(testStore.handle, "")
+	require.NoError(t, err)
+	assert.NotEmpty(t, statements)
+	// the backfill statements are recorded and not executed
+	var backfill int
+	for _, statement := range statements {
+		if strings.HasPrefix(statement, "INSERT INTO metadata_folders") ||
+			strings.HasPrefix(statement, "UPDATE metadata_folders") {
+			backfill++
+		}
+	}
+	// the folder hierarchy and the implicit folders backfills
+	assert.Equal(t, 4, backfill)
+	var count int64
+	err = testStore.handle.Table("metadata_folders").Where("storage_id = ?", storageID).Count(&count).Error
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), count)
+	assert.False(t, testStore.handle.Migrator().HasColumn("metadata_folders", "parent_id"))
+}
+
+func TestFolderPaths(t *testing.T) {
+	assert.Equal(t, "", getFolderName("/"))
+	assert.Equal(t, "b", getFolderName("/a/b"))
+	assert.Equal(t, "a", getFolderName("a"))
+	for folderPath, parentPath := range map[string]string{"/a/b": "/a", "/a": "/", "a/b": "a"} {
+		p, ok := getParentPath(folderPath)
+		assert.True(t, ok)
+		assert.Equal(t, parentPath, p)
+	}
+	for _, folderPath := range []string{"/", "a", "."} {
+		_, ok := getParentPath(folderPath)
+		assert.False(t, ok, folderPath)
+	}
+}
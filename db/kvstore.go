@@ -0,0 +1,599 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/sftpgo/sftpgo-plugin-metadata/logger"
+)
+
+const (
+	// kvSeparator separates the key elements, it cannot be part of a storage
+	// ID or of a path
+	kvSeparator = 0
+	// kvScanBatchSize is the number of keys checked within a single
+	// transaction by the cleanup and the number of files fetched at once by
+	// the iterators
+	kvScanBatchSize = 1000
+	// kvCompactTxMaxSize is the maximum size of a compaction transaction
+	kvCompactTxMaxSize = 64 * 1024 * 1024
+)
+
+var (
+	// folder keys: storage ID, separator, folder path
+	kvFoldersBucket = []byte("folders")
+	// file keys: storage ID, separator, folder path, separator, file name.
+	// Values are the modification times as big endian integers
+	kvFilesBucket = []byte("files")
+	// kvCompactionMinFree is the minimum free space, within the database
+	// file, to trigger a compaction after the cleanup. A compaction is also
+	// required to use at least half of the file
+	kvCompactionMinFree int64 = 32 * 1024 * 1024
+)
+
+// KVStore is a Store backed by an embedded bbolt key-value database. The keys
+// are ordered so the files within a folder are read using a prefix scan and
+// the folders using a range scan. Like the SQL store, the folders left
+// without files are removed by the periodic cleanup, the database file is
+// then compacted to release the freed space. The audit records can only be
+// written to a file sink
+type KVStore struct {
+	// mu protects db and err, db is replaced while compacting
+	mu    sync.RWMutex
+	db    *bolt.DB
+	path  string
+	hooks StoreHooks
+	// err is set if the database cannot be reopened after compacting, the
+	// closed handle is kept and all the operations return err
+	err error
+}
+
+// NewKVStore returns a store using the bbolt database at the specified path,
+// the database is created if missing. The file is locked, so it cannot be
+// shared between processes
+func NewKVStore(path string, hooks StoreHooks) (*KVStore, error) {
+	if path == "" {
+		return nil, errors.New("the database path is required")
+	}
+	db, err := openKVDatabase(path)
+	if err != nil {
+		logger.AppLogger.Error("unable to open key-value database", "path", path, "error", err)
+		return nil, err
+	}
+	return &KVStore{
+		db:    db,
+		path:  path,
+		hooks: hooks,
+	}, nil
+}
+
+func openKVDatabase(path string) (*bolt.DB, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{kvFoldersBucket, kvFilesBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// Close implements Store
+func (s *KVStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err != nil {
+		return nil
+	}
+	return s.db.Close()
+}
+
+func (s *KVStore) view(ctx context.Context, fn func(tx *bolt.Tx) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.err != nil {
+		return s.err
+	}
+	return s.db.View(fn)
+}
+
+func (s *KVStore) update(ctx context.Context, fn func(tx *bolt.Tx) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.err != nil {
+		return s.err
+	}
+	return s.db.Update(fn)
+}
+
+// SetModificationTime implements Store
+func (s *KVStore) SetModificationTime(ctx context.Context, storageID, objectPath string, mTime int64) error {
+	var record *AuditRecord
+	folderPath, name := path.Dir(objectPath), path.Base(objectPath)
+	err := s.update(ctx, func(tx *bolt.Tx) error {
+		if err := tx.Bucket(kvFoldersBucket).Put(getKVFolderKey(storageID, folderPath), []byte{}); err != nil {
+			return err
+		}
+		files := tx.Bucket(kvFilesBucket)
+		key := getKVFileKey(storageID, folderPath, name)
+		if s.hooks.AuditLog != nil {
+			var oldMTime *int64
+			if value := files.Get(key); value != nil {
+				oldValue := decodeKVModTime(value)
+				oldMTime = &oldValue
+			}
+			record = s.hooks.AuditLog.newRecord(AuditOperationSet, storageID, objectPath, oldMTime, &mTime)
+		}
+		return files.Put(key, encodeKVModTime(mTime))
+	})
+	if err == nil {
+		s.hooks.AuditLog.write(record)
+		s.hooks.Changes.dispatchLocal(ChangeOperationSet, storageID, objectPath, mTime, "")
+	}
+	return err
+}
+
+// GetModificationTime implements Store
+func (s *KVStore) GetModificationTime(ctx context.Context, storageID, objectPath string) (int64, error) {
+	var mTime int64
+	folderPath, name := path.Dir(objectPath), path.Base(objectPath)
+	err := s.view(ctx, func(tx *bolt.Tx) error {
+		value := tx.Bucket(kvFilesBucket).Get(getKVFileKey(storageID, folderPath, name))
+		if value == nil {
+			return ErrNotFound
+		}
+		mTime = decodeKVModTime(value)
+		return nil
+	})
+	return mTime, err
+}
+
+// GetModificationTimes implements Store
+func (s *KVStore) GetModificationTimes(ctx context.Context, storageID, folderPath string) (map[string]int64, error) {
+	result := make(map[string]int64)
+	err := s.view(ctx, func(tx *bolt.Tx) error {
+		prefix := getKVFilesPrefix(storageID, folderPath)
+		c := tx.Bucket(kvFilesBucket).Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			result[string(k[len(prefix):])] = decodeKVModTime(v)
+		}
+		return nil
+	})
+	return result, err
+}
+
+// RemoveMetadata implements Store
+func (s *KVStore) RemoveMetadata(ctx context.Context, storageID, objectPath string) error {
+	var record *AuditRecord
+	folderPath, name := path.Dir(objectPath), path.Base(objectPath)
+	err := s.update(ctx, func(tx *bolt.Tx) error {
+		files := tx.Bucket(kvFilesBucket)
+		key := getKVFileKey(storageID, folderPath, name)
+		value := files.Get(key)
+		if value == nil {
+			return ErrNotFound
+		}
+		if s.hooks.AuditLog != nil {
+			oldMTime := decodeKVModTime(value)
+			record = s.hooks.AuditLog.newRecord(AuditOperationRemove, storageID, objectPath, &oldMTime, nil)
+		}
+		return files.Delete(key)
+	})
+	if err == nil {
+		s.hooks.AuditLog.write(record)
+		s.hooks.Changes.dispatchLocal(ChangeOperationRemove, storageID, objectPath, 0, "")
+	}
+	return err
+}
+
+// auditBulkOperation records a bulk operation, the audit log can only be
+// written to a file
+func (s *KVStore) auditBulkOperation(operation, storageID, objectPath string, details map[string]any) {
+	s.hooks.AuditLog.writeBulk(nil, operation, storageID, objectPath, details)
+}
+
+// GetFolders implements Store. Without a storage ID each storage is scanned
+// in turn and the results are merged
+func (s *KVStore) GetFolders(ctx context.Context, storageID string, limit int, from string) ([]string, error) {
+	results := []string{}
+	err := s.view(ctx, func(tx *bolt.Tx) error {
+		c := tx.Bucket(kvFoldersBucket).Cursor()
+		if storageID != "" {
+			results = scanKVFolders(c, storageID, "", limit, from, results)
+			return nil
+		}
+		for k, _ := c.First(); k != nil; {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			storage, _ := splitKVKey(k)
+			results = scanKVFolders(c, storage, "", limit, from, results)
+			// skip to the next storage
+			k, _ = c.Seek(append([]byte(storage), kvSeparator+1))
+		}
+		sort.Strings(results)
+		if limit > 0 && len(results) > limit {
+			results = results[:limit]
+		}
+		return nil
+	})
+	return results, err
+}
+
+// GetFoldersByPrefix implements PrefixStore
+func (s *KVStore) GetFoldersByPrefix(ctx context.Context, storageID, prefix string, limit int, from string) ([]string, error) {
+	prefix = strings.TrimSuffix(prefix, "/")
+	results := []string{}
+	err := s.view(ctx, func(tx *bolt.Tx) error {
+		results = scanKVFolders(tx.Bucket(kvFoldersBucket).Cursor(), storageID, prefix, limit, from, results)
+		return nil
+	})
+	return results, err
+}
+
+// scanKVFolders appends to results at most limit folders of the specified
+// storage, within the folder prefix, with path greater than from. The keys are
+// sorted in byte order, so the scan stops after the prefix subfolders
+func scanKVFolders(c *bolt.Cursor, storageID, folderPrefix string, limit int, from string, results []string) []string {
+	prefix := getKVFolderKey(storageID, "")
+	count := 0
+	k, _ := c.Seek(getKVFolderKey(storageID, max(from, folderPrefix)))
+	for ; k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		folderPath := string(k[len(prefix):])
+		if isAfterPrefix(folderPath, folderPrefix) {
+			break
+		}
+		if folderPath <= from || !isWithinPrefix(folderPath, folderPrefix) {
+			continue
+		}
+		if limit > 0 && count >= limit {
+			break
+		}
+		results = append(results, folderPath)
+		count++
+	}
+	return results
+}
+
+// GetModificationTimesBulk implements BulkStore
+func (s *KVStore) GetModificationTimesBulk(ctx context.Context, storageID string, folders []string) (map[string]map[string]int64, error) {
+	result := make(map[string]map[string]int64)
+	err := s.view(ctx, func(tx *bolt.Tx) error {
+		c := tx.Bucket(kvFilesBucket).Cursor()
+		for _, folderPath := range folders {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			prefix := getKVFilesPrefix(storageID, folderPath)
+			for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+				addKVBulkResult(result, folderPath, string(k[len(prefix):]), v)
+			}
+		}
+		return nil
+	})
+	return result, err
+}
+
+// GetModificationTimesByPrefix implements BulkStore
+func (s *KVStore) GetModificationTimesByPrefix(ctx context.Context, storageID, prefix string) (map[string]map[string]int64, error) {
+	prefix = strings.TrimSuffix(prefix, "/")
+	result := make(map[string]map[string]int64)
+	err := s.view(ctx, func(tx *bolt.Tx) error {
+		storagePrefix := getKVFolderKey(storageID, "")
+		scanPrefix := getKVFolderKey(storageID, prefix)
+		c := tx.Bucket(kvFilesBucket).Cursor()
+		for k, v := c.Seek(scanPrefix); k != nil && bytes.HasPrefix(k, scanPrefix); k, v = c.Next() {
+			folderPath, name := splitKVKey(k[len(storagePrefix):])
+			if prefix == "" || folderPath == prefix || strings.HasPrefix(folderPath, prefix+"/") {
+				addKVBulkResult(result, folderPath, name, v)
+			}
+		}
+		return ctx.Err()
+	})
+	return result, err
+}
+
+func addKVBulkResult(result map[string]map[string]int64, folderPath, name string, value []byte) {
+	files, ok := result[folderPath]
+	if !ok {
+		files = make(map[string]int64)
+		result[folderPath] = files
+	}
+	files[name] = decodeKVModTime(value)
+}
+
+// GetModificationTimesPage implements ListingStore
+func (s *KVStore) GetModificationTimesPage(ctx context.Context, storageID, folderPath, after string, limit int) ([]FileModificationTime, error) {
+	var files []FileModificationTime
+	err := s.view(ctx, func(tx *bolt.Tx) error {
+		prefix := getKVFilesPrefix(storageID, folderPath)
+		c := tx.Bucket(kvFilesBucket).Cursor()
+		for k, v := c.Seek(append(prefix, after...)); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			name := string(k[len(prefix):])
+			if name <= after {
+				continue
+			}
+			if limit > 0 && len(files) >= limit {
+				break
+			}
+			files = append(files, FileModificationTime{Name: name, LastModified: decodeKVModTime(v)})
+		}
+		return nil
+	})
+	return files, err
+}
+
+// IterateModificationTimes implements ListingStore. The files are fetched in
+// batches, each one within its own transaction, so a long iteration does not
+// block the database compaction
+func (s *KVStore) IterateModificationTimes(ctx context.Context, storageID, folderPath string) (FileIterator, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return &kvFileIterator{
+		ctx:        ctx,
+		store:      s,
+		storageID:  storageID,
+		folderPath: folderPath,
+	}, nil
+}
+
+// kvFileIterator is a FileIterator reading the files in batches
+type kvFileIterator struct {
+	ctx        context.Context
+	store      *KVStore
+	storageID  string
+	folderPath string
+	batch      []FileModificationTime
+	file       FileModificationTime
+	done       bool
+	err        error
+}
+
+func (it *kvFileIterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	if len(it.batch) == 0 {
+		if it.done {
+			return false
+		}
+		it.batch, it.err = it.store.GetModificationTimesPage(it.ctx, it.storageID, it.folderPath, it.file.Name,
+			kvScanBatchSize)
+		if it.err != nil {
+			return false
+		}
+		it.done = len(it.batch) < kvScanBatchSize
+		if len(it.batch) == 0 {
+			return false
+		}
+	}
+	it.file = it.batch[0]
+	it.batch = it.batch[1:]
+	return true
+}
+
+func (it *kvFileIterator) File() FileModificationTime {
+	return it.file
+}
+
+func (it *kvFileIterator) Err() error {
+	return it.err
+}
+
+func (it *kvFileIterator) Close() error {
+	it.batch = nil
+	it.done = true
+	return nil
+}
+
+// Cleanup implements CleanupStore. The folders without files are removed in
+// batches and the database file is then compacted, if enough space is free
+func (s *KVStore) Cleanup(ctx context.Context) error {
+	removed, err := s.removeOrphanFolders(ctx)
+	if err != nil {
+		return err
+	}
+	logger.AppLogger.Debug("orphan folders removed", "count", removed)
+	return s.compact(ctx)
+}
+
+func (s *KVStore) removeOrphanFolders(ctx context.Context) (int, error) {
+	var from []byte
+	removed := 0
+	for {
+		var orphans [][]byte
+		var last []byte
+		err := s.view(ctx, func(tx *bolt.Tx) error {
+			orphans, last = findKVOrphans(tx, from)
+			return nil
+		})
+		if err != nil {
+			return removed, err
+		}
+		if len(orphans) > 0 {
+			// files could have been added in the meantime, so the orphans
+			// are checked again within the write transaction
+			err = s.update(ctx, func(tx *bolt.Tx) error {
+				folders := tx.Bucket(kvFoldersBucket)
+				c := tx.Bucket(kvFilesBucket).Cursor()
+				for _, key := range orphans {
+					storageID, folderPath := splitKVKey(key)
+					prefix := getKVFilesPrefix(storageID, folderPath)
+					if k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix) {
+						continue
+					}
+					if err := folders.Delete(key); err != nil {
+						return err
+					}
+					removed++
+				}
+				return nil
+			})
+			if err != nil {
+				return removed, err
+			}
+		}
+		if last == nil {
+			return removed, nil
+		}
+		from = append(last, kvSeparator)
+	}
+}
+
+// findKVOrphans returns the folders without files within a batch of folders
+// starting from the specified key and the last checked key, nil if there are
+// no more folders
+func findKVOrphans(tx *bolt.Tx, from []byte) ([][]byte, []byte) {
+	var orphans [][]byte
+	var last []byte
+	files := tx.Bucket(kvFilesBucket).Cursor()
+	c := tx.Bucket(kvFoldersBucket).Cursor()
+	k, _ := c.First()
+	if from != nil {
+		k, _ = c.Seek(from)
+	}
+	for count := 0; k != nil; k, _ = c.Next() {
+		if count >= kvScanBatchSize {
+			return orphans, last
+		}
+		storageID, folderPath := splitKVKey(k)
+		prefix := getKVFilesPrefix(storageID, folderPath)
+		if fk, _ := files.Seek(prefix); fk == nil || !bytes.HasPrefix(fk, prefix) {
+			orphans = append(orphans, bytes.Clone(k))
+		}
+		last = bytes.Clone(k)
+		count++
+	}
+	return orphans, nil
+}
+
+// compact rewrites the database file, if enough space is free, so the space
+// freed by the removed keys is returned to the file system
+func (s *KVStore) compact(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err != nil {
+		return s.err
+	}
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+	stats := s.db.Stats()
+	free := int64(stats.FreePageN+stats.PendingPageN) * int64(s.db.Info().PageSize)
+	if free < kvCompactionMinFree || free < info.Size()/2 || ctx.Err() != nil {
+		return ctx.Err()
+	}
+	logger.AppLogger.Debug("compacting key-value database", "path", s.path, "size", info.Size(), "free", free)
+	compactPath := s.path + ".compact"
+	if err := os.Remove(compactPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	dst, err := bolt.Open(compactPath, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return err
+	}
+	if err := bolt.Compact(dst, s.db, kvCompactTxMaxSize); err != nil {
+		dst.Close()
+		os.Remove(compactPath)
+		return fmt.Errorf("unable to compact key-value database: %w", err)
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(compactPath)
+		return err
+	}
+	if err := s.db.Close(); err != nil {
+		os.Remove(compactPath)
+		return err
+	}
+	renameErr := os.Rename(compactPath, s.path)
+	// the original database is opened again if the rename failed
+	db, err := openKVDatabase(s.path)
+	if err != nil {
+		logger.AppLogger.Error("unable to reopen key-value database after compaction", "path", s.path, "error", err)
+		s.err = fmt.Errorf("the key-value database is unavailable, it cannot be reopened after compaction: %w", err)
+		return s.err
+	}
+	s.db = db
+	if renameErr != nil {
+		os.Remove(compactPath)
+	}
+	return renameErr
+}
+
+func getKVFolderKey(storageID, folderPath string) []byte {
+	key := make([]byte, 0, len(storageID)+len(folderPath)+1)
+	key = append(key, storageID...)
+	key = append(key, kvSeparator)
+	return append(key, folderPath...)
+}
+
+func getKVFilesPrefix(storageID, folderPath string) []byte {
+	return append(getKVFolderKey(storageID, folderPath), kvSeparator)
+}
+
+func getKVFileKey(storageID, folderPath, name string) []byte {
+	return append(getKVFilesPrefix(storageID, folderPath), name...)
+}
+
+// splitKVKey returns the key elements before and after the first separator
+func splitKVKey(key []byte) (string, string) {
+	before, after, _ := bytes.Cut(key, []byte{kvSeparator})
+	return string(before), string(after)
+}
+
+func encodeKVModTime(mTime int64) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(mTime))
+}
+
+func decodeKVModTime(value []byte) int64 {
+	if len(value) != 8 {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(value))
+}
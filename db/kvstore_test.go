@@ -0,0 +1,227 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func newTestKVStore(t *testing.T) *KVStore {
+	store, err := NewStore(Config{Driver: driverNameBolt, DSN: filepath.Join(t.TempDir(), "metadata.db")})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		store.Close()
+	})
+	return store.(*KVStore)
+}
+
+func TestKVStoreMetadata(t *testing.T) {
+	store := newTestKVStore(t)
+	m := NewMetadater(store, MetadaterConfig{})
+
+	_, err := m.GetModificationTime("s1", "/dir/file")
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	assert.Equal(t, codes.NotFound, status.Code(m.RemoveMetadata("s1", "/dir/file")))
+
+	require.NoError(t, m.SetModificationTime("s1", "/dir/file", 100))
+	require.NoError(t, m.SetModificationTime("s1", "/dir/file", 101))
+	require.NoError(t, m.SetModificationTime("s1", "/dir/file1", 102))
+	require.NoError(t, m.SetModificationTime("s1", "/dir/sub/file", 103))
+	require.NoError(t, m.SetModificationTime("s2", "/dir/file", 104))
+	require.NoError(t, m.SetModificationTime("s1", "/file", 105))
+
+	mTime, err := m.GetModificationTime("s1", "/dir/file")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(101), mTime)
+	mTime, err = m.GetModificationTime("s2", "/dir/file")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(104), mTime)
+	// the prefix scan must not include the files of the subfolders
+	files, err := m.GetModificationTimes("s1", "/dir")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int64{"file": 101, "file1": 102}, files)
+	files, err = m.GetModificationTimes("s1", "/")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int64{"file": 105}, files)
+	files, err = m.GetModificationTimes("s1", "/missing")
+	assert.NoError(t, err)
+	assert.Empty(t, files)
+
+	require.NoError(t, m.RemoveMetadata("s1", "/dir/file"))
+	_, err = m.GetModificationTime("s1", "/dir/file")
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	mTime, err = m.GetModificationTime("s2", "/dir/file")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(104), mTime)
+
+	_, err = m.GetChildFolders("s1", "/")
+	assert.Equal(t, codes.Unimplemented, status.Code(err))
+}
+
+func TestKVStoreGetFolders(t *testing.T) {
+	store := newTestKVStore(t)
+	ctx := context.Background()
+
+	for _, storageID := range []string{"s1", "s10", "s2"} {
+		for _, folder := range []string{"/a", "/b", "/b/c", "/d"} {
+			require.NoError(t, store.SetModificationTime(ctx, storageID, folder+"/file", 1))
+		}
+	}
+	folders, err := store.GetFolders(ctx, "s1", 0, "")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/a", "/b", "/b/c", "/d"}, folders)
+	folders, err = store.GetFolders(ctx, "s1", 2, "/a")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/b", "/b/c"}, folders)
+	folders, err = store.GetFolders(ctx, "s1", 2, "/b/c")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/d"}, folders)
+	folders, err = store.GetFolders(ctx, "s3", 0, "")
+	assert.NoError(t, err)
+	assert.Empty(t, folders)
+	// without a storage ID the same paths are returned once for each storage
+	folders, err = store.GetFolders(ctx, "", 5, "/a")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/b", "/b", "/b", "/b/c", "/b/c"}, folders)
+}
+
+func TestKVStoreBulkAndListing(t *testing.T) {
+	store := newTestKVStore(t)
+	m := NewMetadater(store, MetadaterConfig{})
+
+	for i := 0; i < 5; i++ {
+		require.NoError(t, m.SetModificationTime("s1", fmt.Sprintf("/dir/file%d", i), int64(i)))
+	}
+	require.NoError(t, m.SetModificationTime("s1", "/dir/sub/file", 10))
+	require.NoError(t, m.SetModificationTime("s1", "/dir1/file", 11))
+
+	result, err := m.GetModificationTimesByPrefix("s1", "/dir")
+	assert.NoError(t, err)
+	assert.Len(t, result, 2)
+	assert.Len(t, result["/dir"], 5)
+	assert.Equal(t, map[string]int64{"file": 10}, result["/dir/sub"])
+	result, err = m.GetModificationTimesBulk("s1", []string{"/dir/sub", "/dir1", "/missing"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]map[string]int64{
+		"/dir/sub": {"file": 10},
+		"/dir1":    {"file": 11},
+	}, result)
+
+	page, cursor, err := m.GetModificationTimesPage("s1", "/dir", "file1", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, []FileModificationTime{{Name: "file2", LastModified: 2}, {Name: "file3", LastModified: 3}}, page)
+	assert.Equal(t, "file3", cursor)
+
+	it, err := m.IterateModificationTimes(context.Background(), "s1", "/dir")
+	require.NoError(t, err)
+	var names []string
+	for it.Next() {
+		names = append(names, it.File().Name)
+	}
+	assert.NoError(t, it.Err())
+	assert.NoError(t, it.Close())
+	assert.Equal(t, []string{"file0", "file1", "file2", "file3", "file4"}, names)
+}
+
+func TestKVStoreCleanup(t *testing.T) {
+	store := newTestKVStore(t)
+	ctx := context.Background()
+
+	for i := 0; i < 2000; i++ {
+		require.NoError(t, store.SetModificationTime(ctx, "s1", fmt.Sprintf("/dir%d/file", i), int64(i)))
+	}
+	require.NoError(t, store.SetModificationTime(ctx, "s1", "/dir0/file1", 1))
+	for i := 0; i < 2000; i++ {
+		require.NoError(t, store.RemoveMetadata(ctx, "s1", fmt.Sprintf("/dir%d/file", i)))
+	}
+	folders, err := store.GetFolders(ctx, "s1", 0, "")
+	assert.NoError(t, err)
+	assert.Len(t, folders, 2000)
+
+	info, err := os.Stat(store.path)
+	require.NoError(t, err)
+	minFree := kvCompactionMinFree
+	kvCompactionMinFree = 0
+	defer func() {
+		kvCompactionMinFree = minFree
+	}()
+
+	require.NoError(t, store.Cleanup(ctx))
+	folders, err = store.GetFolders(ctx, "s1", 0, "")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/dir0"}, folders)
+	mTime, err := store.GetModificationTime(ctx, "s1", "/dir0/file1")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), mTime)
+	compacted, err := os.Stat(store.path)
+	require.NoError(t, err)
+	assert.Less(t, compacted.Size(), info.Size())
+	assert.NoFileExists(t, store.path+".compact")
+	// the compacted database is writable
+	require.NoError(t, store.SetModificationTime(ctx, "s1", "/dir1/file", 2))
+}
+
+func TestKVStoreUnavailable(t *testing.T) {
+	store := newTestKVStore(t)
+	ctx := context.Background()
+	require.NoError(t, store.SetModificationTime(ctx, "s1", "/dir/file", 1))
+	// the state after a failed reopen, the closed handle is kept
+	require.NoError(t, store.db.Close())
+	store.err = errors.New("reopen failed")
+
+	assert.ErrorIs(t, store.SetModificationTime(ctx, "s1", "/dir/file", 2), store.err)
+	_, err := store.GetModificationTime(ctx, "s1", "/dir/file")
+	assert.ErrorIs(t, err, store.err)
+	_, err = store.GetFolders(ctx, "s1", 0, "")
+	assert.ErrorIs(t, err, store.err)
+	assert.ErrorIs(t, store.Cleanup(ctx), store.err)
+	assert.ErrorIs(t, store.compact(ctx), store.err)
+	assert.NoError(t, store.Close())
+}
+
+func TestNewStoreBolt(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "metadata.db")
+	_, err := NewStore(Config{Driver: driverNameBolt, DSN: dbPath, ChangeEvents: true})
+	assert.Error(t, err)
+	_, err = NewStore(Config{Driver: driverNameBolt})
+	assert.Error(t, err)
+
+	store, err := NewStore(Config{Driver: driverNameBolt, DSN: dbPath})
+	require.NoError(t, err)
+	// the database file is locked
+	_, err = bolt.Open(dbPath, 0600, &bolt.Options{Timeout: 100 * time.Millisecond})
+	assert.Error(t, err)
+	require.NoError(t, store.SetModificationTime(context.Background(), "s1", "/file", 1))
+	require.NoError(t, store.Close())
+
+	store, err = NewStore(Config{Driver: driverNameBolt, DSN: dbPath})
+	require.NoError(t, err)
+	defer store.Close()
+	mTime, err := store.GetModificationTime(context.Background(), "s1", "/file")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), mTime)
+}
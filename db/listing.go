@@ -0,0 +1,227 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"context"
+	"database/sql"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+const (
+	listingQuery = `SELECT metadata_files.name, metadata_files.last_modified FROM metadata_files
+ INNER JOIN metadata_folders ON metadata_folders.id = metadata_files.folder_id
+ WHERE metadata_folders.path = ? AND metadata_folders.storage_id = ?`
+)
+
+// FileModificationTime defines the modification time for a file
+type FileModificationTime struct {
+	Name         string
+	LastModified int64
+}
+
+// GetModificationTimesPage returns up to limit files within the specified
+// folder, ordered by name, starting after the file named after, empty means
+// from the first file. The returned cursor must be used as after to get the
+// next page, it is empty if there are no more files. A missing folder has no
+// files
+func (m *Metadater) GetModificationTimesPage(storageID, folderPath, after string, limit int) (files []FileModificationTime, cursor string, err error) {
+	folderPath = m.pathPolicy.Path(folderPath)
+	ctx, span := startSpan("GetModificationTimesPage", storageID, folderPath, attribute.Int("metadata.limit", limit))
+	defer func() { endSpan(span, len(files), err) }()
+
+	store, ok := m.store.(ListingStore)
+	if !ok {
+		return nil, "", m.checkError(ErrUnsupported)
+	}
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout)
+	defer cancel()
+
+	files, err = store.GetModificationTimesPage(ctx, storageID, folderPath, after, limit)
+	if err != nil {
+		return nil, "", m.checkError(err)
+	}
+	if limit > 0 && len(files) == limit {
+		cursor = files[len(files)-1].Name
+	}
+	return files, cursor, nil
+}
+
+// ModificationTimeIterator streams the modification times for the files
+// within a folder, ordered by name. It must be closed after use
+type ModificationTimeIterator struct {
+	it     FileIterator
+	cancel context.CancelFunc
+	span   trace.Span
+	file   FileModificationTime
+	count  int
+	err    error
+	closed bool
+}
+
+// IterateModificationTimes returns an iterator over the files within the
+// specified folder. The files are read from the database while iterating, so
+// the memory usage does not depend on the number of files. There is no
+// timeout other than the one set in ctx
+func (m *Metadater) IterateModificationTimes(ctx context.Context, storageID, folderPath string) (*ModificationTimeIterator, error) {
+	folderPath = m.pathPolicy.Path(folderPath)
+	_, span := startSpan("IterateModificationTimes", storageID, folderPath)
+
+	store, ok := m.store.(ListingStore)
+	if !ok {
+		err := m.checkError(ErrUnsupported)
+		endSpan(span, 0, err)
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(trace.ContextWithSpan(ctx, span))
+	it, err := store.IterateModificationTimes(ctx, storageID, folderPath)
+	if err != nil {
+		cancel()
+		endSpan(span, 0, err)
+		return nil, m.checkError(err)
+	}
+	return &ModificationTimeIterator{
+		it:     it,
+		cancel: cancel,
+		span:   span,
+	}, nil
+}
+
+// Next advances to the next file, it returns false when there are no more
+// files or an error occurred, check Err to distinguish the two cases
+func (it *ModificationTimeIterator) Next() bool {
+	if it.err != nil || it.closed {
+		return false
+	}
+	if !it.it.Next() {
+		it.err = it.it.Err()
+		return false
+	}
+	it.file = it.it.File()
+	it.count++
+	return true
+}
+
+// File returns the current file
+func (it *ModificationTimeIterator) File() FileModificationTime {
+	return it.file
+}
+
+// Err returns the error, if any, occurred while iterating
+func (it *ModificationTimeIterator) Err() error {
+	return it.err
+}
+
+// Close releases the database resources, it can be called multiple times
+func (it *ModificationTimeIterator) Close() error {
+	if it.closed {
+		return nil
+	}
+	it.closed = true
+	err := it.it.Close()
+	it.cancel()
+	if it.err == nil {
+		it.err = err
+	}
+	endSpan(it.span, it.count, it.err)
+	return err
+}
+
+// GetModificationTimesPage implements ListingStore
+func (s *SQLStore) GetModificationTimesPage(ctx context.Context, storageID, folderPath, after string, limit int) ([]FileModificationTime, error) {
+	query := listingQuery
+	args := []any{folderPath, storageID}
+	if after != "" {
+		query += " AND metadata_files.name > ?"
+		args = append(args, after)
+	}
+	query += " ORDER BY metadata_files.name ASC"
+	if limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, limit)
+	}
+	var files []FileModificationTime
+	err := s.executeRead(ctx, s.getHandle(storageID), storageID, []string{folderPath}, func(sess *gorm.DB) error {
+		files = nil
+		rows, err := sess.Raw(query, args...).Rows()
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var file FileModificationTime
+			if err := rows.Scan(&file.Name, &file.LastModified); err != nil {
+				return err
+			}
+			files = append(files, file)
+		}
+		return rows.Err()
+	})
+	return files, err
+}
+
+// IterateModificationTimes implements ListingStore
+func (s *SQLStore) IterateModificationTimes(ctx context.Context, storageID, folderPath string) (FileIterator, error) {
+	primary := s.getHandle(storageID)
+	handle, r := s.getReadHandle(primary, storageID, []string{folderPath})
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Bool("metadata.replica", r != nil))
+	query := listingQuery + " ORDER BY metadata_files.name ASC"
+	rows, err := handle.WithContext(ctx).Raw(query, folderPath, storageID).Rows()
+	if err != nil && r != nil && ctx.Err() == nil && r.isUnreachable(ctx, err) {
+		r.setHealthy(false, err)
+		rows, err = primary.WithContext(ctx).Raw(query, folderPath, storageID).Rows()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &rowsFileIterator{rows: rows}, nil
+}
+
+// rowsFileIterator is a FileIterator reading the files from the query rows
+type rowsFileIterator struct {
+	rows *sql.Rows
+	file FileModificationTime
+	err  error
+}
+
+func (it *rowsFileIterator) Next() bool {
+	if it.err != nil || !it.rows.Next() {
+		return false
+	}
+	if err := it.rows.Scan(&it.file.Name, &it.file.LastModified); err != nil {
+		it.err = err
+		return false
+	}
+	return true
+}
+
+func (it *rowsFileIterator) File() FileModificationTime {
+	return it.file
+}
+
+func (it *rowsFileIterator) Err() error {
+	if it.err != nil {
+		return it.err
+	}
+	return it.rows.Err()
+}
+
+func (it *rowsFileIterator) Close() error {
+	return it.rows.Close()
+}
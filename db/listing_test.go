@@ -0,0 +1,99 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPaginatedListing(t *testing.T) {
+	m := testMetadater
+	storageID := "s3://listing-bucket"
+	folder := "/listing/dir"
+	mTime := getTimeAsMsSinceEpoch(time.Now())
+	for i := 0; i < 25; i++ {
+		err := m.SetModificationTime(storageID, fmt.Sprintf("%s/file%02d.txt", folder, i), mTime+int64(i))
+		assert.NoError(t, err)
+	}
+	err := m.SetModificationTime(storageID, folder+"/sub/file.txt", mTime)
+	assert.NoError(t, err)
+
+	var names []string
+	cursor := ""
+	pages := 0
+	for {
+		files, next, err := m.GetModificationTimesPage(storageID, folder, cursor, 10)
+		require.NoError(t, err)
+		for _, file := range files {
+			names = append(names, file.Name)
+		}
+		pages++
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	assert.Equal(t, 3, pages)
+	require.Len(t, names, 25)
+	for i, name := range names {
+		assert.Equal(t, fmt.Sprintf("file%02d.txt", i), name)
+	}
+	// an exact multiple of the limit requires an additional empty page
+	files, cursor, err := m.GetModificationTimesPage(storageID, folder, "file14.txt", 10)
+	require.NoError(t, err)
+	assert.Len(t, files, 10)
+	assert.Equal(t, "file24.txt", cursor)
+	files, cursor, err = m.GetModificationTimesPage(storageID, folder, cursor, 10)
+	require.NoError(t, err)
+	assert.Len(t, files, 0)
+	assert.Empty(t, cursor)
+	files, _, err = m.GetModificationTimesPage(storageID, "/listing/missing", "", 10)
+	require.NoError(t, err)
+	assert.Len(t, files, 0)
+	files, cursor, err = m.GetModificationTimesPage(storageID, folder, "", 0)
+	require.NoError(t, err)
+	assert.Len(t, files, 25)
+	assert.Empty(t, cursor)
+
+	it, err := m.IterateModificationTimes(context.Background(), storageID, folder)
+	require.NoError(t, err)
+	count := 0
+	for it.Next() {
+		file := it.File()
+		assert.Equal(t, fmt.Sprintf("file%02d.txt", count), file.Name)
+		assert.Equal(t, mTime+int64(count), file.LastModified)
+		count++
+	}
+	assert.NoError(t, it.Err())
+	assert.NoError(t, it.Close())
+	assert.NoError(t, it.Close())
+	assert.False(t, it.Next())
+	assert.Equal(t, 25, count)
+
+	// closing before the end is allowed
+	it, err = m.IterateModificationTimes(context.Background(), storageID, folder)
+	require.NoError(t, err)
+	assert.True(t, it.Next())
+	assert.NoError(t, it.Close())
+
+	_, err = testStore.RemoveStorage(storageID)
+	assert.NoError(t, err)
+}
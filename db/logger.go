@@ -0,0 +1,98 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+	gormlogger "gorm.io/gorm/logger"
+
+	"github.com/sftpgo/sftpgo-plugin-metadata/logger"
+)
+
+// gormLogger routes the gorm logs through the application logger.
+// Failed statements are logged as errors, statements slower than
+// slowThreshold as warnings and all the other statements at debug level,
+// if debug is true, or at trace level
+type gormLogger struct {
+	level         gormlogger.LogLevel
+	slowThreshold time.Duration
+	debug         bool
+}
+
+func newGormLogger(debug bool, slowThreshold time.Duration) *gormLogger {
+	return &gormLogger{
+		level:         gormlogger.Info,
+		slowThreshold: slowThreshold,
+		debug:         debug,
+	}
+}
+
+// LogMode implements gormlogger.Interface
+func (l *gormLogger) LogMode(level gormlogger.LogLevel) gormlogger.Interface {
+	newLogger := *l
+	newLogger.level = level
+	return &newLogger
+}
+
+// Info implements gormlogger.Interface
+func (l *gormLogger) Info(_ context.Context, msg string, data ...any) {
+	if l.level >= gormlogger.Info {
+		logger.AppLogger.Info(fmt.Sprintf(msg, data...))
+	}
+}
+
+// Warn implements gormlogger.Interface
+func (l *gormLogger) Warn(_ context.Context, msg string, data ...any) {
+	if l.level >= gormlogger.Warn {
+		logger.AppLogger.Warn(fmt.Sprintf(msg, data...))
+	}
+}
+
+// Error implements gormlogger.Interface
+func (l *gormLogger) Error(_ context.Context, msg string, data ...any) {
+	if l.level >= gormlogger.Error {
+		logger.AppLogger.Error(fmt.Sprintf(msg, data...))
+	}
+}
+
+// Trace implements gormlogger.Interface
+func (l *gormLogger) Trace(_ context.Context, begin time.Time, fc func() (string, int64), err error) {
+	if l.level <= gormlogger.Silent {
+		return
+	}
+	elapsed := time.Since(begin)
+	switch {
+	case err != nil && l.level >= gormlogger.Error && !errors.Is(err, gorm.ErrRecordNotFound):
+		sql, rows := fc()
+		logger.AppLogger.Error("sql statement failed", "elapsed", elapsed, "rows", rows, "sql", sql, "error", err)
+	case l.slowThreshold > 0 && elapsed > l.slowThreshold && l.level >= gormlogger.Warn:
+		sql, rows := fc()
+		logger.AppLogger.Warn("slow sql statement", "elapsed", elapsed, "threshold", l.slowThreshold,
+			"rows", rows, "sql", sql)
+	case l.level >= gormlogger.Info:
+		if l.debug {
+			sql, rows := fc()
+			logger.AppLogger.Debug("sql statement", "elapsed", elapsed, "rows", rows, "sql", sql)
+		} else if logger.AppLogger.IsTrace() {
+			sql, rows := fc()
+			logger.AppLogger.Trace("sql statement", "elapsed", elapsed, "rows", rows, "sql", sql)
+		}
+	}
+}
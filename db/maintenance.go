@@ -0,0 +1,162 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	exportQuery = `SELECT metadata_folders.storage_id, metadata_folders.path, metadata_files.name,
+ metadata_files.last_modified FROM metadata_files
+ INNER JOIN metadata_folders ON metadata_folders.id = metadata_files.folder_id`
+)
+
+var (
+	maintenanceQueryTimeout = 10 * time.Minute
+)
+
+// ExportRecord defines the metadata for a single file as exported
+type ExportRecord struct {
+	StorageID    string `json:"storage_id"`
+	Path         string `json:"path"`
+	Name         string `json:"name"`
+	LastModified int64  `json:"last_modified"`
+}
+
+// GetDatabaseName returns the name of the database we are connected to
+func (s *SQLStore) GetDatabaseName() (string, error) {
+	sess, cancel := s.getSessionWithTimeout(context.Background(), "", defaultQueryTimeout)
+	defer cancel()
+
+	return queryDatabaseName(sess)
+}
+
+// GetDatabaseNames returns the names of the databases storing the metadata
+// for the specified storage ID or, if empty, the names of all the databases,
+// the default one first
+func (s *SQLStore) GetDatabaseNames(storageID string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultQueryTimeout)
+	defer cancel()
+
+	if storageID != "" {
+		name, err := queryDatabaseName(s.getSession(ctx, storageID))
+		if err != nil {
+			return nil, err
+		}
+		return []string{name}, nil
+	}
+	var names []string
+	err := s.ForEachDatabase(func(_ string, handle *gorm.DB) error {
+		name, err := queryDatabaseName(handle.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		names = append(names, name)
+		return nil
+	})
+	return names, err
+}
+
+func queryDatabaseName(sess *gorm.DB) (string, error) {
+	var query string
+	switch sess.Dialector.Name() {
+	case driverNamePostgreSQL:
+		query = "SELECT current_database()"
+	case driverNameMySQL:
+		query = "SELECT DATABASE()"
+	default:
+		return "", fmt.Errorf("unsupported database driver %v", sess.Dialector.Name())
+	}
+	var name string
+	err := sess.Raw(query).Row().Scan(&name)
+	return name, err
+}
+
+// ExportMetadata writes the metadata for the specified storage ID, or for all
+// the storages if empty, to w as JSON lines. It returns the number of exported
+// records. Nothing is exported if the database schema does not exist
+func (s *SQLStore) ExportMetadata(w io.Writer, storageID string) (int64, error) {
+	bw := bufio.NewWriter(w)
+	encoder := json.NewEncoder(bw)
+	var exported int64
+	for _, handle := range s.getHandles(storageID) {
+		n, err := exportMetadata(handle, encoder, storageID)
+		exported += n
+		if err != nil {
+			return exported, err
+		}
+	}
+	return exported, bw.Flush()
+}
+
+func exportMetadata(handle *gorm.DB, encoder *json.Encoder, storageID string) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), maintenanceQueryTimeout)
+	defer cancel()
+
+	sess := handle.WithContext(ctx)
+	if !sess.Migrator().HasTable(&Folder{}) || !sess.Migrator().HasTable(&File{}) {
+		return 0, nil
+	}
+	query := exportQuery
+	var args []any
+	if storageID != "" {
+		query += " WHERE metadata_folders.storage_id = ?"
+		args = append(args, storageID)
+	}
+	rows, err := sess.Raw(query, args...).Rows()
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var exported int64
+	for rows.Next() {
+		var record ExportRecord
+		if err := rows.Scan(&record.StorageID, &record.Path, &record.Name, &record.LastModified); err != nil {
+			return exported, err
+		}
+		if err := encoder.Encode(&record); err != nil {
+			return exported, err
+		}
+		exported++
+	}
+	return exported, rows.Err()
+}
+
+// RemoveStorage removes all the folders, and so all the files, for the
+// specified storage ID. It returns the number of removed folders
+func (s *SQLStore) RemoveStorage(storageID string) (int64, error) {
+	sess, cancel := s.getSessionWithTimeout(context.Background(), storageID, maintenanceQueryTimeout)
+	defer cancel()
+
+	// files are removed by the foreign key cascade
+	sess = sess.Where("storage_id = ?", storageID).Delete(&Folder{})
+	if sess.Error == nil {
+		s.recordWrite(storageID, "")
+		s.invalidateFolderIDs()
+		s.auditBulkOperation(AuditOperationRemoveStorage, storageID, "", map[string]any{
+			"folders": sess.RowsAffected,
+		})
+	}
+	return sess.RowsAffected, sess.Error
+}
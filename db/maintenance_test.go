@@ -0,0 +1,92 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetDatabaseName(t *testing.T) {
+	name, err := testStore.GetDatabaseName()
+	assert.NoError(t, err)
+	assert.NotEmpty(t, name)
+	names, err := testStore.GetDatabaseNames("s3://bucket")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{name}, names)
+}
+
+func TestExportAndRemoveStorage(t *testing.T) {
+	m := testMetadater
+	storageID1 := "s3://export-bucket"
+	storageID2 := "s3://other-bucket"
+	mTime := getTimeAsMsSinceEpoch(time.Now())
+
+	for i := 0; i < 5; i++ {
+		err := m.SetModificationTime(storageID1, fmt.Sprintf("/export/folder%v/file.txt", i), mTime)
+		assert.NoError(t, err)
+		err = m.SetModificationTime(storageID2, fmt.Sprintf("/export/folder%v/file.txt", i), mTime)
+		assert.NoError(t, err)
+	}
+
+	var buf bytes.Buffer
+	exported, err := testStore.ExportMetadata(&buf, storageID1)
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), exported)
+	scanner := bufio.NewScanner(&buf)
+	var records []ExportRecord
+	for scanner.Scan() {
+		var record ExportRecord
+		err = json.Unmarshal(scanner.Bytes(), &record)
+		require.NoError(t, err)
+		records = append(records, record)
+	}
+	if assert.Len(t, records, 5) {
+		for _, record := range records {
+			assert.Equal(t, storageID1, record.StorageID)
+			assert.Equal(t, "file.txt", record.Name)
+			assert.Equal(t, mTime, record.LastModified)
+		}
+	}
+
+	removed, err := testStore.RemoveStorage(storageID1)
+	assert.NoError(t, err)
+	// the "/export" and "/" ancestors are removed too
+	assert.Equal(t, int64(7), removed)
+	folders, err := m.GetFolders(storageID1, 0, "")
+	assert.NoError(t, err)
+	assert.Len(t, folders, 0)
+	_, err = m.GetModificationTime(storageID1, "/export/folder0/file.txt")
+	checkNotFoundError(t, err)
+	folders, err = m.GetFolders(storageID2, 0, "")
+	assert.NoError(t, err)
+	assert.Len(t, folders, 5)
+
+	removed, err = testStore.RemoveStorage(storageID2)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(7), removed)
+	buf.Reset()
+	exported, err = testStore.ExportMetadata(&buf, storageID2)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), exported)
+	assert.Equal(t, 0, buf.Len())
+}
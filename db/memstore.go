@@ -0,0 +1,621 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/sftpgo/sftpgo-plugin-metadata/logger"
+)
+
+// MemoryStore is a Store keeping the metadata in memory, for tests and
+// ephemeral deployments. It implements all the optional capabilities with
+// the same semantics as the SQL store: the ancestors of a folder are created
+// to link the hierarchy and the folders left without files are removed by
+// the periodic cleanup. If a snapshot path is set, the metadata are loaded
+// from it, if it exists, and saved to it when the store is closed. The
+// snapshot uses the same JSON lines format as the dump command
+type MemoryStore struct {
+	mu           sync.RWMutex
+	storages     map[string]*memStorage
+	snapshotPath string
+	hooks        StoreHooks
+}
+
+// memStorage holds the folders of a storage
+type memStorage struct {
+	folders map[string]*memFolder
+	// paths holds the paths of all the folders, ordered
+	paths []string
+}
+
+type memFolder struct {
+	files map[string]int64
+	// children holds the paths of the immediate subfolders
+	children map[string]struct{}
+	// implicit is true for the ancestors created to link the hierarchy, as
+	// for the SQL store they are not listed until a file is added
+	implicit bool
+}
+
+// NewMemoryStore returns an in-memory store. If snapshotPath is not empty,
+// the metadata are loaded from it, if it exists, and saved to it on Close
+func NewMemoryStore(snapshotPath string, hooks StoreHooks) (*MemoryStore, error) {
+	s := &MemoryStore{
+		storages:     make(map[string]*memStorage),
+		snapshotPath: snapshotPath,
+		hooks:        hooks,
+	}
+	if snapshotPath == "" {
+		return s, nil
+	}
+	n, err := s.loadSnapshot()
+	if err != nil {
+		logger.AppLogger.Error("unable to load metadata snapshot", "path", snapshotPath, "error", err)
+		return nil, err
+	}
+	logger.AppLogger.Debug("metadata snapshot loaded", "path", snapshotPath, "files", n)
+	return s, nil
+}
+
+// Close implements Store, the metadata are saved to the snapshot path, if
+// any
+func (s *MemoryStore) Close() error {
+	if s.snapshotPath == "" {
+		return nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	n, err := s.saveSnapshot()
+	if err != nil {
+		logger.AppLogger.Error("unable to save metadata snapshot", "path", s.snapshotPath, "error", err)
+		return err
+	}
+	logger.AppLogger.Debug("metadata snapshot saved", "path", s.snapshotPath, "files", n)
+	return nil
+}
+
+func (s *MemoryStore) loadSnapshot() (int64, error) {
+	f, err := os.Open(s.snapshotPath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	defer f.Close()
+
+	var loaded int64
+	decoder := json.NewDecoder(bufio.NewReader(f))
+	for {
+		var record ExportRecord
+		if err := decoder.Decode(&record); err != nil {
+			if errors.Is(err, io.EOF) {
+				return loaded, nil
+			}
+			return loaded, fmt.Errorf("invalid snapshot record %d: %w", loaded+1, err)
+		}
+		s.getOrCreateFolder(record.StorageID, record.Path, false).files[record.Name] = record.LastModified
+		loaded++
+	}
+}
+
+// saveSnapshot writes the metadata to a temporary file that then replaces
+// the snapshot, so a failed save does not corrupt the previous snapshot
+func (s *MemoryStore) saveSnapshot() (int64, error) {
+	tmpPath := s.snapshotPath + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return 0, err
+	}
+	n, err := s.exportMetadata(f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, s.snapshotPath)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+	}
+	return n, err
+}
+
+// exportMetadata writes the metadata as JSON lines ordered by storage ID,
+// folder path and file name
+func (s *MemoryStore) exportMetadata(w io.Writer) (int64, error) {
+	bw := bufio.NewWriter(w)
+	encoder := json.NewEncoder(bw)
+	storageIDs := make([]string, 0, len(s.storages))
+	for storageID := range s.storages {
+		storageIDs = append(storageIDs, storageID)
+	}
+	sort.Strings(storageIDs)
+
+	var exported int64
+	for _, storageID := range storageIDs {
+		storage := s.storages[storageID]
+		for _, folderPath := range storage.paths {
+			for _, file := range getSortedFiles(storage.folders[folderPath].files, "", 0) {
+				record := ExportRecord{
+					StorageID:    storageID,
+					Path:         folderPath,
+					Name:         file.Name,
+					LastModified: file.LastModified,
+				}
+				if err := encoder.Encode(&record); err != nil {
+					return exported, err
+				}
+				exported++
+			}
+		}
+	}
+	return exported, bw.Flush()
+}
+
+func (s *MemoryStore) getFolder(storageID, folderPath string) *memFolder {
+	storage, ok := s.storages[storageID]
+	if !ok {
+		return nil
+	}
+	return storage.folders[folderPath]
+}
+
+// getOrCreateFolder returns the folder with the specified path, the folder
+// and its missing ancestors are created if they do not exist. The ancestors
+// are implicit, an existing implicit folder is no longer implicit if
+// requested for a file
+func (s *MemoryStore) getOrCreateFolder(storageID, folderPath string, implicit bool) *memFolder {
+	storage, ok := s.storages[storageID]
+	if !ok {
+		storage = &memStorage{
+			folders: make(map[string]*memFolder),
+		}
+		s.storages[storageID] = storage
+	}
+	if folder, ok := storage.folders[folderPath]; ok {
+		folder.implicit = folder.implicit && implicit
+		return folder
+	}
+	folder := &memFolder{
+		files:    make(map[string]int64),
+		children: make(map[string]struct{}),
+		implicit: implicit,
+	}
+	storage.folders[folderPath] = folder
+	idx := sort.SearchStrings(storage.paths, folderPath)
+	storage.paths = append(storage.paths, "")
+	copy(storage.paths[idx+1:], storage.paths[idx:])
+	storage.paths[idx] = folderPath
+
+	if parentPath, ok := getParentPath(folderPath); ok {
+		s.getOrCreateFolder(storageID, parentPath, true).children[folderPath] = struct{}{}
+	}
+	return folder
+}
+
+// SetModificationTime implements Store
+func (s *MemoryStore) SetModificationTime(ctx context.Context, storageID, objectPath string, mTime int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	var record *AuditRecord
+	s.mu.Lock()
+	files := s.getOrCreateFolder(storageID, path.Dir(objectPath), false).files
+	name := path.Base(objectPath)
+	if s.hooks.AuditLog != nil {
+		var oldMTime *int64
+		if oldValue, ok := files[name]; ok {
+			oldMTime = &oldValue
+		}
+		record = s.hooks.AuditLog.newRecord(AuditOperationSet, storageID, objectPath, oldMTime, &mTime)
+	}
+	files[name] = mTime
+	s.mu.Unlock()
+
+	s.hooks.AuditLog.write(record)
+	s.hooks.Changes.dispatchLocal(ChangeOperationSet, storageID, objectPath, mTime, "")
+	return nil
+}
+
+// GetModificationTime implements Store
+func (s *MemoryStore) GetModificationTime(ctx context.Context, storageID, objectPath string) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	folder := s.getFolder(storageID, path.Dir(objectPath))
+	if folder == nil {
+		return 0, ErrNotFound
+	}
+	mTime, ok := folder.files[path.Base(objectPath)]
+	if !ok {
+		return 0, ErrNotFound
+	}
+	return mTime, nil
+}
+
+// GetModificationTimes implements Store
+func (s *MemoryStore) GetModificationTimes(ctx context.Context, storageID, folderPath string) (map[string]int64, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := make(map[string]int64)
+	if folder := s.getFolder(storageID, folderPath); folder != nil {
+		for name, mTime := range folder.files {
+			result[name] = mTime
+		}
+	}
+	return result, nil
+}
+
+// RemoveMetadata implements Store
+func (s *MemoryStore) RemoveMetadata(ctx context.Context, storageID, objectPath string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	var record *AuditRecord
+	s.mu.Lock()
+	folder := s.getFolder(storageID, path.Dir(objectPath))
+	if folder == nil {
+		s.mu.Unlock()
+		return ErrNotFound
+	}
+	name := path.Base(objectPath)
+	oldMTime, ok := folder.files[name]
+	if !ok {
+		s.mu.Unlock()
+		return ErrNotFound
+	}
+	if s.hooks.AuditLog != nil {
+		record = s.hooks.AuditLog.newRecord(AuditOperationRemove, storageID, objectPath, &oldMTime, nil)
+	}
+	delete(folder.files, name)
+	s.mu.Unlock()
+
+	s.hooks.AuditLog.write(record)
+	s.hooks.Changes.dispatchLocal(ChangeOperationRemove, storageID, objectPath, 0, "")
+	return nil
+}
+
+// auditBulkOperation records a bulk operation, the audit log can only be
+// written to a file
+func (s *MemoryStore) auditBulkOperation(operation, storageID, objectPath string, details map[string]any) {
+	s.hooks.AuditLog.writeBulk(nil, operation, storageID, objectPath, details)
+}
+
+// GetFolders implements Store
+func (s *MemoryStore) GetFolders(ctx context.Context, storageID string, limit int, from string) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	results := []string{}
+	if storageID != "" {
+		if storage, ok := s.storages[storageID]; ok {
+			results = storage.appendFolders(results, "", limit, from)
+		}
+		return results, nil
+	}
+	// each storage returns at most limit folders, they are then merged
+	for _, storage := range s.storages {
+		results = storage.appendFolders(results, "", limit, from)
+	}
+	sort.Strings(results)
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	return results, nil
+}
+
+// GetFoldersByPrefix implements PrefixStore
+func (s *MemoryStore) GetFoldersByPrefix(ctx context.Context, storageID, prefix string, limit int, from string) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	results := []string{}
+	if storage, ok := s.storages[storageID]; ok {
+		results = storage.appendFolders(results, strings.TrimSuffix(prefix, "/"), limit, from)
+	}
+	return results, nil
+}
+
+// appendFolders appends to results at most limit listed folders, within the
+// prefix, with path greater than from. The paths are sorted in byte order, so
+// the scan stops after the prefix subfolders
+func (s *memStorage) appendFolders(results []string, prefix string, limit int, from string) []string {
+	count := 0
+	for idx := sort.SearchStrings(s.paths, max(from, prefix)); idx < len(s.paths); idx++ {
+		if limit > 0 && count >= limit {
+			break
+		}
+		folderPath := s.paths[idx]
+		if isAfterPrefix(folderPath, prefix) {
+			break
+		}
+		if folderPath <= from || s.folders[folderPath].implicit || !isWithinPrefix(folderPath, prefix) {
+			continue
+		}
+		results = append(results, folderPath)
+		count++
+	}
+	return results
+}
+
+// GetModificationTimesBulk implements BulkStore
+func (s *MemoryStore) GetModificationTimesBulk(ctx context.Context, storageID string, folders []string) (map[string]map[string]int64, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := make(map[string]map[string]int64)
+	for _, folderPath := range folders {
+		if folder := s.getFolder(storageID, folderPath); folder != nil {
+			addMemBulkResult(result, folderPath, folder)
+		}
+	}
+	return result, nil
+}
+
+// GetModificationTimesByPrefix implements BulkStore
+func (s *MemoryStore) GetModificationTimesByPrefix(ctx context.Context, storageID, prefix string) (map[string]map[string]int64, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	prefix = strings.TrimSuffix(prefix, "/")
+	result := make(map[string]map[string]int64)
+	storage, ok := s.storages[storageID]
+	if !ok {
+		return result, nil
+	}
+	for idx := sort.SearchStrings(storage.paths, prefix); idx < len(storage.paths); idx++ {
+		folderPath := storage.paths[idx]
+		if !strings.HasPrefix(folderPath, prefix) {
+			break
+		}
+		if prefix == "" || folderPath == prefix || strings.HasPrefix(folderPath, prefix+"/") {
+			addMemBulkResult(result, folderPath, storage.folders[folderPath])
+		}
+	}
+	return result, nil
+}
+
+// addMemBulkResult adds a copy of the folder files to the result, the folders
+// without files are skipped as for the SQL store
+func addMemBulkResult(result map[string]map[string]int64, folderPath string, folder *memFolder) {
+	if len(folder.files) == 0 {
+		return
+	}
+	files := make(map[string]int64, len(folder.files))
+	for name, mTime := range folder.files {
+		files[name] = mTime
+	}
+	result[folderPath] = files
+}
+
+// GetModificationTimesPage implements ListingStore
+func (s *MemoryStore) GetModificationTimesPage(ctx context.Context, storageID, folderPath, after string, limit int) ([]FileModificationTime, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	folder := s.getFolder(storageID, folderPath)
+	if folder == nil {
+		return nil, nil
+	}
+	return getSortedFiles(folder.files, after, limit), nil
+}
+
+// IterateModificationTimes implements ListingStore, the iterator returns the
+// files existing when it is created
+func (s *MemoryStore) IterateModificationTimes(ctx context.Context, storageID, folderPath string) (FileIterator, error) {
+	files, err := s.GetModificationTimesPage(ctx, storageID, folderPath, "", 0)
+	if err != nil {
+		return nil, err
+	}
+	return &memFileIterator{
+		ctx:   ctx,
+		files: files,
+	}, nil
+}
+
+// getSortedFiles returns at most limit files, ordered by name, with name
+// greater than after. Limit 0 means no limit
+func getSortedFiles(files map[string]int64, after string, limit int) []FileModificationTime {
+	result := make([]FileModificationTime, 0, len(files))
+	for name, mTime := range files {
+		if name > after {
+			result = append(result, FileModificationTime{Name: name, LastModified: mTime})
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	if limit > 0 && len(result) > limit {
+		result = result[:limit]
+	}
+	return result
+}
+
+// memFileIterator is a FileIterator over a copy of the files
+type memFileIterator struct {
+	ctx   context.Context
+	files []FileModificationTime
+	file  FileModificationTime
+	err   error
+}
+
+func (it *memFileIterator) Next() bool {
+	if it.err != nil || len(it.files) == 0 {
+		return false
+	}
+	if it.err = it.ctx.Err(); it.err != nil {
+		return false
+	}
+	it.file = it.files[0]
+	it.files = it.files[1:]
+	return true
+}
+
+func (it *memFileIterator) File() FileModificationTime {
+	return it.file
+}
+
+func (it *memFileIterator) Err() error {
+	return it.err
+}
+
+func (it *memFileIterator) Close() error {
+	it.files = nil
+	return nil
+}
+
+// GetChildFolders implements HierarchyStore
+func (s *MemoryStore) GetChildFolders(ctx context.Context, storageID, folderPath string) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	results := []string{}
+	if folder := s.getFolder(storageID, folderPath); folder != nil {
+		results = getSortedChildren(folder)
+	}
+	return results, nil
+}
+
+// WalkFolders implements HierarchyStore. The lock is not held while calling
+// fn, so fn can use the store
+func (s *MemoryStore) WalkFolders(ctx context.Context, storageID, folderPath string, fn func(folderPath string) error) error {
+	s.mu.RLock()
+	exists := s.getFolder(storageID, folderPath) != nil
+	s.mu.RUnlock()
+	if !exists {
+		return ctx.Err()
+	}
+	level := []string{folderPath}
+	for len(level) > 0 {
+		for _, p := range level {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := fn(p); err != nil {
+				return err
+			}
+		}
+		s.mu.RLock()
+		var children []string
+		for _, p := range level {
+			// the folder could have been removed by a concurrent cleanup
+			if folder := s.getFolder(storageID, p); folder != nil {
+				children = append(children, getSortedChildren(folder)...)
+			}
+		}
+		s.mu.RUnlock()
+		sort.Strings(children)
+		level = children
+	}
+	return nil
+}
+
+func getSortedChildren(folder *memFolder) []string {
+	children := make([]string, 0, len(folder.children))
+	for p := range folder.children {
+		children = append(children, p)
+	}
+	sort.Strings(children)
+	return children
+}
+
+// Cleanup implements CleanupStore, the folders without files and subfolders
+// are removed, their ancestors are then removed if left empty
+func (s *MemoryStore) Cleanup(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	removed := 0
+	for storageID, storage := range s.storages {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		for _, folderPath := range storage.paths {
+			removed += storage.removeEmptyFolder(folderPath)
+		}
+		paths := storage.paths[:0]
+		for _, folderPath := range storage.paths {
+			if _, ok := storage.folders[folderPath]; ok {
+				paths = append(paths, folderPath)
+			}
+		}
+		storage.paths = paths
+		if len(storage.folders) == 0 {
+			delete(s.storages, storageID)
+		}
+	}
+	logger.AppLogger.Debug("unreferenced folders removed", "count", removed)
+	return nil
+}
+
+// removeEmptyFolder removes the specified folder, if it has no files and no
+// subfolders, and then its ancestors left empty. The ordered paths must be
+// updated by the caller
+func (s *memStorage) removeEmptyFolder(folderPath string) int {
+	removed := 0
+	for {
+		folder, ok := s.folders[folderPath]
+		if !ok || len(folder.files) > 0 || len(folder.children) > 0 {
+			return removed
+		}
+		delete(s.folders, folderPath)
+		removed++
+		parentPath, ok := getParentPath(folderPath)
+		if !ok {
+			return removed
+		}
+		if parent, ok := s.folders[parentPath]; ok {
+			delete(parent.children, folderPath)
+		}
+		folderPath = parentPath
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryStoreSnapshot(t *testing.T) {
+	ctx := context.Background()
+	snapshotPath := filepath.Join(t.TempDir(), "snapshot.jsonl")
+
+	store, err := NewStore(Config{Driver: driverNameMemory, DSN: snapshotPath})
+	require.NoError(t, err)
+	require.NoError(t, store.SetModificationTime(ctx, "s1", "/d1/f1", 1))
+	require.NoError(t, store.SetModificationTime(ctx, "s1", "/d1/s1/f1", 2))
+	require.NoError(t, store.SetModificationTime(ctx, "s2", "/f1", 3))
+	require.NoError(t, store.SetModificationTime(ctx, "s2", "/f2", 4))
+	require.NoError(t, store.RemoveMetadata(ctx, "s2", "/f2"))
+	require.NoError(t, store.Close())
+	assert.NoFileExists(t, snapshotPath+".tmp")
+
+	content, err := os.ReadFile(snapshotPath)
+	require.NoError(t, err)
+	assert.Equal(t, `{"storage_id":"s1","path":"/d1","name":"f1","last_modified":1}
+{"storage_id":"s1","path":"/d1/s1","name":"f1","last_modified":2}
+{"storage_id":"s2","path":"/","name":"f1","last_modified":3}
+`, string(content))
+
+	store, err = NewStore(Config{Driver: driverNameMemory, DSN: snapshotPath})
+	require.NoError(t, err)
+	mTime, err := store.GetModificationTime(ctx, "s1", "/d1/s1/f1")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), mTime)
+	children, err := store.(HierarchyStore).GetChildFolders(ctx, "s1", "/d1")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/d1/s1"}, children)
+	_, err = store.GetModificationTime(ctx, "s2", "/f2")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	require.NoError(t, os.WriteFile(snapshotPath, []byte("invalid"), 0600))
+	_, err = NewStore(Config{Driver: driverNameMemory, DSN: snapshotPath})
+	assert.Error(t, err)
+
+	// without a snapshot path the metadata are not persisted
+	store, err = NewStore(Config{Driver: driverNameMemory})
+	require.NoError(t, err)
+	require.NoError(t, store.SetModificationTime(ctx, "s1", "/f1", 1))
+	assert.NoError(t, store.Close())
+	_, err = NewStore(Config{Driver: driverNameMemory, ChangeEvents: true})
+	assert.Error(t, err)
+}
+
+func TestMemoryStoreConcurrency(t *testing.T) {
+	store, err := NewMemoryStore("", StoreHooks{})
+	require.NoError(t, err)
+	m := NewMetadater(store, MetadaterConfig{})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			for j := 0; j < 100; j++ {
+				folder := fmt.Sprintf("/d%d/s%d", j%2, j%5)
+				assert.NoError(t, m.SetModificationTime("s1", fmt.Sprintf("%s/f%d", folder, i*100+j), int64(j)))
+				_, err := m.GetModificationTimes("s1", folder)
+				assert.NoError(t, err)
+				_, err = m.GetFolders("s1", 0, "")
+				assert.NoError(t, err)
+				if j%10 == 0 {
+					assert.NoError(t, store.Cleanup(context.Background()))
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	var count int
+	err = m.WalkFolders("s1", "/", func(folderPath string) error {
+		files, err := m.GetModificationTimes("s1", folderPath)
+		count += len(files)
+		return err
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 800, count)
+}
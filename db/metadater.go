@@ -15,164 +15,204 @@
 package db
 
 import (
+	"context"
 	"errors"
 	"path"
+	"time"
 
+	"github.com/hashicorp/go-hclog"
+	"go.opentelemetry.io/otel/attribute"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
-	"gorm.io/gorm"
-	"gorm.io/gorm/clause"
+
+	"github.com/sftpgo/sftpgo-plugin-metadata/logger"
 )
 
-type Metadater struct{}
+// MetadaterConfig defines the dependencies and the settings for a Metadater
+type MetadaterConfig struct {
+	// PathPolicy is the normalization applied to the paths before they are
+	// passed to the store
+	PathPolicy NormalizationPolicy
+	// QueryTimeout is the timeout for a single metadata operation, 0 means
+	// the default
+	QueryTimeout time.Duration
+	// BulkQueryTimeout is the timeout for the bulk lookups and the folder
+	// walks, 0 means the default
+	BulkQueryTimeout time.Duration
+	// Logger is the logger to use, nil means the application logger
+	Logger hclog.Logger
+	// Cache is an optional cache for the modification times of the files
+	// within a folder
+	Cache Cache
+}
 
-func (m *Metadater) SetModificationTime(storageID, objectPath string, mTime int64) error {
-	sess, cancel := getDefaultSession()
-	defer cancel()
+// Metadater implements the SFTPGo metadata plugin interface on top of a
+// Store. It normalizes the paths, applies the timeouts, traces the
+// operations and caches the folder listings
+type Metadater struct {
+	store            Store
+	pathPolicy       NormalizationPolicy
+	queryTimeout     time.Duration
+	bulkQueryTimeout time.Duration
+	logger           hclog.Logger
+	cache            Cache
+}
 
-	err := executeTx(sess, func(tx *gorm.DB) error {
-		folder := Folder{
-			StorageID: storageID,
-		}
+// NewMetadater returns a Metadater using the specified store. Stores can be
+// wrapped, for example to add metrics or retries, before being passed here
+func NewMetadater(store Store, config MetadaterConfig) *Metadater {
+	m := &Metadater{
+		store:            store,
+		pathPolicy:       config.PathPolicy,
+		queryTimeout:     config.QueryTimeout,
+		bulkQueryTimeout: config.BulkQueryTimeout,
+		logger:           config.Logger,
+		cache:            config.Cache,
+	}
+	if m.queryTimeout <= 0 {
+		m.queryTimeout = defaultQueryTimeout
+	}
+	if m.bulkQueryTimeout <= 0 {
+		m.bulkQueryTimeout = maintenanceQueryTimeout
+	}
+	if m.logger == nil {
+		m.logger = logger.AppLogger
+	}
+	return m
+}
 
-		folderPath := path.Dir(objectPath)
-		folder.Path = folderPath
-		err := tx.Clauses(clause.OnConflict{
-			Columns: []clause.Column{
-				{
-					Name: "path",
-				},
-				{
-					Name: "storage_id",
-				},
-			},
-			DoNothing: true,
-		}).Create(&folder).Error
-		if err != nil {
-			return err
-		}
-		if folder.ID == 0 {
-			folder = Folder{}
-			err = tx.Where("path = ? AND storage_id = ?", folderPath, storageID).Select("id").First(&folder).Error
-			if err != nil {
-				return err
-			}
-		}
-		file := File{
-			Name:         path.Base(objectPath),
-			LastModified: mTime,
-			FolderID:     folder.ID,
-		}
-		return tx.Omit("Folder").Clauses(
-			clause.OnConflict{
-				Columns: []clause.Column{
-					{
-						Name: "name",
-					},
-					{
-						Name: "folder_id",
-					},
-				},
-				DoUpdates: clause.AssignmentColumns([]string{"last_modified"}),
-			}).Create(&file).Error
-	})
+func (m *Metadater) SetModificationTime(storageID, objectPath string, mTime int64) (err error) {
+	objectPath = m.pathPolicy.Path(objectPath)
+	ctx, span := startSpan("SetModificationTime", storageID, objectPath)
+	defer func() { endSpan(span, getAffectedRows(err), err) }()
+
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout)
+	defer cancel()
 
+	err = m.store.SetModificationTime(ctx, storageID, objectPath, mTime)
+	if err == nil {
+		m.invalidateCache(ctx, storageID, path.Dir(objectPath))
+	}
 	return m.checkError(err)
 }
 
-func (m *Metadater) GetModificationTime(storageID, objectPath string) (int64, error) {
-	var err error
-	folder := Folder{}
-	sess, cancel := getDefaultSession()
+func (m *Metadater) GetModificationTime(storageID, objectPath string) (mTime int64, err error) {
+	objectPath = m.pathPolicy.Path(objectPath)
+	ctx, span := startSpan("GetModificationTime", storageID, objectPath)
+	defer func() { endSpan(span, getAffectedRows(err), err) }()
+
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout)
 	defer cancel()
 
-	err = sess.Where("path = ? AND storage_id = ?", path.Dir(objectPath), storageID).Select("id").First(&folder).Error
-	if err != nil {
-		return 0, m.checkError(err)
+	// a cached folder listing is complete, so a missing file does not exist
+	if files, _, ok := m.getCachedFolder(ctx, storageID, path.Dir(objectPath)); ok {
+		mTime, ok = files[path.Base(objectPath)]
+		if !ok {
+			return 0, m.checkError(ErrNotFound)
+		}
+		return mTime, nil
 	}
-	file := File{}
-	err = sess.Where("name = ? AND folder_id = ?", path.Base(objectPath), folder.ID).Select("last_modified").First(&file).Error
+	mTime, err = m.store.GetModificationTime(ctx, storageID, objectPath)
 	if err != nil {
 		return 0, m.checkError(err)
 	}
-	return file.LastModified, nil
+	return mTime, nil
 }
 
-func (m *Metadater) GetModificationTimes(storageID, objectPath string) (map[string]int64, error) {
-	sess, cancel := getSessionWithTimeout(defaultQueryTimeout * 4)
+func (m *Metadater) GetModificationTimes(storageID, objectPath string) (result map[string]int64, err error) {
+	objectPath = m.pathPolicy.Path(objectPath)
+	ctx, span := startSpan("GetModificationTimes", storageID, objectPath)
+	defer func() { endSpan(span, len(result), err) }()
+
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout*4)
 	defer cancel()
 
-	result := make(map[string]int64)
-	folder := Folder{}
-	err := sess.Where("path = ? AND storage_id = ?", objectPath, storageID).Select("id").First(&folder).Error
-	if err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return result, nil
-		}
-		return nil, m.checkError(err)
+	files, version, ok := m.getCachedFolder(ctx, storageID, objectPath)
+	if ok {
+		return files, nil
 	}
-	var files []File
-	err = sess.Where("folder_id = ?", folder.ID).Select("name,last_modified").Find(&files).Error
+	result, err = m.store.GetModificationTimes(ctx, storageID, objectPath)
 	if err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return result, nil
-		}
 		return nil, m.checkError(err)
 	}
-	for idx := range files {
-		result[files[idx].Name] = files[idx].LastModified
+	if m.cache != nil {
+		m.cache.SetModificationTimes(ctx, storageID, objectPath, version, result)
 	}
 	return result, nil
 }
 
-func (m *Metadater) RemoveMetadata(storageID, objectPath string) error {
-	sess, cancel := getDefaultSession()
+func (m *Metadater) RemoveMetadata(storageID, objectPath string) (err error) {
+	objectPath = m.pathPolicy.Path(objectPath)
+	ctx, span := startSpan("RemoveMetadata", storageID, objectPath)
+	defer func() { endSpan(span, getAffectedRows(err), err) }()
+
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout)
 	defer cancel()
 
-	folder := Folder{}
-	err := sess.Where("path = ? AND storage_id = ?", path.Dir(objectPath), storageID).Select("id").First(&folder).Error
-	if err != nil {
-		return m.checkError(err)
+	err = m.store.RemoveMetadata(ctx, storageID, objectPath)
+	if err == nil {
+		m.invalidateCache(ctx, storageID, path.Dir(objectPath))
 	}
-	sess = sess.Where("name = ? AND folder_id = ?", path.Base(objectPath), folder.ID).Delete(&File{})
-	err = checkRowsAffected(sess)
 	return m.checkError(err)
 }
 
-func (m *Metadater) GetFolders(storageID string, limit int, from string) ([]string, error) {
-	var folders []Folder
+func (m *Metadater) GetFolders(storageID string, limit int, from string) (results []string, err error) {
+	// an empty value means the first folder
+	if from != "" {
+		from = m.pathPolicy.Path(from)
+	}
+	ctx, span := startSpan("GetFolders", storageID, from, attribute.Int("metadata.limit", limit))
+	defer func() { endSpan(span, len(results), err) }()
 
-	sess, cancel := getDefaultSession()
+	ctx, cancel := context.WithTimeout(ctx, m.queryTimeout)
 	defer cancel()
 
-	if limit > 0 {
-		sess = sess.Limit(limit)
-	}
-	if from != "" {
-		sess = sess.Where("path > ?", from)
+	results, err = m.store.GetFolders(ctx, storageID, limit, from)
+	if err != nil {
+		return nil, m.checkError(err)
 	}
-	if storageID != "" {
-		sess = sess.Where("storage_id = ?", storageID)
+	return results, nil
+}
+
+// HandleChange implements ChangeConsumer, the cached data for the folders
+// changed by other plugin instances is discarded
+func (m *Metadater) HandleChange(event ChangeEvent) {
+	if m.cache == nil || event.IsLocal() {
+		return
 	}
+	ctx, cancel := context.WithTimeout(context.Background(), m.queryTimeout)
+	defer cancel()
 
-	sess = sess.Order("path ASC")
-	err := sess.Select("path").Find(&folders).Error
-	if err != nil {
-		return nil, m.checkError(err)
+	folderPath := event.FolderPath
+	if event.Operation == ChangeOperationResync {
+		folderPath = ""
 	}
+	m.logger.Trace("invalidating cached metadata", "storage_id", event.StorageID, "folder", folderPath)
+	m.cache.Invalidate(ctx, event.StorageID, folderPath)
+}
 
-	results := make([]string, 0, len(folders))
-	for idx := range folders {
-		results = append(results, folders[idx].Path)
+func (m *Metadater) getCachedFolder(ctx context.Context, storageID, folderPath string) (map[string]int64, string, bool) {
+	if m.cache == nil {
+		return nil, "", false
 	}
+	return m.cache.GetModificationTimes(ctx, storageID, folderPath)
+}
 
-	return results, nil
+func (m *Metadater) invalidateCache(ctx context.Context, storageID, folderPath string) {
+	if m.cache != nil {
+		m.cache.Invalidate(ctx, storageID, folderPath)
+	}
 }
 
 func (m *Metadater) checkError(err error) error {
-	if errors.Is(err, gorm.ErrRecordNotFound) {
+	if errors.Is(err, ErrNotFound) {
 		st := status.New(codes.NotFound, err.Error())
 		return st.Err()
 	}
+	if errors.Is(err, ErrUnsupported) {
+		m.logger.Debug("unsupported metadata operation", "error", err)
+		st := status.New(codes.Unimplemented, err.Error())
+		return st.Err()
+	}
 	return err
 }
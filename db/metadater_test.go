@@ -27,7 +27,7 @@ import (
 )
 
 func TestGetSetModificationTime(t *testing.T) {
-	m := Metadater{}
+	m := testMetadater
 	storageID := "s3://my-bucket"
 	path1 := "/user1/folder1/file1.txt"
 	path2 := "/user1/folder1/file2.txt"
@@ -72,7 +72,7 @@ func TestGetSetModificationTime(t *testing.T) {
 }
 
 func TestGetModificationTimes(t *testing.T) {
-	m := Metadater{}
+	m := testMetadater
 	storageID := "gs://my-bucket"
 	folder1 := "user1/folder1"
 	folder2 := "user1/folder2"
@@ -110,7 +110,7 @@ func TestGetModificationTimes(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Len(t, result, 0)
 
-	err = removeUnreferencedFolders()
+	err = testStore.removeUnreferencedFolders()
 	assert.NoError(t, err)
 	folders, err := m.GetFolders(storageID, 0, "")
 	assert.NoError(t, err)
@@ -118,7 +118,7 @@ func TestGetModificationTimes(t *testing.T) {
 }
 
 func TestGetFolders(t *testing.T) {
-	m := Metadater{}
+	m := testMetadater
 	storageID1 := "gs://my-bucket"
 	storageID2 := "azblob://my-bucket"
 
@@ -163,7 +163,7 @@ func TestGetFolders(t *testing.T) {
 	assert.Len(t, folders1, 10)
 	assert.Len(t, folders2, 10)
 
-	err = removeUnreferencedFolders()
+	err = testStore.removeUnreferencedFolders()
 	assert.NoError(t, err)
 	folders1, err = m.GetFolders(storageID1, 0, "")
 	assert.NoError(t, err)
@@ -176,7 +176,7 @@ func TestGetFolders(t *testing.T) {
 		err = m.RemoveMetadata(storageID2, fmt.Sprintf("/folder%v/file.txt", i))
 		assert.NoError(t, err)
 	}
-	err = removeUnreferencedFolders()
+	err = testStore.removeUnreferencedFolders()
 	assert.NoError(t, err)
 	folders2, err = m.GetFolders(storageID2, 0, "")
 	assert.NoError(t, err)
@@ -184,7 +184,7 @@ func TestGetFolders(t *testing.T) {
 }
 
 func TestFolderNameUniqueConstraint(t *testing.T) {
-	m := Metadater{}
+	m := testMetadater
 	storageID := "gs://mybucket"
 
 	var sb strings.Builder
@@ -216,7 +216,7 @@ func TestFolderNameUniqueConstraint(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Len(t, files, 0)
 
-	err = removeUnreferencedFolders()
+	err = testStore.removeUnreferencedFolders()
 	assert.NoError(t, err)
 	folders, err = m.GetFolders(storageID, 0, "")
 	assert.NoError(t, err)
@@ -17,6 +17,7 @@ package migration
 import (
 	"context"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/go-gormigrate/gormigrate/v2"
@@ -39,6 +40,11 @@ func init() {
 func registerMigrations() {
 	migrations = append(migrations,
 		getV1Migration(),
+		getV2Migration(),
+		getV3Migration(),
+		getV4Migration(),
+		getV5Migration(),
+		getV6Migration(),
 	)
 }
 
@@ -48,7 +54,7 @@ func MigrateDatabase(db *gorm.DB) error {
 	defer cancel()
 
 	db = db.WithContext(ctx)
-	m := gormigrate.New(db, options, migrations)
+	m := gormigrate.New(db, getOptions(db), migrations)
 	return m.Migrate()
 }
 
@@ -62,7 +68,7 @@ func ResetDatabase(db *gorm.DB) error {
 		fmt.Println("no migration was applied, nothing to do")
 		return nil
 	}
-	m := gormigrate.New(db, options, migrations)
+	m := gormigrate.New(db, getOptions(db), migrations)
 	if err := m.RollbackTo(mignationV1ID); err != nil {
 		return err
 	}
@@ -71,3 +77,42 @@ func ResetDatabase(db *gorm.DB) error {
 	}
 	return db.Migrator().DropTable(options.TableName)
 }
+
+// getOptions returns the migration options for the specified database.
+// CockroachDB recommends against schema changes within explicit transactions,
+// they could be partially applied, so the migrations are not wrapped in a
+// transaction
+func getOptions(db *gorm.DB) *gormigrate.Options {
+	if !isCockroachDB(db) {
+		return options
+	}
+	cockroachOptions := *options
+	cockroachOptions.UseTransaction = false
+	return &cockroachOptions
+}
+
+// isCockroachDB returns true if the PostgreSQL dialect is used to connect to
+// CockroachDB
+func isCockroachDB(db *gorm.DB) bool {
+	if db.Dialector.Name() != "postgres" {
+		return false
+	}
+	version, err := queryString(db, "SELECT version()")
+	return err == nil && strings.Contains(version, "CockroachDB")
+}
+
+// queryString returns the single value returned by the specified query. The
+// query is executed even in dry run sessions
+func queryString(db *gorm.DB, query string, args ...any) (string, error) {
+	ctx := db.Statement.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	var result string
+	err := db.Statement.ConnPool.QueryRowContext(ctx, query, args...).Scan(&result)
+	return result, err
+}
+
+func quoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
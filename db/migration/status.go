@@ -0,0 +1,225 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package migration
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"slices"
+
+	"github.com/go-gormigrate/gormigrate/v2"
+	"gorm.io/gorm"
+)
+
+// Status defines the status of a migration
+type Status struct {
+	ID      string
+	Applied bool
+	// Unknown is true for applied migrations not defined in this version
+	Unknown bool
+}
+
+// migrationRecord defines a row of the migrations table, it must match the
+// model used by gormigrate
+type migrationRecord struct {
+	ID string `gorm:"primaryKey;column:id;size:255"`
+}
+
+// GetStatus returns the status of the defined migrations, in order, followed
+// by any unknown applied migration
+func GetStatus(db *gorm.DB) ([]Status, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancel()
+
+	applied, err := getAppliedMigrations(db.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	result := make([]Status, 0, len(migrations))
+	for _, m := range migrations {
+		result = append(result, Status{
+			ID:      m.ID,
+			Applied: slices.Contains(applied, m.ID),
+		})
+	}
+	for _, id := range applied {
+		if !isKnownMigration(id) {
+			result = append(result, Status{
+				ID:      id,
+				Applied: true,
+				Unknown: true,
+			})
+		}
+	}
+	return result, nil
+}
+
+// MigrateDatabaseTo migrates the database up to the specified migration,
+// included. An empty ID means the latest version
+func MigrateDatabaseTo(db *gorm.DB, migrationID string) error {
+	if migrationID == "" {
+		return MigrateDatabase(db)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancel()
+
+	db = db.WithContext(ctx)
+	m := gormigrate.New(db, getOptions(db), migrations)
+	return m.MigrateTo(migrationID)
+}
+
+// RollbackDatabaseTo undoes the migrations applied after the specified one
+func RollbackDatabaseTo(db *gorm.DB, migrationID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancel()
+
+	db = db.WithContext(ctx)
+	m := gormigrate.New(db, getOptions(db), migrations)
+	return m.RollbackTo(migrationID)
+}
+
+// DryRunMigrate returns the SQL statements that would be executed to migrate
+// the database up to the specified migration, included. An empty ID means the
+// latest version. Nothing is written to the database
+func DryRunMigrate(db *gorm.DB, migrationID string) ([]string, error) {
+	if migrationID != "" && !isKnownMigration(migrationID) {
+		return nil, gormigrate.ErrMigrationIDDoesNotExist
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancel()
+
+	db = db.WithContext(ctx)
+	applied, err := getAppliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+	tx, recorder := newDryRunSession(db)
+	if !db.Migrator().HasTable(options.TableName) {
+		if err := tx.Table(options.TableName).AutoMigrate(&migrationRecord{}); err != nil {
+			return nil, err
+		}
+	}
+	for _, m := range migrations {
+		if !slices.Contains(applied, m.ID) {
+			if err := m.Migrate(tx); err != nil {
+				return nil, fmt.Errorf("migration %q: %w", m.ID, err)
+			}
+			if err := tx.Table(options.TableName).Create(&migrationRecord{ID: m.ID}).Error; err != nil {
+				return nil, err
+			}
+		}
+		if m.ID == migrationID {
+			break
+		}
+	}
+	return recorder.statements, nil
+}
+
+// DryRunRollback returns the SQL statements that would be executed to undo
+// the migrations applied after the specified one. Nothing is written to the
+// database
+func DryRunRollback(db *gorm.DB, migrationID string) ([]string, error) {
+	if !isKnownMigration(migrationID) {
+		return nil, gormigrate.ErrMigrationIDDoesNotExist
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancel()
+
+	db = db.WithContext(ctx)
+	applied, err := getAppliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+	tx, recorder := newDryRunSession(db)
+	for i := len(migrations) - 1; i >= 0; i-- {
+		m := migrations[i]
+		if m.ID == migrationID {
+			break
+		}
+		if !slices.Contains(applied, m.ID) {
+			continue
+		}
+		if m.Rollback == nil {
+			return nil, gormigrate.ErrRollbackImpossible
+		}
+		if err := m.Rollback(tx); err != nil {
+			return nil, fmt.Errorf("migration %q: %w", m.ID, err)
+		}
+		err := tx.Table(options.TableName).Where(fmt.Sprintf("%s = ?", options.IDColumnName), m.ID).
+			Delete(&migrationRecord{}).Error
+		if err != nil {
+			return nil, err
+		}
+	}
+	return recorder.statements, nil
+}
+
+func getAppliedMigrations(db *gorm.DB) ([]string, error) {
+	var applied []string
+	if !db.Migrator().HasTable(options.TableName) {
+		return applied, nil
+	}
+	err := db.Table(options.TableName).Pluck(options.IDColumnName, &applied).Error
+	return applied, err
+}
+
+func isKnownMigration(migrationID string) bool {
+	return slices.ContainsFunc(migrations, func(m *gormigrate.Migration) bool {
+		return m.ID == migrationID
+	})
+}
+
+// newDryRunSession returns a session that records the statements modifying
+// the database instead of executing them. Queries are executed so that the
+// generated statements reflect the current schema
+func newDryRunSession(db *gorm.DB) (*gorm.DB, *dryRunConnPool) {
+	recorder := &dryRunConnPool{
+		ConnPool:  db.Statement.ConnPool,
+		dialector: db.Dialector,
+	}
+	tx := db.Session(&gorm.Session{SkipDefaultTransaction: true})
+	tx.Statement.ConnPool = recorder
+	return tx, recorder
+}
+
+// dryRunConnPool is a gorm.ConnPool that records the executed statements
+type dryRunConnPool struct {
+	gorm.ConnPool
+	dialector  gorm.Dialector
+	statements []string
+}
+
+func (p *dryRunConnPool) ExecContext(_ context.Context, query string, args ...any) (sql.Result, error) {
+	p.statements = append(p.statements, p.dialector.Explain(query, args...))
+	return driver.RowsAffected(0), nil
+}
+
+// BeginTx implements gorm.ConnPoolBeginner, transactions are not started
+// since nothing is written
+func (p *dryRunConnPool) BeginTx(_ context.Context, _ *sql.TxOptions) (gorm.ConnPool, error) {
+	return p, nil
+}
+
+// Commit implements gorm.TxCommitter
+func (p *dryRunConnPool) Commit() error {
+	return nil
+}
+
+// Rollback implements gorm.TxCommitter
+func (p *dryRunConnPool) Rollback() error {
+	return nil
+}
@@ -0,0 +1,59 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package migration
+
+import (
+	"github.com/go-gormigrate/gormigrate/v2"
+	"gorm.io/gorm"
+)
+
+const (
+	migrationV2ID = "2"
+)
+
+type auditLogV2 struct {
+	ID              int64  `gorm:"primarykey"`
+	EventTime       int64  `gorm:"size:64;not null;index:idx_audit_log_event_time"`
+	Operation       string `gorm:"size:32;not null"`
+	StorageID       string `gorm:"size:512;not null;index:idx_audit_log_storage_id"`
+	Path            string `gorm:"type:text;not null"`
+	OldLastModified *int64 `gorm:"size:64"`
+	NewLastModified *int64 `gorm:"size:64"`
+	Node            string `gorm:"size:255;not null"`
+}
+
+func (*auditLogV2) TableName() string {
+	return "metadata_audit_logs"
+}
+
+func v2Up(tx *gorm.DB) error {
+	return tx.AutoMigrate(&auditLogV2{})
+}
+
+func v2Down(tx *gorm.DB) error {
+	return tx.Migrator().DropTable(&auditLogV2{})
+}
+
+func getV2Migration() *gormigrate.Migration {
+	return &gormigrate.Migration{
+		ID: migrationV2ID,
+		Migrate: func(tx *gorm.DB) error {
+			return v2Up(tx)
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return v2Down(tx)
+		},
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package migration
+
+import (
+	"fmt"
+
+	"github.com/go-gormigrate/gormigrate/v2"
+	"gorm.io/gorm"
+)
+
+const (
+	migrationV3ID = "3"
+	// the folder name is the last path element, empty for "/"
+	v3PostgreSQLNameExpr = `regexp_replace(path, '^.*/', '')`
+	v3MySQLNameExpr      = `SUBSTRING_INDEX(path, '/', -1)`
+	v3SetNameQuery       = `UPDATE metadata_folders SET name = %s WHERE name IS NULL`
+	// the folders with a parent contain a slash and they are not the root
+	v3HasParentFilter    = `f.path LIKE '%%/%%' AND f.path <> '/'`
+	v3CreateParentsQuery = `INSERT INTO metadata_folders (path, storage_id)
+ SELECT DISTINCT %s, f.storage_id FROM metadata_folders f WHERE ` + v3HasParentFilter + ` AND NOT EXISTS
+ (SELECT p.id FROM metadata_folders p WHERE p.storage_id = f.storage_id AND p.path = %s)`
+	// MySQL does not allow to reference the updated table within a subquery
+	v3MySQLSetParentQuery = `UPDATE metadata_folders f INNER JOIN metadata_folders p
+ ON p.storage_id = f.storage_id AND p.path = %s SET f.parent_id = p.id WHERE ` + v3HasParentFilter
+	v3PostgreSQLSetParentQuery = `UPDATE metadata_folders f SET parent_id = p.id FROM metadata_folders p
+ WHERE p.storage_id = f.storage_id AND p.path = %s AND ` + v3HasParentFilter
+)
+
+type folderV3 struct {
+	ID        int64  `gorm:"primarykey"`
+	Path      string `gorm:"type:text;not null;index:idx_folder_path;index:idx_unique_folder_path_storage_id,unique"`
+	StorageID string `gorm:"size:512;not null;index:idx_folder_storage_id;index:idx_unique_folder_path_storage_id,unique"`
+	ParentID  *int64 `gorm:"size:64;index:idx_folder_parent_id"`
+	Name      string `gorm:"type:text"`
+}
+
+func (*folderV3) TableName() string {
+	return "metadata_folders"
+}
+
+func v3Up(tx *gorm.DB) error {
+	// the columns are added explicitly, AutoMigrate would also try to alter
+	// the existing ones
+	migrator := tx.Migrator()
+	if err := migrator.AddColumn(&folderV3{}, "ParentID"); err != nil {
+		return err
+	}
+	if err := migrator.AddColumn(&folderV3{}, "Name"); err != nil {
+		return err
+	}
+	if err := migrator.CreateIndex(&folderV3{}, "idx_folder_parent_id"); err != nil {
+		return err
+	}
+	return v3Backfill(tx)
+}
+
+// v3Backfill sets the name and the parent for the existing folders and
+// creates the missing ancestors. The statements are set based and they are
+// run using Exec, so they are recorded in dry run mode. Each pass creates the
+// missing parents for a tree level, so the number of passes is the depth of
+// the deepest folder
+func v3Backfill(tx *gorm.DB) error {
+	nameExpr := v3PostgreSQLNameExpr
+	if tx.Dialector.Name() == "mysql" {
+		nameExpr = v3MySQLNameExpr
+	}
+	for {
+		if err := tx.Exec(fmt.Sprintf(v3SetNameQuery, nameExpr)).Error; err != nil {
+			return err
+		}
+		res := tx.Exec(fmt.Sprintf(v3CreateParentsQuery, getV3ParentExpr("f"), getV3ParentExpr("f")))
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			break
+		}
+	}
+	query := v3PostgreSQLSetParentQuery
+	if tx.Dialector.Name() == "mysql" {
+		query = v3MySQLSetParentQuery
+	}
+	return tx.Exec(fmt.Sprintf(query, getV3ParentExpr("f"))).Error
+}
+
+// getV3ParentExpr returns the SQL expression for the parent path of the
+// folders with alias table and a parent. The stored folder paths are clean,
+// so the parent is the path without the last element, "/" for the top level
+// absolute folders
+func getV3ParentExpr(table string) string {
+	return fmt.Sprintf(`CASE WHEN %[1]s.path LIKE '/%%' AND %[1]s.path NOT LIKE '/%%/%%' THEN '/'
+ ELSE SUBSTRING(%[1]s.path, 1, CHAR_LENGTH(%[1]s.path) - CHAR_LENGTH(%[1]s.name) - 1) END`, table)
+}
+
+func v3Down(tx *gorm.DB) error {
+	migrator := tx.Migrator()
+	if err := migrator.DropIndex(&folderV3{}, "idx_folder_parent_id"); err != nil {
+		return err
+	}
+	if err := migrator.DropColumn(&folderV3{}, "parent_id"); err != nil {
+		return err
+	}
+	return migrator.DropColumn(&folderV3{}, "name")
+}
+
+func getV3Migration() *gormigrate.Migration {
+	return &gormigrate.Migration{
+		ID: migrationV3ID,
+		Migrate: func(tx *gorm.DB) error {
+			return v3Up(tx)
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return v3Down(tx)
+		},
+	}
+}
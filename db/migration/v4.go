@@ -0,0 +1,93 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package migration
+
+import (
+	"fmt"
+
+	"github.com/go-gormigrate/gormigrate/v2"
+	"gorm.io/gorm"
+)
+
+const (
+	migrationV4ID = "4"
+	// the primary key constraint name is read from the catalog, the default
+	// name changed across CockroachDB versions
+	v4PrimaryKeyQuery = `SELECT constraint_name FROM information_schema.table_constraints
+ WHERE table_schema = current_schema() AND table_name = $1 AND constraint_type = 'PRIMARY KEY'`
+)
+
+// v4Tables are the tables with sequential primary keys
+var v4Tables = []string{"metadata_folders", "metadata_files", "metadata_audit_logs"}
+
+// v4Up replaces, on CockroachDB, the primary keys and the audit log time index
+// with hash-sharded ones. The IDs generated by unique_rowid are ordered by
+// time, so all the inserts would hit the same range. The other databases are
+// not modified
+func v4Up(tx *gorm.DB) error {
+	if !isCockroachDB(tx) {
+		return nil
+	}
+	for _, table := range v4Tables {
+		if err := alterV4PrimaryKey(tx, table, "USING HASH"); err != nil {
+			return err
+		}
+	}
+	return alterV4EventTimeIndex(tx, "USING HASH")
+}
+
+func v4Down(tx *gorm.DB) error {
+	if !isCockroachDB(tx) {
+		return nil
+	}
+	for _, table := range v4Tables {
+		if err := alterV4PrimaryKey(tx, table, ""); err != nil {
+			return err
+		}
+	}
+	return alterV4EventTimeIndex(tx, "")
+}
+
+// alterV4PrimaryKey replaces the primary key on the id column. The constraint
+// is dropped and added within the same statement, ALTER PRIMARY KEY would keep
+// the previous key as a secondary unique index
+func alterV4PrimaryKey(tx *gorm.DB, table, sharding string) error {
+	constraint, err := queryString(tx, v4PrimaryKeyQuery, table)
+	if err != nil {
+		return fmt.Errorf("unable to get the primary key for table %q: %w", table, err)
+	}
+	return tx.Exec(fmt.Sprintf(`ALTER TABLE %s DROP CONSTRAINT %s, ADD CONSTRAINT %s PRIMARY KEY (id) %s`,
+		table, quoteIdentifier(constraint), quoteIdentifier(constraint), sharding)).Error
+}
+
+func alterV4EventTimeIndex(tx *gorm.DB, sharding string) error {
+	if err := tx.Exec(`DROP INDEX metadata_audit_logs@idx_audit_log_event_time`).Error; err != nil {
+		return err
+	}
+	return tx.Exec(fmt.Sprintf(`CREATE INDEX idx_audit_log_event_time ON metadata_audit_logs (event_time) %s`,
+		sharding)).Error
+}
+
+func getV4Migration() *gormigrate.Migration {
+	return &gormigrate.Migration{
+		ID: migrationV4ID,
+		Migrate: func(tx *gorm.DB) error {
+			return v4Up(tx)
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return v4Down(tx)
+		},
+	}
+}
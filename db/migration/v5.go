@@ -0,0 +1,77 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package migration
+
+import (
+	"github.com/go-gormigrate/gormigrate/v2"
+	"gorm.io/gorm"
+)
+
+const (
+	migrationV5ID = "5"
+	// the existing folders with subfolders and without files are the
+	// ancestors created to link the hierarchy
+	v5PostgreSQLBackfillQuery = `UPDATE metadata_folders SET implicit = true
+ WHERE NOT EXISTS (SELECT id FROM metadata_files WHERE metadata_files.folder_id = metadata_folders.id)
+ AND EXISTS (SELECT id FROM metadata_folders children WHERE children.parent_id = metadata_folders.id)`
+	// MySQL does not allow to reference the updated table within a subquery,
+	// the distinct derived table is materialized
+	v5MySQLBackfillQuery = `UPDATE metadata_folders INNER JOIN
+ (SELECT DISTINCT parent_id FROM metadata_folders WHERE parent_id IS NOT NULL) children
+ ON children.parent_id = metadata_folders.id SET metadata_folders.implicit = true
+ WHERE NOT EXISTS (SELECT id FROM metadata_files WHERE metadata_files.folder_id = metadata_folders.id)`
+)
+
+type folderV5 struct {
+	ID        int64  `gorm:"primarykey"`
+	Path      string `gorm:"type:text;not null;index:idx_folder_path;index:idx_unique_folder_path_storage_id,unique"`
+	StorageID string `gorm:"size:512;not null;index:idx_folder_storage_id;index:idx_unique_folder_path_storage_id,unique"`
+	ParentID  *int64 `gorm:"size:64;index:idx_folder_parent_id"`
+	Name      string `gorm:"type:text"`
+	Implicit  bool   `gorm:"not null;default:false"`
+}
+
+func (*folderV5) TableName() string {
+	return "metadata_folders"
+}
+
+// v5Up flags the ancestors created to link the hierarchy, they are not listed
+// until a file is added
+func v5Up(tx *gorm.DB) error {
+	if err := tx.Migrator().AddColumn(&folderV5{}, "Implicit"); err != nil {
+		return err
+	}
+	query := v5PostgreSQLBackfillQuery
+	if tx.Dialector.Name() == "mysql" {
+		query = v5MySQLBackfillQuery
+	}
+	return tx.Exec(query).Error
+}
+
+func v5Down(tx *gorm.DB) error {
+	return tx.Migrator().DropColumn(&folderV5{}, "implicit")
+}
+
+func getV5Migration() *gormigrate.Migration {
+	return &gormigrate.Migration{
+		ID: migrationV5ID,
+		Migrate: func(tx *gorm.DB) error {
+			return v5Up(tx)
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return v5Down(tx)
+		},
+	}
+}
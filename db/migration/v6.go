@@ -0,0 +1,55 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package migration
+
+import (
+	"github.com/go-gormigrate/gormigrate/v2"
+	"gorm.io/gorm"
+)
+
+const (
+	migrationV6ID = "6"
+)
+
+type auditLogV6 struct {
+	ID      int64  `gorm:"primarykey"`
+	Details string `gorm:"type:text"`
+}
+
+func (*auditLogV6) TableName() string {
+	return "metadata_audit_logs"
+}
+
+// v6Up adds the details recorded for the bulk operations, such as the affected
+// counts
+func v6Up(tx *gorm.DB) error {
+	return tx.Migrator().AddColumn(&auditLogV6{}, "Details")
+}
+
+func v6Down(tx *gorm.DB) error {
+	return tx.Migrator().DropColumn(&auditLogV6{}, "details")
+}
+
+func getV6Migration() *gormigrate.Migration {
+	return &gormigrate.Migration{
+		ID: migrationV6ID,
+		Migrate: func(tx *gorm.DB) error {
+			return v6Up(tx)
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return v6Down(tx)
+		},
+	}
+}
@@ -0,0 +1,323 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+	"gorm.io/gorm"
+
+	"github.com/sftpgo/sftpgo-plugin-metadata/logger"
+)
+
+// Path normalization options
+const (
+	NormalizeLeadingSlash = "leading_slash"
+	NormalizeClean        = "clean"
+	NormalizeNFC          = "nfc"
+	NormalizeCaseFold     = "case_fold"
+)
+
+const (
+	normalizeBatchSize = 1000
+)
+
+var (
+	// errDryRun is used to roll back the dry run transaction
+	errDryRun = errors.New("dry run")
+)
+
+// NormalizationPolicy defines how the paths are normalized before they are
+// stored or looked up, so equivalent paths refer to the same metadata
+type NormalizationPolicy struct {
+	// LeadingSlash adds a leading slash to relative paths
+	LeadingSlash bool
+	// Clean removes duplicate and trailing slashes and resolves dot elements
+	Clean bool
+	// NFC converts the paths to the Unicode normalization form C
+	NFC bool
+	// CaseFold makes the paths case insensitive
+	CaseFold bool
+}
+
+// ParseNormalizationPolicy parses a comma separated list of normalization
+// options. An empty string means no normalization
+func ParseNormalizationPolicy(value string) (NormalizationPolicy, error) {
+	var policy NormalizationPolicy
+	for _, option := range strings.Split(value, ",") {
+		switch strings.TrimSpace(option) {
+		case "":
+		case NormalizeLeadingSlash:
+			policy.LeadingSlash = true
+		case NormalizeClean:
+			policy.Clean = true
+		case NormalizeNFC:
+			policy.NFC = true
+		case NormalizeCaseFold:
+			policy.CaseFold = true
+		default:
+			return policy, fmt.Errorf("unsupported path normalization option %q, supported options: %v", option,
+				[]string{NormalizeLeadingSlash, NormalizeClean, NormalizeNFC, NormalizeCaseFold})
+		}
+	}
+	return policy, nil
+}
+
+// IsEnabled returns true if any normalization option is enabled
+func (p NormalizationPolicy) IsEnabled() bool {
+	return p.LeadingSlash || p.Clean || p.NFC || p.CaseFold
+}
+
+func (p NormalizationPolicy) String() string {
+	var options []string
+	if p.LeadingSlash {
+		options = append(options, NormalizeLeadingSlash)
+	}
+	if p.Clean {
+		options = append(options, NormalizeClean)
+	}
+	if p.NFC {
+		options = append(options, NormalizeNFC)
+	}
+	if p.CaseFold {
+		options = append(options, NormalizeCaseFold)
+	}
+	return strings.Join(options, ",")
+}
+
+// Path returns the normalized version of the specified path
+func (p NormalizationPolicy) Path(name string) string {
+	name = p.text(name)
+	if p.LeadingSlash && !strings.HasPrefix(name, "/") {
+		name = "/" + name
+	}
+	if p.Clean && name != "" {
+		name = path.Clean(name)
+	}
+	return name
+}
+
+// text applies the Unicode normalization options
+func (p NormalizationPolicy) text(s string) string {
+	if p.NFC {
+		s = norm.NFC.String(s)
+	}
+	if p.CaseFold {
+		s = cases.Fold().String(s)
+	}
+	return s
+}
+
+// NormalizationResult defines the changes applied to the stored metadata
+type NormalizationResult struct {
+	// Files is the number of files moved or renamed
+	Files int64
+	// MergedFiles is the number of files merged into an existing file, the
+	// newest modification time is kept
+	MergedFiles int64
+	// Folders is the number of removed folders, their files were moved
+	Folders int64
+}
+
+// NormalizeStoredPaths applies the specified policy to the stored folder
+// paths and file names, for the specified storage ID or for all the storages
+// if empty. Files whose normalized paths are the same are merged keeping the
+// newest modification time. If dryRun is true the changes are computed
+// within a transaction that is then rolled back
+func (s *SQLStore) NormalizeStoredPaths(policy NormalizationPolicy, storageID string, dryRun bool) (NormalizationResult, error) {
+	var result NormalizationResult
+	if !policy.IsEnabled() {
+		return result, errors.New("no path normalization option enabled")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), maintenanceQueryTimeout)
+	defer cancel()
+
+	if !dryRun {
+		// the folders are renamed and merged
+		defer s.invalidateFolderIDs()
+	}
+	for _, handle := range s.getHandles(storageID) {
+		sess := handle.WithContext(ctx)
+		if !dryRun {
+			if err := normalizeFolders(sess, policy, storageID, true, &result); err != nil {
+				s.auditNormalization(policy, storageID, result, err)
+				return result, err
+			}
+			continue
+		}
+		err := sess.Transaction(func(tx *gorm.DB) error {
+			if err := normalizeFolders(tx, policy, storageID, false, &result); err != nil {
+				return err
+			}
+			return errDryRun
+		})
+		if !errors.Is(err, errDryRun) {
+			return result, err
+		}
+	}
+	if !dryRun {
+		s.auditNormalization(policy, storageID, result, nil)
+	}
+	return result, nil
+}
+
+// auditNormalization records an applied normalization. An interrupted one is
+// recorded only if some paths were changed
+func (s *SQLStore) auditNormalization(policy NormalizationPolicy, storageID string, result NormalizationResult,
+	err error,
+) {
+	if err != nil && result.Files == 0 && result.MergedFiles == 0 && result.Folders == 0 {
+		return
+	}
+	s.auditBulkOperation(AuditOperationNormalize, storageID, "", map[string]any{
+		"policy":       policy.String(),
+		"files":        result.Files,
+		"merged_files": result.MergedFiles,
+		"folders":      result.Folders,
+		"completed":    err == nil,
+	})
+}
+
+// normalizeFolders normalizes the folders in batches, each folder within its
+// own transaction if folderTx is true
+func normalizeFolders(sess *gorm.DB, policy NormalizationPolicy, storageID string, folderTx bool,
+	result *NormalizationResult,
+) error {
+	var lastID int64
+	for {
+		var folders []Folder
+		query := sess.Where("id > ?", lastID)
+		if storageID != "" {
+			query = query.Where("storage_id = ?", storageID)
+		}
+		if err := query.Order("id ASC").Limit(normalizeBatchSize).Find(&folders).Error; err != nil {
+			return err
+		}
+		for idx := range folders {
+			// a failed folder is retried on the next run, so there is no need
+			// for a single transaction
+			var err error
+			if folderTx {
+				err = sess.Transaction(func(tx *gorm.DB) error {
+					return normalizeFolder(tx, policy, &folders[idx], result)
+				})
+			} else {
+				err = normalizeFolder(sess, policy, &folders[idx], result)
+			}
+			if err != nil {
+				return fmt.Errorf("unable to normalize folder %q, storage ID %q: %w", folders[idx].Path,
+					folders[idx].StorageID, err)
+			}
+		}
+		if len(folders) < normalizeBatchSize {
+			return nil
+		}
+		lastID = folders[len(folders)-1].ID
+	}
+}
+
+func normalizeFolder(tx *gorm.DB, policy NormalizationPolicy, folder *Folder, result *NormalizationResult) error {
+	folderIDs := make(map[string]int64)
+	var lastID int64
+	for {
+		var files []File
+		err := tx.Where("folder_id = ? AND id > ?", folder.ID, lastID).Order("id ASC").Limit(normalizeBatchSize).
+			Find(&files).Error
+		if err != nil {
+			return err
+		}
+		for idx := range files {
+			if err := normalizeFile(tx, policy, folder, &files[idx], folderIDs, result); err != nil {
+				return err
+			}
+		}
+		if len(files) < normalizeBatchSize {
+			break
+		}
+		lastID = files[len(files)-1].ID
+	}
+	if policy.Path(folder.Path) == folder.Path {
+		return nil
+	}
+	var remaining int64
+	if err := tx.Model(&File{}).Where("folder_id = ?", folder.ID).Count(&remaining).Error; err != nil {
+		return err
+	}
+	if remaining > 0 {
+		return nil
+	}
+	err := tx.Where("id = ?", folder.ID).Delete(&Folder{}).Error
+	if err == nil {
+		result.Folders++
+		logger.AppLogger.Debug("folder normalized", "storage_id", folder.StorageID, "path", folder.Path)
+	}
+	return err
+}
+
+func normalizeFile(tx *gorm.DB, policy NormalizationPolicy, folder *Folder, file *File, folderIDs map[string]int64,
+	result *NormalizationResult,
+) error {
+	objectPath := policy.Path(joinStoredPath(folder.Path, file.Name))
+	folderPath, name := path.Dir(objectPath), path.Base(objectPath)
+	if folderPath == folder.Path && name == file.Name {
+		return nil
+	}
+	folderID := folder.ID
+	if folderPath != folder.Path {
+		var ok bool
+		folderID, ok = folderIDs[folderPath]
+		if !ok {
+			var err error
+			folderID, err = getOrCreateFolder(tx, folder.StorageID, folderPath, false)
+			if err != nil {
+				return err
+			}
+			folderIDs[folderPath] = folderID
+		}
+	}
+	var existing []File
+	err := tx.Where("name = ? AND folder_id = ? AND id <> ?", name, folderID, file.ID).Limit(1).Find(&existing).Error
+	if err != nil {
+		return err
+	}
+	if len(existing) == 0 {
+		result.Files++
+		return tx.Model(&File{}).Where("id = ?", file.ID).
+			Updates(map[string]any{"name": name, "folder_id": folderID}).Error
+	}
+	if file.LastModified > existing[0].LastModified {
+		err = tx.Model(&File{}).Where("id = ?", existing[0].ID).Update("last_modified", file.LastModified).Error
+		if err != nil {
+			return err
+		}
+	}
+	result.MergedFiles++
+	return tx.Where("id = ?", file.ID).Delete(&File{}).Error
+}
+
+// joinStoredPath returns the object path for a stored folder path and file
+// name without any normalization
+func joinStoredPath(folderPath, name string) string {
+	if strings.HasSuffix(folderPath, "/") {
+		return folderPath + name
+	}
+	return folderPath + "/" + name
+}
@@ -0,0 +1,118 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalizationPolicy(t *testing.T) {
+	_, err := ParseNormalizationPolicy("clean,unknown")
+	assert.Error(t, err)
+	policy, err := ParseNormalizationPolicy("")
+	require.NoError(t, err)
+	assert.False(t, policy.IsEnabled())
+	assert.Equal(t, "a//b/", policy.Path("a//b/"))
+
+	policy, err = ParseNormalizationPolicy("leading_slash, clean,nfc")
+	require.NoError(t, err)
+	assert.True(t, policy.IsEnabled())
+	assert.Equal(t, "leading_slash,clean,nfc", policy.String())
+	assert.Equal(t, "/a/b", policy.Path("a/b"))
+	assert.Equal(t, "/a/b", policy.Path("/a//b/"))
+	assert.Equal(t, "/a/b", policy.Path("/a/./c/../b"))
+	assert.Equal(t, "/", policy.Path(""))
+	// NFD to NFC
+	assert.Equal(t, "/café", policy.Path("/café"))
+	assert.Equal(t, "/Café", policy.Path("/Café"))
+
+	policy.CaseFold = true
+	assert.Equal(t, "/caf\u00e9/strasse", policy.Path("/CAFE\u0301/Straße"))
+}
+
+func TestNormalizeStoredPaths(t *testing.T) {
+	m := testMetadater
+	storageID := "s3://normalize-bucket"
+	mTime := getTimeAsMsSinceEpoch(time.Now())
+	// the same files stored using different paths
+	err := m.SetModificationTime(storageID, "norm/dir/file.txt", mTime)
+	assert.NoError(t, err)
+	err = m.SetModificationTime(storageID, "/norm/dir/file.txt", mTime+100)
+	assert.NoError(t, err)
+	err = m.SetModificationTime(storageID, "/norm/dir/cafe\u0301.txt", mTime)
+	assert.NoError(t, err)
+	err = m.SetModificationTime(storageID, "/norm/cafe\u0301/file.txt", mTime+10)
+	assert.NoError(t, err)
+	err = m.SetModificationTime(storageID, "/norm/caf\u00e9/file.txt", mTime)
+	assert.NoError(t, err)
+	err = m.SetModificationTime("s3://other-normalize-bucket", "norm/dir/file.txt", mTime)
+	assert.NoError(t, err)
+
+	policy, err := ParseNormalizationPolicy("leading_slash,clean,nfc")
+	require.NoError(t, err)
+	_, err = testStore.NormalizeStoredPaths(NormalizationPolicy{}, storageID, false)
+	assert.Error(t, err)
+
+	result, err := testStore.NormalizeStoredPaths(policy, storageID, false)
+	require.NoError(t, err)
+	assert.Equal(t, NormalizationResult{Files: 1, MergedFiles: 2, Folders: 3}, result)
+	result, err = testStore.NormalizeStoredPaths(policy, storageID, false)
+	require.NoError(t, err)
+	assert.Equal(t, NormalizationResult{}, result)
+
+	times, err := m.GetModificationTimes(storageID, "/norm/dir")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int64{"file.txt": mTime + 100, "caf\u00e9.txt": mTime}, times)
+	times, err = m.GetModificationTimes(storageID, "/norm/caf\u00e9")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int64{"file.txt": mTime + 10}, times)
+	_, err = m.GetModificationTime(storageID, "norm/dir/file.txt")
+	checkNotFoundError(t, err)
+	_, err = m.GetModificationTime("s3://other-normalize-bucket", "norm/dir/file.txt")
+	assert.NoError(t, err)
+
+	// nothing is changed in dry run mode
+	result, err = testStore.NormalizeStoredPaths(policy, "s3://other-normalize-bucket", true)
+	require.NoError(t, err)
+	assert.Equal(t, NormalizationResult{Files: 1, Folders: 2}, result)
+	_, err = m.GetModificationTime("s3://other-normalize-bucket", "norm/dir/file.txt")
+	assert.NoError(t, err)
+
+	// with the policy enabled equivalent paths refer to the same file
+	m = NewMetadater(testStore, MetadaterConfig{PathPolicy: policy})
+	for _, p := range []string{"norm/dir/file.txt", "/norm/dir/./file.txt", "/norm/dir/file.txt"} {
+		got, err := m.GetModificationTime(storageID, p)
+		assert.NoError(t, err)
+		assert.Equal(t, mTime+100, got)
+	}
+	got, err := m.GetModificationTime(storageID, "/norm/dir/cafe\u0301.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, mTime, got)
+	times, err = m.GetModificationTimes(storageID, "norm/dir/")
+	require.NoError(t, err)
+	assert.Len(t, times, 2)
+	folders, err := m.GetFolders(storageID, 0, "norm/café/")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/norm/dir"}, folders)
+
+	_, err = testStore.RemoveStorage(storageID)
+	assert.NoError(t, err)
+	_, err = testStore.RemoveStorage("s3://other-normalize-bucket")
+	assert.NoError(t, err)
+}
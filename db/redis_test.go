@@ -0,0 +1,241 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedisCacheConfig(t *testing.T) {
+	server := miniredis.RunT(t)
+	server.RequireAuth("secret")
+	cache, err := NewRedisCache(RedisCacheConfig{URL: fmt.Sprintf("redis://:secret@%s/2", server.Addr())})
+	require.NoError(t, err)
+	cache.SetFolderID(context.Background(), "s1", "/d1", 1)
+	require.NoError(t, cache.Close())
+	server.Select(2)
+	assert.True(t, server.Exists(defaultRedisCachePrefix+"folder:s1\x00/d1"))
+
+	for _, redisURL := range []string{"http://localhost", "redis://localhost/db", "%%",
+		fmt.Sprintf("redis://:wrong@%s", server.Addr())} {
+		_, err = NewRedisCache(RedisCacheConfig{URL: redisURL, Timeout: 200 * time.Millisecond})
+		assert.Error(t, err, redisURL)
+	}
+}
+
+func TestRedisCache(t *testing.T) {
+	server := miniredis.RunT(t)
+	redisURL := "redis://" + server.Addr()
+	cache, err := NewRedisCache(RedisCacheConfig{URL: redisURL, TTL: 200 * time.Millisecond})
+	require.NoError(t, err)
+	defer cache.Close()
+
+	ctx := context.Background()
+	setCachedFolder := func(storageID, folderPath string, files map[string]int64) {
+		_, version, _ := cache.GetModificationTimes(ctx, storageID, folderPath)
+		cache.SetModificationTimes(ctx, storageID, folderPath, version, files)
+	}
+	_, _, ok := cache.GetModificationTimes(ctx, "s1", "/d1")
+	assert.False(t, ok)
+	setCachedFolder("s1", "/d1", map[string]int64{"f1": 1})
+	setCachedFolder("s1", "/d2", map[string]int64{})
+	setCachedFolder("s2", "/d1", map[string]int64{"f1": 2})
+	files, _, ok := cache.GetModificationTimes(ctx, "s1", "/d1")
+	assert.True(t, ok)
+	assert.Equal(t, map[string]int64{"f1": 1}, files)
+	files, _, ok = cache.GetModificationTimes(ctx, "s1", "/d2")
+	assert.True(t, ok)
+	assert.NotNil(t, files)
+	assert.Empty(t, files)
+
+	cache.Invalidate(ctx, "s1", "/d1")
+	_, _, ok = cache.GetModificationTimes(ctx, "s1", "/d1")
+	assert.False(t, ok)
+	_, _, ok = cache.GetModificationTimes(ctx, "s1", "/d2")
+	assert.True(t, ok)
+	cache.Invalidate(ctx, "s1", "")
+	_, _, ok = cache.GetModificationTimes(ctx, "s1", "/d2")
+	assert.False(t, ok)
+	_, _, ok = cache.GetModificationTimes(ctx, "s2", "/d1")
+	assert.True(t, ok)
+	cache.Invalidate(ctx, "", "")
+	_, _, ok = cache.GetModificationTimes(ctx, "s2", "/d1")
+	assert.False(t, ok)
+	// cached again after the invalidation
+	setCachedFolder("s2", "/d1", map[string]int64{"f1": 3})
+	files, _, ok = cache.GetModificationTimes(ctx, "s2", "/d1")
+	assert.True(t, ok)
+	assert.Equal(t, map[string]int64{"f1": 3}, files)
+
+	_, ok = cache.GetFolderID(ctx, "s1", "/d1")
+	assert.False(t, ok)
+	cache.SetFolderID(ctx, "s1", "/d1", 10)
+	folderID, ok := cache.GetFolderID(ctx, "s1", "/d1")
+	assert.True(t, ok)
+	assert.Equal(t, int64(10), folderID)
+	cache.InvalidateFolderIDs(ctx)
+	_, ok = cache.GetFolderID(ctx, "s1", "/d1")
+	assert.False(t, ok)
+
+	// the cached data expire
+	cache.SetFolderID(ctx, "s1", "/d1", 11)
+	server.FastForward(300 * time.Millisecond)
+	_, _, ok = cache.GetModificationTimes(ctx, "s2", "/d1")
+	assert.False(t, ok)
+	_, ok = cache.GetFolderID(ctx, "s1", "/d1")
+	assert.False(t, ok)
+
+	acquired, err := cache.TryLock(ctx, "cleanup", 200*time.Millisecond)
+	assert.NoError(t, err)
+	assert.True(t, acquired)
+	acquired, err = cache.TryLock(ctx, "cleanup", 200*time.Millisecond)
+	assert.NoError(t, err)
+	assert.False(t, acquired)
+	acquired, err = cache.TryLock(ctx, "other", 200*time.Millisecond)
+	assert.NoError(t, err)
+	assert.True(t, acquired)
+	server.FastForward(300 * time.Millisecond)
+	acquired, err = cache.TryLock(ctx, "cleanup", 200*time.Millisecond)
+	assert.NoError(t, err)
+	assert.True(t, acquired)
+
+	// cache failures are misses
+	server.Close()
+	_, _, ok = cache.GetModificationTimes(ctx, "s1", "/d1")
+	assert.False(t, ok)
+	setCachedFolder("s1", "/d1", map[string]int64{"f1": 1})
+	_, err = cache.TryLock(ctx, "cleanup", time.Second)
+	assert.Error(t, err)
+	_, err = NewRedisCache(RedisCacheConfig{URL: redisURL})
+	assert.Error(t, err)
+}
+
+func TestRedisCacheStaleListing(t *testing.T) {
+	server := miniredis.RunT(t)
+	cache, err := NewRedisCache(RedisCacheConfig{URL: "redis://" + server.Addr()})
+	require.NoError(t, err)
+	defer cache.Close()
+
+	ctx := context.Background()
+	for _, storageID := range []string{"s1", ""} {
+		// a listing read from the store before an invalidation is not cached
+		_, version, ok := cache.GetModificationTimes(ctx, "s1", "/d1")
+		assert.False(t, ok)
+		assert.NotEmpty(t, version)
+		folderPath := "/d1"
+		if storageID == "" {
+			folderPath = ""
+		}
+		cache.Invalidate(ctx, storageID, folderPath)
+		cache.SetModificationTimes(ctx, "s1", "/d1", version, map[string]int64{"f1": 1})
+		_, newVersion, ok := cache.GetModificationTimes(ctx, "s1", "/d1")
+		assert.False(t, ok)
+		assert.NotEqual(t, version, newVersion)
+		// the listing read after the invalidation is cached
+		cache.SetModificationTimes(ctx, "s1", "/d1", newVersion, map[string]int64{"f1": 2})
+		files, _, ok := cache.GetModificationTimes(ctx, "s1", "/d1")
+		assert.True(t, ok)
+		assert.Equal(t, map[string]int64{"f1": 2}, files)
+		cache.Invalidate(ctx, "s1", "/d1")
+	}
+	// the folder version expires with the cached data and it does not match
+	// the older values
+	_, version, _ := cache.GetModificationTimes(ctx, "s1", "/d1")
+	server.FastForward(defaultRedisCacheTTL)
+	cache.SetModificationTimes(ctx, "s1", "/d1", version, map[string]int64{"f1": 3})
+	_, _, ok := cache.GetModificationTimes(ctx, "s1", "/d1")
+	assert.False(t, ok)
+	// no version, the lookup failed
+	cache.SetModificationTimes(ctx, "s1", "/d2", "", map[string]int64{"f1": 1})
+	_, _, ok = cache.GetModificationTimes(ctx, "s1", "/d2")
+	assert.False(t, ok)
+}
+
+func TestRedisCacheMetadater(t *testing.T) {
+	server := miniredis.RunT(t)
+	cache, err := NewRedisCache(RedisCacheConfig{URL: "redis://" + server.Addr()})
+	require.NoError(t, err)
+	defer cache.Close()
+
+	// two plugin processes sharing the cache
+	store := newFakeStore()
+	m1 := NewMetadater(store, MetadaterConfig{Cache: cache})
+	m2 := NewMetadater(store, MetadaterConfig{Cache: cache})
+
+	require.NoError(t, m1.SetModificationTime("s1", "/d1/f1", 1))
+	files, err := m1.GetModificationTimes("s1", "/d1")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int64{"f1": 1}, files)
+	reads := store.reads
+	files, err = m2.GetModificationTimes("s1", "/d1")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int64{"f1": 1}, files)
+	assert.Equal(t, reads, store.reads)
+
+	require.NoError(t, m2.SetModificationTime("s1", "/d1/f2", 2))
+	files, err = m1.GetModificationTimes("s1", "/d1")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int64{"f1": 1, "f2": 2}, files)
+	require.NoError(t, m1.RemoveMetadata("s1", "/d1/f1"))
+	files, err = m2.GetModificationTimes("s1", "/d1")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int64{"f2": 2}, files)
+}
+
+func TestSQLStoreFolderIDCache(t *testing.T) {
+	server := miniredis.RunT(t)
+	cache, err := NewRedisCache(RedisCacheConfig{URL: "redis://" + server.Addr()})
+	require.NoError(t, err)
+	defer cache.Close()
+
+	ctx := context.Background()
+	storageID := t.Name()
+	testStore.folderIDs = cache
+	defer func() {
+		testStore.folderIDs = nil
+	}()
+
+	require.NoError(t, testStore.SetModificationTime(ctx, storageID, "/d1/f1", 1))
+	folderID, ok := cache.GetFolderID(ctx, storageID, "/d1")
+	require.True(t, ok)
+	require.NoError(t, testStore.SetModificationTime(ctx, storageID, "/d1/f2", 2))
+	files, err := testStore.GetModificationTimes(ctx, storageID, "/d1")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int64{"f1": 1, "f2": 2}, files)
+
+	// a stale cached ID is replaced
+	_, err = testStore.RemoveStorage(storageID)
+	require.NoError(t, err)
+	cache.SetFolderID(ctx, storageID, "/d1", folderID)
+	require.NoError(t, testStore.SetModificationTime(ctx, storageID, "/d1/f1", 3))
+	files, err = testStore.GetModificationTimes(ctx, storageID, "/d1")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int64{"f1": 3}, files)
+	newFolderID, ok := cache.GetFolderID(ctx, storageID, "/d1")
+	assert.True(t, ok)
+	assert.NotEqual(t, folderID, newFolderID)
+
+	// the cleanup invalidates the cached IDs
+	require.NoError(t, testStore.Cleanup(ctx))
+	_, ok = cache.GetFolderID(ctx, storageID, "/d1")
+	assert.False(t, ok)
+}
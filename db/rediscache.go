@@ -0,0 +1,307 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/sftpgo/sftpgo-plugin-metadata/logger"
+)
+
+const (
+	defaultRedisCacheTTL     = 5 * time.Minute
+	defaultRedisCachePrefix  = "sftpgo-metadata:"
+	defaultRedisCacheTimeout = 2 * time.Second
+)
+
+// RedisCacheConfig defines the configuration for a RedisCache
+type RedisCacheConfig struct {
+	// URL is the server URL, in the form
+	// redis://[[username]:password@]host[:port][/database], use rediss:// for
+	// TLS
+	URL string
+	// TTL is the expiration for the cached data, default 5 minutes
+	TTL time.Duration
+	// KeyPrefix is prepended to all the keys, so a server can be shared
+	KeyPrefix string
+	// Timeout is the timeout for a single command, default 2 seconds
+	Timeout time.Duration
+}
+
+// RedisCache is a cache shared by multiple plugin processes and stored on a
+// server speaking the Redis protocol. It implements Cache, for the
+// modification times of the files within a folder, FolderIDCache, for the
+// SQL folder IDs, and Locker, to coordinate the cleanup. The cached data
+// expire after the configured TTL, the whole cache for a storage is
+// invalidated using a generation counter, so no key scan is needed
+type RedisCache struct {
+	client  *redis.Client
+	timeout time.Duration
+	ttl     time.Duration
+	prefix  string
+	// owner identifies this cache as the holder of the acquired locks
+	owner string
+}
+
+// redisSetIfGenerationScript sets KEYS[1] to ARGV[2], expiring after ARGV[3]
+// milliseconds, if the generation read from the other keys is ARGV[1]. A
+// missing counter is generation 0, as for getGeneration
+var redisSetIfGenerationScript = redis.NewScript(`
+local values = redis.call('MGET', KEYS[2], KEYS[3], KEYS[4])
+for i = 1, #values do
+	if not values[i] or values[i] == '' then
+		values[i] = '0'
+	end
+end
+if table.concat(values, ':') ~= ARGV[1] then
+	return 0
+end
+redis.call('SET', KEYS[1], ARGV[2], 'PX', ARGV[3])
+return 1
+`)
+
+// redisCachedFiles is the cached value for the files within a folder
+type redisCachedFiles struct {
+	// Generation is the generation of the cache, for all the storages, for
+	// the folder storage and for the folder, read before the store query
+	Generation string           `json:"g"`
+	Files      map[string]int64 `json:"f"`
+}
+
+// NewRedisCache returns a RedisCache for the specified configuration, the
+// server must be reachable
+func NewRedisCache(config RedisCacheConfig) (*RedisCache, error) {
+	options, err := redis.ParseURL(config.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redis url: %w", err)
+	}
+	c := &RedisCache{
+		timeout: config.Timeout,
+		ttl:     config.TTL,
+		prefix:  config.KeyPrefix,
+		owner:   getNodeName() + "/" + newChangeOrigin(),
+	}
+	if c.timeout <= 0 {
+		c.timeout = defaultRedisCacheTimeout
+	}
+	options.DialTimeout = c.timeout
+	options.ReadTimeout = c.timeout
+	options.WriteTimeout = c.timeout
+	// a failed command is a cache miss, retrying would only delay the
+	// database query
+	options.MaxRetries = -1
+	c.client = redis.NewClient(options)
+	if c.ttl <= 0 {
+		c.ttl = defaultRedisCacheTTL
+	}
+	if c.prefix == "" {
+		c.prefix = defaultRedisCachePrefix
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+
+	if err := c.client.Ping(ctx).Err(); err != nil {
+		c.client.Close()
+		return nil, fmt.Errorf("unable to connect to redis: %w", err)
+	}
+	return c, nil
+}
+
+// Close closes the connections to the server
+func (c *RedisCache) Close() error {
+	return c.client.Close()
+}
+
+func (c *RedisCache) getGlobalGenerationKey() string {
+	return c.prefix + "gen"
+}
+
+func (c *RedisCache) getStorageGenerationKey(storageID string) string {
+	return c.prefix + "gen:" + storageID
+}
+
+func (c *RedisCache) getFilesKey(storageID, folderPath string) string {
+	return c.prefix + "files:" + storageID + "\x00" + folderPath
+}
+
+func (c *RedisCache) getFolderVersionKey(storageID, folderPath string) string {
+	return c.prefix + "ver:" + storageID + "\x00" + folderPath
+}
+
+func (c *RedisCache) getFolderIDGenerationKey() string {
+	return c.prefix + "folder-gen"
+}
+
+func (c *RedisCache) getFolderIDKey(storageID, folderPath string) string {
+	return c.prefix + "folder:" + storageID + "\x00" + folderPath
+}
+
+func (c *RedisCache) getLockKey(name string) string {
+	return c.prefix + "lock:" + name
+}
+
+// getGeneration returns the generation from the specified values, a missing
+// counter is generation 0
+func getGeneration(values ...any) string {
+	parts := make([]string, 0, len(values))
+	for _, value := range values {
+		if value, ok := value.(string); ok && value != "" {
+			parts = append(parts, value)
+		} else {
+			parts = append(parts, "0")
+		}
+	}
+	return strings.Join(parts, ":")
+}
+
+// GetModificationTimes implements Cache. The cached value and the current
+// generations, for all the storages, for the storage and for the folder, are
+// read using a single command, on a miss the generations are the version
+func (c *RedisCache) GetModificationTimes(ctx context.Context, storageID, folderPath string) (map[string]int64, string, bool) {
+	values, err := c.client.MGet(ctx, c.getFilesKey(storageID, folderPath), c.getGlobalGenerationKey(),
+		c.getStorageGenerationKey(storageID), c.getFolderVersionKey(storageID, folderPath)).Result()
+	if err != nil {
+		logRedisCacheError("get modification times", err)
+		return nil, "", false
+	}
+	generation := getGeneration(values[1:]...)
+	data, ok := values[0].(string)
+	if !ok {
+		return nil, generation, false
+	}
+	var cached redisCachedFiles
+	if err := json.Unmarshal([]byte(data), &cached); err != nil {
+		logRedisCacheError("decode modification times", err)
+		return nil, generation, false
+	}
+	if cached.Generation != generation {
+		return nil, generation, false
+	}
+	if cached.Files == nil {
+		cached.Files = make(map[string]int64)
+	}
+	return cached.Files, generation, true
+}
+
+// SetModificationTimes implements Cache. The generations are compared and the
+// value is set by a script, so an invalidation cannot happen in between
+func (c *RedisCache) SetModificationTimes(ctx context.Context, storageID, folderPath, version string,
+	files map[string]int64,
+) {
+	if version == "" {
+		return
+	}
+	data, err := json.Marshal(&redisCachedFiles{
+		Generation: version,
+		Files:      files,
+	})
+	if err != nil {
+		logRedisCacheError("encode modification times", err)
+		return
+	}
+	keys := []string{c.getFilesKey(storageID, folderPath), c.getGlobalGenerationKey(),
+		c.getStorageGenerationKey(storageID), c.getFolderVersionKey(storageID, folderPath)}
+	err = redisSetIfGenerationScript.Run(ctx, c.client, keys, version, data, c.ttl.Milliseconds()).Err()
+	if err != nil {
+		logRedisCacheError("set modification times", err)
+	}
+}
+
+// Invalidate implements Cache, a single folder is invalidated incrementing its
+// version, a storage or the whole cache incrementing their generation. The
+// folder version expires with the cached data, the cached value is deleted
+// in the same transaction, so a reset version cannot match a stale value
+func (c *RedisCache) Invalidate(ctx context.Context, storageID, folderPath string) {
+	var err error
+	switch {
+	case folderPath != "":
+		versionKey := c.getFolderVersionKey(storageID, folderPath)
+		_, err = c.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Del(ctx, c.getFilesKey(storageID, folderPath))
+			pipe.Incr(ctx, versionKey)
+			pipe.PExpire(ctx, versionKey, c.ttl)
+			return nil
+		})
+	case storageID != "":
+		err = c.client.Incr(ctx, c.getStorageGenerationKey(storageID)).Err()
+	default:
+		err = c.client.Incr(ctx, c.getGlobalGenerationKey()).Err()
+	}
+	if err != nil {
+		logRedisCacheError("invalidate", err)
+	}
+}
+
+// GetFolderID implements FolderIDCache
+func (c *RedisCache) GetFolderID(ctx context.Context, storageID, folderPath string) (int64, bool) {
+	values, err := c.client.MGet(ctx, c.getFolderIDKey(storageID, folderPath), c.getFolderIDGenerationKey()).Result()
+	if err != nil {
+		logRedisCacheError("get folder id", err)
+		return 0, false
+	}
+	data, ok := values[0].(string)
+	if !ok {
+		return 0, false
+	}
+	generation, value, ok := strings.Cut(data, "/")
+	if !ok || generation != getGeneration(values[1]) {
+		return 0, false
+	}
+	folderID, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return folderID, true
+}
+
+// SetFolderID implements FolderIDCache
+func (c *RedisCache) SetFolderID(ctx context.Context, storageID, folderPath string, folderID int64) {
+	generation, err := c.client.Get(ctx, c.getFolderIDGenerationKey()).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		logRedisCacheError("set folder id", err)
+		return
+	}
+	value := getGeneration(generation) + "/" + strconv.FormatInt(folderID, 10)
+	if err := c.client.Set(ctx, c.getFolderIDKey(storageID, folderPath), value, c.ttl).Err(); err != nil {
+		logRedisCacheError("set folder id", err)
+	}
+}
+
+// InvalidateFolderIDs implements FolderIDCache
+func (c *RedisCache) InvalidateFolderIDs(ctx context.Context) {
+	if err := c.client.Incr(ctx, c.getFolderIDGenerationKey()).Err(); err != nil {
+		logRedisCacheError("invalidate folder ids", err)
+	}
+}
+
+// TryLock implements Locker
+func (c *RedisCache) TryLock(ctx context.Context, name string, ttl time.Duration) (bool, error) {
+	return c.client.SetNX(ctx, c.getLockKey(name), c.owner, ttl).Result()
+}
+
+func logRedisCacheError(operation string, err error) {
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	logger.AppLogger.Warn("redis cache error", "operation", operation, "error", err)
+}
@@ -0,0 +1,303 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+
+	"github.com/sftpgo/sftpgo-plugin-metadata/logger"
+)
+
+var (
+	// replicaCheckInterval is the interval between replica health checks
+	replicaCheckInterval = 10 * time.Second
+	replicaCheckTimeout  = 5 * time.Second
+)
+
+// replica is a read only database, excluded while unhealthy
+type replica struct {
+	name    string
+	handle  *gorm.DB
+	healthy atomic.Bool
+}
+
+func (r *replica) setHealthy(healthy bool, err error) {
+	if r.healthy.Swap(healthy) == healthy {
+		return
+	}
+	if healthy {
+		logger.AppLogger.Info("database replica is healthy again", "replica", r.name)
+		return
+	}
+	logger.AppLogger.Warn("database replica excluded", "replica", r.name, "error", err)
+}
+
+func (r *replica) check() {
+	ctx, cancel := context.WithTimeout(context.Background(), replicaCheckTimeout)
+	defer cancel()
+
+	sqlDB, err := r.handle.DB()
+	if err == nil {
+		err = sqlDB.PingContext(ctx)
+	}
+	r.setHealthy(err == nil, err)
+}
+
+// isUnreachable returns true if the specified read error is caused by the
+// replica connection: a connection error or, for the other errors, a failed
+// ping. The query errors, such as a canceled or invalid query, are not
+func (r *replica) isUnreachable(ctx context.Context, err error) bool {
+	var netErr net.Error
+	if errors.Is(err, driver.ErrBadConn) || errors.As(err, &netErr) {
+		return true
+	}
+	sqlDB, err := r.handle.DB()
+	if err != nil {
+		return true
+	}
+	return sqlDB.PingContext(ctx) != nil && ctx.Err() == nil
+}
+
+// replicaSet defines the replicas for a primary database
+type replicaSet struct {
+	replicas []*replica
+	next     atomic.Uint32
+	done     chan struct{}
+}
+
+func (s *SQLStore) newReplicaSet(config Config) (*replicaSet, error) {
+	set := &replicaSet{
+		done: make(chan struct{}),
+	}
+	for _, dsn := range config.ReplicaDSNs {
+		replicaConfig := config
+		replicaConfig.DSN = dsn
+		replicaConfig.DSNFile = ""
+		replicaConfig.ReplicaDSNs = nil
+		replicaConfig.ChangeEvents = false
+		replicaConfig.isReplica = true
+		r := &replica{
+			name: RedactDSN(config.Driver, dsn),
+		}
+		handle, err := s.openDatabase(replicaConfig)
+		if handle == nil {
+			set.close()
+			return nil, err
+		}
+		// a replica not reachable at startup is included once it is healthy
+		r.handle = handle
+		r.healthy.Store(true)
+		r.setHealthy(err == nil, err)
+		set.replicas = append(set.replicas, r)
+	}
+	go set.checkHealth()
+	return set, nil
+}
+
+func (rs *replicaSet) checkHealth() {
+	ticker := time.NewTicker(replicaCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-rs.done:
+			return
+		case <-ticker.C:
+			rs.check()
+		}
+	}
+}
+
+func (rs *replicaSet) check() {
+	for _, r := range rs.replicas {
+		r.check()
+	}
+}
+
+// get returns a healthy replica, using round robin, or nil if there are no
+// healthy replicas
+func (rs *replicaSet) get() *replica {
+	count := uint32(len(rs.replicas))
+	start := rs.next.Add(1)
+	for i := uint32(0); i < count; i++ {
+		r := rs.replicas[(start+i)%count]
+		if r.healthy.Load() {
+			return r
+		}
+	}
+	return nil
+}
+
+func (rs *replicaSet) close() {
+	select {
+	case <-rs.done:
+	default:
+		close(rs.done)
+	}
+	for _, r := range rs.replicas {
+		if r.handle == nil {
+			continue
+		}
+		if sqlDB, err := r.handle.DB(); err == nil {
+			sqlDB.Close()
+		}
+	}
+}
+
+// initializeReplicas configures the replicas for the specified primary
+// database handle
+func (s *SQLStore) initializeReplicas(config Config, handle *gorm.DB) error {
+	if len(config.ReplicaDSNs) == 0 {
+		return nil
+	}
+	set, err := s.newReplicaSet(config)
+	if err != nil {
+		logger.AppLogger.Error("unable to initialize database replicas", "error", err)
+		return err
+	}
+	s.replicas[handle] = set
+	return nil
+}
+
+func (s *SQLStore) closeReplicas(handle *gorm.DB) {
+	if set, ok := s.replicas[handle]; ok {
+		set.close()
+		delete(s.replicas, handle)
+	}
+}
+
+// recordWrite records a write for the specified folder, or for the whole
+// storage if folderPath is empty, if there are replicas to read from
+func (s *SQLStore) recordWrite(storageID, folderPath string) {
+	if len(s.replicas) > 0 {
+		s.writes.add(storageID, folderPath)
+	}
+}
+
+// writeTracker records the folders recently written, the reads for these
+// folders use the primary database until the read after write window expires
+type writeTracker struct {
+	mu        sync.Mutex
+	window    time.Duration
+	writes    map[string]time.Time
+	lastSweep time.Time
+}
+
+func newWriteTracker(window time.Duration) *writeTracker {
+	return &writeTracker{
+		window: window,
+		writes: make(map[string]time.Time),
+	}
+}
+
+func getWriteKey(storageID, folderPath string) string {
+	return storageID + "\x00" + folderPath
+}
+
+// add records a write for the specified folder and so for its storage
+func (t *writeTracker) add(storageID, folderPath string) {
+	if t.window <= 0 {
+		return
+	}
+	now := time.Now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.writes[getWriteKey(storageID, "")] = now
+	if folderPath != "" {
+		t.writes[getWriteKey(storageID, folderPath)] = now
+	}
+	if now.Sub(t.lastSweep) > t.window {
+		for key, writeTime := range t.writes {
+			if now.Sub(writeTime) > t.window {
+				delete(t.writes, key)
+			}
+		}
+		t.lastSweep = now
+	}
+}
+
+// isRecent returns true if any of the specified folders, or the storage if
+// no folder is specified, was written within the window
+func (t *writeTracker) isRecent(storageID string, folders []string) bool {
+	if t.window <= 0 {
+		return false
+	}
+	keys := []string{getWriteKey(storageID, "")}
+	if len(folders) > 0 {
+		keys = keys[:0]
+		for _, folderPath := range folders {
+			keys = append(keys, getWriteKey(storageID, folderPath))
+		}
+	}
+	now := time.Now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, key := range keys {
+		if writeTime, ok := t.writes[key]; ok && now.Sub(writeTime) <= t.window {
+			return true
+		}
+	}
+	return false
+}
+
+// getReadHandle returns the database handle to use for reading the specified
+// folders, or the whole storage if no folder is specified, from the specified
+// primary database. A healthy replica is returned, if any, unless the folders
+// were recently written
+func (s *SQLStore) getReadHandle(primary *gorm.DB, storageID string, folders []string) (*gorm.DB, *replica) {
+	set, ok := s.replicas[primary]
+	if !ok || s.writes.isRecent(storageID, folders) {
+		return primary, nil
+	}
+	if r := set.get(); r != nil {
+		return r.handle, r
+	}
+	return primary, nil
+}
+
+// executeRead runs fn using a session for the replica, if any, selected for
+// the specified folders of the primary database. If the replica is
+// unreachable, it is excluded until the next successful health check and fn
+// is executed again on the primary database. The other errors are returned
+func (s *SQLStore) executeRead(ctx context.Context, primary *gorm.DB, storageID string, folders []string,
+	fn func(sess *gorm.DB) error,
+) error {
+	handle, r := s.getReadHandle(primary, storageID, folders)
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Bool("metadata.replica", r != nil))
+
+	err := fn(handle.WithContext(ctx))
+	if err == nil || r == nil || errors.Is(err, gorm.ErrRecordNotFound) || ctx.Err() != nil {
+		return err
+	}
+	if !r.isUnreachable(ctx, err) {
+		return err
+	}
+	r.setHealthy(false, err)
+	return fn(primary.WithContext(ctx))
+}
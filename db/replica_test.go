@@ -0,0 +1,169 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+func TestReadReplicas(t *testing.T) {
+	driver := os.Getenv("SFTPGO_PLUGIN_METADATA_DRIVER")
+	// the primary database is used as healthy replica
+	healthyDSN := os.Getenv("SFTPGO_PLUGIN_METADATA_DSN")
+	unreachableDSN := "root:@tcp(127.0.0.1:1)/sftpgo_metadata"
+	if driver == driverNamePostgreSQL || driver == driverNameCockroachDB {
+		unreachableDSN = "postgres://postgres@127.0.0.1:1/sftpgo_metadata?connect_timeout=1"
+	}
+	config := Config{Driver: driver, ReplicaDSNs: []string{healthyDSN, unreachableDSN}}
+	err := testStore.initializeReplicas(config, testStore.handle)
+	require.NoError(t, err)
+	testStore.writes = newWriteTracker(300 * time.Millisecond)
+	defer func() {
+		testStore.closeReplicas(testStore.handle)
+		testStore.writes = newWriteTracker(0)
+	}()
+
+	set := testStore.replicas[testStore.handle]
+	require.Len(t, set.replicas, 2)
+	healthy, unreachable := set.replicas[0], set.replicas[1]
+	assert.True(t, healthy.healthy.Load())
+	assert.False(t, unreachable.healthy.Load())
+	// unhealthy replicas are excluded
+	for i := 0; i < 4; i++ {
+		handle, r := testStore.getReadHandle(testStore.handle, "s3://replica-bucket", []string{"/replica/dir"})
+		assert.Equal(t, healthy, r)
+		assert.Equal(t, healthy.handle, handle)
+	}
+
+	m := testMetadater
+	storageID := "s3://replica-bucket"
+	mTime := getTimeAsMsSinceEpoch(time.Now())
+	err = m.SetModificationTime(storageID, "/replica/dir/file.txt", mTime)
+	assert.NoError(t, err)
+	// the written folder and the storage wide reads use the primary database
+	handle, r := testStore.getReadHandle(testStore.handle, storageID, []string{"/replica/dir"})
+	assert.Nil(t, r)
+	assert.Equal(t, testStore.handle, handle)
+	_, r = testStore.getReadHandle(testStore.handle, storageID, nil)
+	assert.Nil(t, r)
+	_, r = testStore.getReadHandle(testStore.handle, storageID, []string{"/replica/other"})
+	assert.Equal(t, healthy, r)
+	_, r = testStore.getReadHandle(testStore.handle, "s3://other-replica-bucket", nil)
+	assert.Equal(t, healthy, r)
+	got, err := m.GetModificationTime(storageID, "/replica/dir/file.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, mTime, got)
+	// after the window the replica is used again
+	time.Sleep(400 * time.Millisecond)
+	_, r = testStore.getReadHandle(testStore.handle, storageID, []string{"/replica/dir"})
+	assert.Equal(t, healthy, r)
+	_, r = testStore.getReadHandle(testStore.handle, storageID, nil)
+	assert.Equal(t, healthy, r)
+	got, err = m.GetModificationTime(storageID, "/replica/dir/file.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, mTime, got)
+	times, err := m.GetModificationTimes(storageID, "/replica/dir")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int64{"file.txt": mTime}, times)
+	_, err = m.GetModificationTime(storageID, "/replica/dir/missing.txt")
+	checkNotFoundError(t, err)
+	assert.True(t, healthy.healthy.Load())
+	// a query error is returned and the replica is not excluded
+	attempts := 0
+	err = testStore.executeRead(context.Background(), testStore.handle, storageID, nil, func(sess *gorm.DB) error {
+		attempts++
+		var count int64
+		return sess.Raw("SELECT COUNT(*) FROM missing_replica_table").Scan(&count).Error
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 1, attempts)
+	assert.True(t, healthy.healthy.Load())
+	// the same applies to the walks and the iterations
+	errQuery := errors.New("query error")
+	injectError := func(db *gorm.DB) {
+		db.AddError(errQuery) //nolint:errcheck
+	}
+	require.NoError(t, healthy.handle.Callback().Query().Before("gorm:query").Register("test:query_error", injectError))
+	require.NoError(t, healthy.handle.Callback().Row().Before("gorm:row").Register("test:row_error", injectError))
+	err = testStore.WalkFolders(context.Background(), storageID, "/replica", func(_ string) error {
+		return nil
+	})
+	assert.ErrorIs(t, err, errQuery)
+	assert.True(t, healthy.healthy.Load())
+	_, err = testStore.IterateModificationTimes(context.Background(), storageID, "/replica/dir")
+	assert.ErrorIs(t, err, errQuery)
+	assert.True(t, healthy.healthy.Load())
+	require.NoError(t, healthy.handle.Callback().Query().Remove("test:query_error"))
+	require.NoError(t, healthy.handle.Callback().Row().Remove("test:row_error"))
+	it, err := testStore.IterateModificationTimes(context.Background(), storageID, "/replica/dir")
+	require.NoError(t, err)
+	assert.True(t, it.Next())
+	assert.NoError(t, it.Close())
+
+	// a failing replica is excluded and the read is retried on the primary
+	healthy.setHealthy(false, nil)
+	unreachable.setHealthy(true, nil)
+	_, r = testStore.getReadHandle(testStore.handle, storageID, nil)
+	assert.Equal(t, unreachable, r)
+	got, err = m.GetModificationTime(storageID, "/replica/dir/file.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, mTime, got)
+	assert.False(t, unreachable.healthy.Load())
+	// no healthy replica
+	handle, r = testStore.getReadHandle(testStore.handle, storageID, nil)
+	assert.Nil(t, r)
+	assert.Equal(t, testStore.handle, handle)
+	folders, err := m.GetFolders(storageID, 0, "")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/replica/dir"}, folders)
+	// the health check includes the recovered replicas
+	set.check()
+	assert.True(t, healthy.healthy.Load())
+	assert.False(t, unreachable.healthy.Load())
+
+	_, err = testStore.RemoveStorage(storageID)
+	assert.NoError(t, err)
+}
+
+func TestWriteTracker(t *testing.T) {
+	tracker := newWriteTracker(0)
+	tracker.add("s3://bucket", "/dir")
+	assert.False(t, tracker.isRecent("s3://bucket", []string{"/dir"}))
+
+	tracker = newWriteTracker(time.Hour)
+	tracker.add("s3://bucket", "/dir")
+	assert.True(t, tracker.isRecent("s3://bucket", []string{"/dir"}))
+	assert.True(t, tracker.isRecent("s3://bucket", []string{"/other", "/dir"}))
+	assert.True(t, tracker.isRecent("s3://bucket", nil))
+	assert.False(t, tracker.isRecent("s3://bucket", []string{"/other"}))
+	assert.False(t, tracker.isRecent("s3://bucket1", nil))
+	tracker.add("s3://bucket1", "")
+	assert.True(t, tracker.isRecent("s3://bucket1", nil))
+	assert.False(t, tracker.isRecent("s3://bucket1", []string{"/dir"}))
+	// expired writes are removed
+	tracker.writes[getWriteKey("s3://bucket", "/dir")] = time.Now().Add(-2 * time.Hour)
+	tracker.lastSweep = time.Time{}
+	tracker.add("s3://bucket2", "/dir")
+	assert.False(t, tracker.isRecent("s3://bucket", []string{"/dir"}))
+	assert.NotContains(t, tracker.writes, getWriteKey("s3://bucket", "/dir"))
+}
@@ -0,0 +1,258 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"gorm.io/gorm"
+
+	"github.com/sftpgo/sftpgo-plugin-metadata/logger"
+)
+
+// Supported route match types
+const (
+	RouteMatchExact  = "exact"
+	RouteMatchPrefix = "prefix"
+	RouteMatchRegex  = "regex"
+)
+
+const (
+	// DefaultDatabaseName is the name used for the default database
+	DefaultDatabaseName = "default"
+)
+
+// RoutingConfig defines the databases used for the matching storage IDs
+type RoutingConfig struct {
+	Routes []RouteConfig `json:"routes"`
+}
+
+// RouteConfig defines the database for the storage IDs matching the pattern.
+// The other database settings are inherited from the default database
+type RouteConfig struct {
+	// Name identifies the route in logs and commands output
+	Name string `json:"name"`
+	// Match is the match type: exact, prefix or regex
+	Match string `json:"match"`
+	// Pattern is the storage ID, the storage ID prefix or the regular
+	// expression to match
+	Pattern         string `json:"pattern"`
+	Driver          string `json:"driver"`
+	DSN             string `json:"dsn"`
+	DSNFile         string `json:"dsn_file"`
+	PasswordFile    string `json:"password_file"`
+	CustomTLSConfig string `json:"custom_tls_config"`
+	// ReplicaDSNs defines the data source names for the read replicas
+	ReplicaDSNs []string `json:"replica_dsns"`
+}
+
+// LoadRoutingConfig reads the storage routes from the specified JSON file
+func LoadRoutingConfig(name string) ([]RouteConfig, error) {
+	var config RoutingConfig
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&config); err != nil {
+		return nil, fmt.Errorf("unable to parse routing config %q: %w", name, err)
+	}
+	return config.Routes, nil
+}
+
+type route struct {
+	config RouteConfig
+	regex  *regexp.Regexp
+	handle *gorm.DB
+	// shared is true if the handle is shared with the default database or
+	// with a previous route having the same connection settings
+	shared bool
+}
+
+func newRoute(config RouteConfig, names map[string]bool) (*route, error) {
+	if config.Name == "" {
+		return nil, errors.New("the route name is required")
+	}
+	if config.Name == DefaultDatabaseName || names[config.Name] {
+		return nil, fmt.Errorf("duplicate route name %q", config.Name)
+	}
+	if config.Pattern == "" {
+		return nil, fmt.Errorf("route %q: the pattern is required", config.Name)
+	}
+	r := &route{
+		config: config,
+	}
+	switch config.Match {
+	case RouteMatchExact, RouteMatchPrefix:
+	case RouteMatchRegex:
+		regex, err := regexp.Compile(config.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("route %q: invalid regular expression: %w", config.Name, err)
+		}
+		r.regex = regex
+	default:
+		return nil, fmt.Errorf("route %q: unsupported match type %q", config.Name, config.Match)
+	}
+	return r, nil
+}
+
+func (r *route) match(storageID string) bool {
+	switch r.config.Match {
+	case RouteMatchExact:
+		return storageID == r.config.Pattern
+	case RouteMatchPrefix:
+		return strings.HasPrefix(storageID, r.config.Pattern)
+	default:
+		return r.regex.MatchString(storageID)
+	}
+}
+
+// getConfig returns the database configuration for the route, the settings
+// not related to the connection are inherited from the default database
+func (r *route) getConfig(config Config) Config {
+	config.Driver = r.config.Driver
+	config.DSN = r.config.DSN
+	config.DSNFile = r.config.DSNFile
+	config.PasswordFile = r.config.PasswordFile
+	config.CustomTLSConfig = r.config.CustomTLSConfig
+	config.ReplicaDSNs = r.config.ReplicaDSNs
+	config.RoutingConfig = ""
+	return config
+}
+
+// getConnectionKey returns a key identifying the database the configuration
+// connects to
+func getConnectionKey(config Config) string {
+	values := []string{config.Driver, config.DSN, config.DSNFile, config.PasswordFile, config.CustomTLSConfig}
+	return strings.Join(append(values, config.ReplicaDSNs...), "\x00")
+}
+
+// initializeRoutes replaces the configured routes. Each database has its own
+// connection pool, routes with the same connection settings share it
+func (s *SQLStore) initializeRoutes(config Config, routeConfigs []RouteConfig) error {
+	s.closeRoutes()
+
+	names := make(map[string]bool)
+	handles := map[string]*gorm.DB{
+		getConnectionKey(config): s.handle,
+	}
+	var configured []*route
+	for _, routeConfig := range routeConfigs {
+		r, err := newRoute(routeConfig, names)
+		if err != nil {
+			logger.AppLogger.Error("invalid storage route", "error", err)
+			s.closeHandles(configured)
+			return err
+		}
+		names[routeConfig.Name] = true
+		routeConfig := r.getConfig(config)
+		key := getConnectionKey(routeConfig)
+		if handle, ok := handles[key]; ok {
+			r.handle = handle
+			r.shared = true
+			configured = append(configured, r)
+			continue
+		}
+		r.handle, err = s.openDatabase(routeConfig)
+		if err != nil {
+			logger.AppLogger.Error("unable to initialize storage route", "route", r.config.Name, "error", err)
+			s.closeHandles(append(configured, r))
+			return fmt.Errorf("route %q: %w", r.config.Name, err)
+		}
+		handles[key] = r.handle
+		configured = append(configured, r)
+		logger.AppLogger.Debug("storage route initialized", "route", r.config.Name, "match", r.config.Match,
+			"pattern", r.config.Pattern)
+	}
+	s.routes = configured
+	return nil
+}
+
+func (s *SQLStore) closeRoutes() {
+	s.closeHandles(s.routes)
+	s.routes = nil
+}
+
+func (s *SQLStore) closeHandles(toClose []*route) {
+	for _, r := range toClose {
+		if !r.shared {
+			s.closeHandle(r.handle)
+		}
+	}
+}
+
+// closeHandle closes the connection pool for the specified database and for
+// its replicas
+func (s *SQLStore) closeHandle(handle *gorm.DB) {
+	if handle == nil {
+		return
+	}
+	s.closeReplicas(handle)
+	if sqlDB, err := handle.DB(); err == nil {
+		sqlDB.Close()
+	}
+}
+
+// getHandle returns the database handle for the specified storage ID, the
+// default handle is returned if no route matches
+func (s *SQLStore) getHandle(storageID string) *gorm.DB {
+	for _, r := range s.routes {
+		if r.match(storageID) {
+			return r.handle
+		}
+	}
+	return s.handle
+}
+
+// getHandles returns the database handle for the specified storage ID or all
+// the database handles, the default one first, if the storage ID is empty
+func (s *SQLStore) getHandles(storageID string) []*gorm.DB {
+	if storageID != "" {
+		return []*gorm.DB{s.getHandle(storageID)}
+	}
+	handles := []*gorm.DB{s.handle}
+	for _, r := range s.routes {
+		if !r.shared {
+			handles = append(handles, r.handle)
+		}
+	}
+	return handles
+}
+
+// ForEachDatabase calls fn for the default database and then for the
+// database of each route, it stops at the first error. Databases shared by
+// multiple routes are visited once, using the name of the first route. It is
+// useful to apply the migrations to all the databases
+func (s *SQLStore) ForEachDatabase(fn func(name string, handle *gorm.DB) error) error {
+	if err := fn(DefaultDatabaseName, s.handle); err != nil {
+		return err
+	}
+	for _, r := range s.routes {
+		if r.shared {
+			continue
+		}
+		if err := fn(r.config.Name, r.handle); err != nil {
+			return fmt.Errorf("route %q: %w", r.config.Name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,197 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+
+	"github.com/sftpgo/sftpgo-plugin-metadata/db/migration"
+)
+
+func TestRouteMatch(t *testing.T) {
+	names := make(map[string]bool)
+	_, err := newRoute(RouteConfig{Match: RouteMatchExact, Pattern: "s3://bucket"}, names)
+	assert.Error(t, err)
+	_, err = newRoute(RouteConfig{Name: DefaultDatabaseName, Match: RouteMatchExact, Pattern: "s3://bucket"}, names)
+	assert.Error(t, err)
+	_, err = newRoute(RouteConfig{Name: "r", Match: RouteMatchExact}, names)
+	assert.Error(t, err)
+	_, err = newRoute(RouteConfig{Name: "r", Match: "glob", Pattern: "s3://*"}, names)
+	assert.Error(t, err)
+	_, err = newRoute(RouteConfig{Name: "r", Match: RouteMatchRegex, Pattern: "s3://[a-"}, names)
+	assert.Error(t, err)
+	_, err = newRoute(RouteConfig{Name: "r", Match: RouteMatchExact, Pattern: "s3://bucket"}, map[string]bool{"r": true})
+	assert.Error(t, err)
+
+	testCases := []struct {
+		config  RouteConfig
+		matches []string
+		others  []string
+	}{
+		{
+			config:  RouteConfig{Name: "exact", Match: RouteMatchExact, Pattern: "s3://bucket"},
+			matches: []string{"s3://bucket"},
+			others:  []string{"s3://bucket1", "s3://bucke", ""},
+		},
+		{
+			config:  RouteConfig{Name: "prefix", Match: RouteMatchPrefix, Pattern: "s3://eu-"},
+			matches: []string{"s3://eu-", "s3://eu-west-bucket"},
+			others:  []string{"s3://us-bucket", "gs://eu-bucket"},
+		},
+		{
+			config:  RouteConfig{Name: "regex", Match: RouteMatchRegex, Pattern: `^(s3|gs)://tenant-[0-9]+$`},
+			matches: []string{"s3://tenant-1", "gs://tenant-22"},
+			others:  []string{"s3://tenant-a", "azblob://tenant-1", "s3://tenant-1/sub"},
+		},
+	}
+	for _, tc := range testCases {
+		r, err := newRoute(tc.config, names)
+		require.NoError(t, err)
+		for _, storageID := range tc.matches {
+			assert.True(t, r.match(storageID), "route %q storage ID %q", tc.config.Name, storageID)
+		}
+		for _, storageID := range tc.others {
+			assert.False(t, r.match(storageID), "route %q storage ID %q", tc.config.Name, storageID)
+		}
+	}
+}
+
+func TestLoadRoutingConfig(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "routing.json")
+	err := os.WriteFile(name, []byte(`{"routes":[{"name":"eu","match":"prefix","pattern":"s3://eu-",
+"driver":"postgres","dsn_file":"/run/secrets/eu_dsn"}]}`), 0600)
+	require.NoError(t, err)
+	routeConfigs, err := LoadRoutingConfig(name)
+	require.NoError(t, err)
+	assert.Equal(t, []RouteConfig{{Name: "eu", Match: RouteMatchPrefix, Pattern: "s3://eu-", Driver: "postgres",
+		DSNFile: "/run/secrets/eu_dsn"}}, routeConfigs)
+
+	err = os.WriteFile(name, []byte(`{"routes":[{"name":"eu","unknown":true}]}`), 0600)
+	require.NoError(t, err)
+	_, err = LoadRoutingConfig(name)
+	assert.Error(t, err)
+	_, err = LoadRoutingConfig(filepath.Join(t.TempDir(), "missing.json"))
+	assert.Error(t, err)
+}
+
+func TestStorageRouting(t *testing.T) {
+	routedDSN := os.Getenv("SFTPGO_PLUGIN_METADATA_ROUTED_DSN")
+	if routedDSN == "" {
+		t.Skip("routed DSN not set")
+	}
+	driver := os.Getenv("SFTPGO_PLUGIN_METADATA_DRIVER")
+	config := Config{Driver: driver, Debug: true}
+	err := testStore.initializeRoutes(config, []RouteConfig{
+		{Name: "eu", Match: RouteMatchPrefix, Pattern: "s3://eu-", Driver: driver, DSN: routedDSN},
+		{Name: "invalid", Match: RouteMatchExact, Pattern: "s3://invalid", Driver: "unsupported"},
+	})
+	assert.Error(t, err)
+	assert.Len(t, testStore.routes, 0)
+	err = testStore.initializeRoutes(config, []RouteConfig{
+		{Name: "eu", Match: RouteMatchPrefix, Pattern: "s3://eu-", Driver: driver, DSN: routedDSN},
+		{Name: "tenant", Match: RouteMatchRegex, Pattern: `^gs://tenant-[0-9]+$`, Driver: driver, DSN: routedDSN},
+	})
+	require.NoError(t, err)
+	defer testStore.closeRoutes()
+
+	var names []string
+	err = testStore.ForEachDatabase(func(name string, handle *gorm.DB) error {
+		names = append(names, name)
+		return migration.MigrateDatabase(handle)
+	})
+	require.NoError(t, err)
+	// the routes to the same database share the connection pool
+	assert.Equal(t, []string{DefaultDatabaseName, "eu"}, names)
+	assert.Equal(t, testStore.handle, testStore.getHandle("s3://us-bucket"))
+	assert.Equal(t, testStore.routes[0].handle, testStore.getHandle("s3://eu-bucket"))
+	assert.Equal(t, testStore.routes[1].handle, testStore.getHandle("gs://tenant-1"))
+	assert.Len(t, testStore.getHandles(""), 2)
+	// a full reset affects the default and the routed databases
+	defaultName, err := testStore.GetDatabaseName()
+	require.NoError(t, err)
+	dbNames, err := testStore.GetDatabaseNames("")
+	require.NoError(t, err)
+	require.Len(t, dbNames, 2)
+	assert.Equal(t, defaultName, dbNames[0])
+	assert.NotEqual(t, defaultName, dbNames[1])
+	dbNames, err = testStore.GetDatabaseNames("s3://eu-bucket")
+	require.NoError(t, err)
+	require.Len(t, dbNames, 1)
+	assert.NotEqual(t, defaultName, dbNames[0])
+	dbNames, err = testStore.GetDatabaseNames("s3://us-bucket")
+	require.NoError(t, err)
+	assert.Equal(t, []string{defaultName}, dbNames)
+
+	m := testMetadater
+	mTime := getTimeAsMsSinceEpoch(time.Now())
+	storageIDs := []string{"s3://eu-routing-bucket", "gs://tenant-1", "s3://us-routing-bucket"}
+	for _, storageID := range storageIDs {
+		err = m.SetModificationTime(storageID, "/routing/file.txt", mTime)
+		assert.NoError(t, err)
+		got, err := m.GetModificationTime(storageID, "/routing/file.txt")
+		assert.NoError(t, err)
+		assert.Equal(t, mTime, got)
+	}
+	// the metadata are stored in the routed database only
+	for idx, storageID := range storageIDs {
+		var defaultCount, routedCount int64
+		err = testStore.handle.Model(&Folder{}).Where("storage_id = ?", storageID).Count(&defaultCount).Error
+		assert.NoError(t, err)
+		err = testStore.routes[0].handle.Model(&Folder{}).Where("storage_id = ?", storageID).Count(&routedCount).Error
+		assert.NoError(t, err)
+		if idx < 2 {
+			assert.Equal(t, int64(0), defaultCount, storageID)
+			assert.Greater(t, routedCount, int64(0), storageID)
+		} else {
+			assert.Greater(t, defaultCount, int64(0), storageID)
+			assert.Equal(t, int64(0), routedCount, storageID)
+		}
+	}
+	// without a storage ID all the databases are used
+	folders, err := m.GetFolders("", 0, "")
+	assert.NoError(t, err)
+	count := 0
+	for _, folder := range folders {
+		if folder == "/routing" {
+			count++
+		}
+	}
+	assert.Equal(t, 3, count)
+	folders, err = m.GetFolders("", 1, "/r")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/routing"}, folders)
+	var buf bytes.Buffer
+	exported, err := testStore.ExportMetadata(&buf, "")
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, exported, int64(3))
+	buf.Reset()
+	exported, err = testStore.ExportMetadata(&buf, "gs://tenant-1")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), exported)
+
+	for _, storageID := range storageIDs {
+		removed, err := testStore.RemoveStorage(storageID)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(2), removed, storageID)
+	}
+}
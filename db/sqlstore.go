@@ -0,0 +1,357 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"context"
+	"errors"
+	"path"
+	"sort"
+	"strings"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// SetModificationTime implements Store
+func (s *SQLStore) SetModificationTime(ctx context.Context, storageID, objectPath string, mTime int64) error {
+	folderPath := path.Dir(objectPath)
+	cachedID := s.getCachedFolderID(ctx, storageID, folderPath)
+	record, folderID, err := s.setModificationTime(ctx, storageID, objectPath, mTime, cachedID)
+	if err != nil && cachedID != 0 && ctx.Err() == nil {
+		// the cached folder could have been removed, the foreign key prevents
+		// adding the file to it, so the folder is looked up again
+		record, folderID, err = s.setModificationTime(ctx, storageID, objectPath, mTime, 0)
+	}
+	if err == nil {
+		if folderID != cachedID && s.folderIDs != nil {
+			s.folderIDs.SetFolderID(ctx, storageID, folderPath, folderID)
+		}
+		s.recordWrite(storageID, folderPath)
+		s.hooks.AuditLog.write(record)
+		s.hooks.Changes.dispatchLocal(ChangeOperationSet, storageID, objectPath, mTime, s.getChangeOrigin())
+	}
+	return err
+}
+
+// setModificationTime upserts the file within a transaction, the folder is
+// looked up, and created if missing, if folderID is 0. It returns the audit
+// record, if any, and the folder ID
+func (s *SQLStore) setModificationTime(ctx context.Context, storageID, objectPath string, mTime, folderID int64,
+) (*AuditRecord, int64, error) {
+	var record *AuditRecord
+	var txFolderID int64
+	folderPath := path.Dir(objectPath)
+	err := executeTx(s.getSession(ctx, storageID), func(tx *gorm.DB) error {
+		// the transaction can be retried, the folder could be created
+		// within a rolled back attempt
+		txFolderID = folderID
+		if txFolderID == 0 {
+			var err error
+			txFolderID, err = getOrCreateFolder(tx, storageID, folderPath, false)
+			if err != nil {
+				return err
+			}
+		}
+		record = nil
+		file := File{
+			Name:         path.Base(objectPath),
+			LastModified: mTime,
+			FolderID:     txFolderID,
+		}
+		if s.hooks.AuditLog != nil {
+			oldMTime, err := getLastModified(tx, file.Name, txFolderID)
+			if err != nil {
+				return err
+			}
+			record = s.hooks.AuditLog.newRecord(AuditOperationSet, storageID, objectPath, oldMTime, &mTime)
+		}
+		err := tx.Omit("Folder").Clauses(
+			clause.OnConflict{
+				Columns: []clause.Column{
+					{
+						Name: "name",
+					},
+					{
+						Name: "folder_id",
+					},
+				},
+				DoUpdates: clause.AssignmentColumns([]string{"last_modified"}),
+			}).Create(&file).Error
+		if err != nil {
+			return err
+		}
+		if err := s.publishChange(tx, ChangeOperationSet, storageID, folderPath, file.Name, mTime); err != nil {
+			return err
+		}
+		if record == nil {
+			return nil
+		}
+		return s.hooks.AuditLog.writeTx(tx, record)
+	})
+	return record, txFolderID, err
+}
+
+// getCachedFolderID returns the cached ID for the specified folder, 0 if not
+// cached
+func (s *SQLStore) getCachedFolderID(ctx context.Context, storageID, folderPath string) int64 {
+	if s.folderIDs == nil {
+		return 0
+	}
+	folderID, ok := s.folderIDs.GetFolderID(ctx, storageID, folderPath)
+	if !ok {
+		return 0
+	}
+	return folderID
+}
+
+// invalidateFolderIDs discards the cached folder IDs after removing or
+// renaming folders
+func (s *SQLStore) invalidateFolderIDs() {
+	if s.folderIDs == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), defaultQueryTimeout)
+	defer cancel()
+
+	s.folderIDs.InvalidateFolderIDs(ctx)
+}
+
+// GetModificationTime implements Store
+func (s *SQLStore) GetModificationTime(ctx context.Context, storageID, objectPath string) (int64, error) {
+	var mTime int64
+	err := s.executeRead(ctx, s.getHandle(storageID), storageID, []string{path.Dir(objectPath)},
+		func(sess *gorm.DB) error {
+			file, err := getFile(sess, storageID, objectPath)
+			mTime = file.LastModified
+			return err
+		})
+	return mTime, err
+}
+
+// GetModificationTimes implements Store
+func (s *SQLStore) GetModificationTimes(ctx context.Context, storageID, folderPath string) (map[string]int64, error) {
+	var result map[string]int64
+	err := s.executeRead(ctx, s.getHandle(storageID), storageID, []string{folderPath}, func(sess *gorm.DB) error {
+		result = make(map[string]int64)
+		folder := Folder{}
+		err := sess.Where("path = ? AND storage_id = ?", folderPath, storageID).Select("id").First(&folder).Error
+		if err != nil {
+			return err
+		}
+		var files []File
+		err = sess.Where("folder_id = ?", folder.ID).Select("name,last_modified").Find(&files).Error
+		if err != nil {
+			return err
+		}
+		for idx := range files {
+			result[files[idx].Name] = files[idx].LastModified
+		}
+		return nil
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return result, nil
+	}
+	return result, err
+}
+
+// RemoveMetadata implements Store
+func (s *SQLStore) RemoveMetadata(ctx context.Context, storageID, objectPath string) error {
+	sess := s.getSession(ctx, storageID)
+	if s.hooks.AuditLog != nil || s.changeEvents {
+		return s.removeMetadataTx(sess, storageID, objectPath)
+	}
+
+	err := checkRowsAffected(deleteFile(sess, storageID, objectPath))
+	if err == nil {
+		s.recordWrite(storageID, path.Dir(objectPath))
+		s.hooks.Changes.dispatchLocal(ChangeOperationRemove, storageID, objectPath, 0, s.getChangeOrigin())
+	}
+	return err
+}
+
+// removeMetadataTx removes the metadata, records the removed modification
+// time and publishes the change within a single transaction
+func (s *SQLStore) removeMetadataTx(sess *gorm.DB, storageID, objectPath string) error {
+	var record *AuditRecord
+	err := executeTx(sess, func(tx *gorm.DB) error {
+		var oldMTime *int64
+		if s.hooks.AuditLog != nil {
+			file, err := getFile(tx, storageID, objectPath)
+			if err != nil {
+				return err
+			}
+			oldMTime = &file.LastModified
+		}
+		if err := checkRowsAffected(deleteFile(tx, storageID, objectPath)); err != nil {
+			return err
+		}
+		err := s.publishChange(tx, ChangeOperationRemove, storageID, path.Dir(objectPath), path.Base(objectPath), 0)
+		if err != nil {
+			return err
+		}
+		if s.hooks.AuditLog == nil {
+			return nil
+		}
+		record = s.hooks.AuditLog.newRecord(AuditOperationRemove, storageID, objectPath, oldMTime, nil)
+		return s.hooks.AuditLog.writeTx(tx, record)
+	})
+	if err == nil {
+		s.recordWrite(storageID, path.Dir(objectPath))
+		s.hooks.AuditLog.write(record)
+		s.hooks.Changes.dispatchLocal(ChangeOperationRemove, storageID, objectPath, 0, s.getChangeOrigin())
+	}
+	return err
+}
+
+// GetFolders implements Store
+func (s *SQLStore) GetFolders(ctx context.Context, storageID string, limit int, from string) ([]string, error) {
+	var results []string
+	// without a storage ID the folders are read from all the databases and
+	// merged, each database returns at most limit folders
+	handles := s.getHandles(storageID)
+	for _, handle := range handles {
+		var folders []Folder
+
+		err := s.executeRead(ctx, handle, storageID, nil, func(sess *gorm.DB) error {
+			return getFoldersQuery(sess, storageID, limit, from).Find(&folders).Error
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		if results == nil {
+			results = make([]string, 0, len(folders))
+		}
+		for idx := range folders {
+			results = append(results, folders[idx].Path)
+		}
+	}
+	if len(handles) > 1 {
+		sort.Strings(results)
+		if limit > 0 && len(results) > limit {
+			results = results[:limit]
+		}
+	}
+	return results, nil
+}
+
+// GetFoldersByPrefix implements PrefixStore. The prefix is matched within the
+// query, so the results follow the database ordering
+func (s *SQLStore) GetFoldersByPrefix(ctx context.Context, storageID, prefix string, limit int, from string) ([]string, error) {
+	prefix = strings.TrimSuffix(prefix, "/")
+	var folders []Folder
+	err := s.executeRead(ctx, s.getHandle(storageID), storageID, nil, func(sess *gorm.DB) error {
+		sess = getFoldersQuery(sess, storageID, limit, from)
+		if prefix != "" {
+			sess = sess.Where("(path = ? OR path LIKE ? ESCAPE '!')", prefix, escapeLikePattern(prefix)+"/%")
+		}
+		return sess.Find(&folders).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	results := make([]string, 0, len(folders))
+	for idx := range folders {
+		results = append(results, folders[idx].Path)
+	}
+	return results, nil
+}
+
+func getFoldersQuery(sess *gorm.DB, storageID string, limit int, from string) *gorm.DB {
+	if limit > 0 {
+		sess = sess.Limit(limit)
+	}
+	if from != "" {
+		sess = sess.Where("path > ?", from)
+	}
+	if storageID != "" {
+		sess = sess.Where("storage_id = ?", storageID)
+	}
+	// skip the ancestors created to link the hierarchy
+	sess = sess.Where("implicit = ?", false)
+
+	return sess.Order("path ASC").Select("path")
+}
+
+// getOrCreateFolder returns the ID of the folder with the specified path,
+// the folder and its missing ancestors are created if they do not exist. The
+// ancestors are implicit, an existing implicit folder is no longer implicit
+// if requested for a file
+func getOrCreateFolder(tx *gorm.DB, storageID, folderPath string, implicit bool) (int64, error) {
+	folder := Folder{
+		StorageID: storageID,
+		Path:      folderPath,
+		Name:      getFolderName(folderPath),
+		Implicit:  implicit,
+	}
+	err := tx.Clauses(clause.OnConflict{
+		Columns: []clause.Column{
+			{
+				Name: "path",
+			},
+			{
+				Name: "storage_id",
+			},
+		},
+		DoNothing: true,
+	}).Create(&folder).Error
+	if err != nil {
+		return 0, err
+	}
+	if folder.ID == 0 {
+		folder = Folder{}
+		err = tx.Where("path = ? AND storage_id = ?", folderPath, storageID).Select("id", "implicit").
+			First(&folder).Error
+		if err != nil {
+			return 0, err
+		}
+		if folder.Implicit && !implicit {
+			err = tx.Model(&Folder{}).Where("id = ?", folder.ID).Update("implicit", false).Error
+		}
+		return folder.ID, err
+	}
+	// the folder was just created, existing folders already have their
+	// ancestors so the recursion stops at the first existing one
+	parentPath, ok := getParentPath(folderPath)
+	if !ok {
+		return folder.ID, nil
+	}
+	parentID, err := getOrCreateFolder(tx, storageID, parentPath, true)
+	if err != nil {
+		return 0, err
+	}
+	err = tx.Model(&Folder{}).Where("id = ?", folder.ID).Update("parent_id", parentID).Error
+	return folder.ID, err
+}
+
+// getFile returns the file with the specified path, only the modification time
+// is loaded. The folder and the file are looked up using a single query
+func getFile(sess *gorm.DB, storageID, objectPath string) (File, error) {
+	file := File{}
+	err := sess.Joins("INNER JOIN metadata_folders ON metadata_folders.id = metadata_files.folder_id").
+		Where("metadata_folders.path = ? AND metadata_folders.storage_id = ? AND metadata_files.name = ?",
+			path.Dir(objectPath), storageID, path.Base(objectPath)).
+		Select("metadata_files.last_modified").Take(&file).Error
+	return file, err
+}
+
+// deleteFile removes the file with the specified path using a single query,
+// the returned session must be checked for errors and affected rows
+func deleteFile(sess *gorm.DB, storageID, objectPath string) *gorm.DB {
+	folderIDs := sess.Session(&gorm.Session{NewDB: true}).Model(&Folder{}).Select("id").
+		Where("path = ? AND storage_id = ?", path.Dir(objectPath), storageID)
+	return sess.Where("name = ? AND folder_id IN (?)", path.Base(objectPath), folderIDs).Delete(&File{})
+}
@@ -0,0 +1,319 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+
+	"gorm.io/gorm"
+)
+
+const (
+	defaultLargestFolders = 10
+	statsFoldersQuery     = `SELECT storage_id, COUNT(*) FROM metadata_folders %s GROUP BY storage_id`
+	statsFilesQuery       = `SELECT metadata_folders.storage_id, COUNT(*), MIN(metadata_files.last_modified),
+ MAX(metadata_files.last_modified) FROM metadata_files
+ INNER JOIN metadata_folders ON metadata_folders.id = metadata_files.folder_id %s
+ GROUP BY metadata_folders.storage_id`
+	// the orphan folders have no files and no subfolders, they are found using
+	// anti-joins, both databases execute them without correlated subqueries
+	statsOrphansQuery = `SELECT folders.storage_id, COUNT(*) FROM metadata_folders folders
+ LEFT JOIN metadata_files files ON files.folder_id = folders.id
+ LEFT JOIN metadata_folders children ON children.parent_id = folders.id
+ WHERE files.id IS NULL AND children.id IS NULL %s GROUP BY folders.storage_id`
+	// the files are counted before joining the folders, so only the largest
+	// folders are looked up
+	statsLargestFoldersQuery = `SELECT metadata_folders.storage_id, metadata_folders.path, largest.files
+ FROM (SELECT folder_id, COUNT(*) AS files FROM metadata_files %s GROUP BY folder_id ORDER BY files DESC LIMIT ?)
+ largest INNER JOIN metadata_folders ON metadata_folders.id = largest.folder_id`
+	statsPostgreSQLEstimateQuery = `SELECT reltuples::bigint FROM pg_class WHERE oid = to_regclass(?)`
+	statsMySQLEstimateQuery      = `SELECT table_rows FROM information_schema.tables
+ WHERE table_schema = DATABASE() AND table_name = ?`
+)
+
+// StatisticsOptions defines the statistics to compute
+type StatisticsOptions struct {
+	// StorageID limits the statistics to the specified storage ID, empty
+	// means all the storages
+	StorageID string
+	// LargestFolders is the number of largest folders to report, 0 means
+	// the default, 10
+	LargestFolders int
+	// Estimate reads the total number of folders and files from the database
+	// catalog instead of counting them, the other aggregates are not
+	// computed. It is ignored if a storage ID is set
+	Estimate bool
+}
+
+// Statistics defines the aggregates for the stored metadata
+type Statistics struct {
+	// Folders is the number of folders
+	Folders int64 `json:"folders"`
+	// Files is the number of files
+	Files int64 `json:"files"`
+	// Estimated is true if Folders and Files are estimated from the database
+	// catalog
+	Estimated bool `json:"estimated"`
+	// OrphanFolders is the number of folders without files and subfolders,
+	// they are removed by the periodic cleanup
+	OrphanFolders int64 `json:"orphan_folders"`
+	// OldestModification is the oldest modification time, as milliseconds
+	// since epoch, nil if there are no files
+	OldestModification *int64 `json:"oldest_last_modified,omitempty"`
+	// NewestModification is the newest modification time
+	NewestModification *int64 `json:"newest_last_modified,omitempty"`
+	// Storages are the statistics for each storage ordered by storage ID
+	Storages []StorageStatistics `json:"storages,omitempty"`
+	// LargestFolders are the folders with the most files
+	LargestFolders []FolderStatistics `json:"largest_folders,omitempty"`
+}
+
+// StorageStatistics defines the aggregates for a storage
+type StorageStatistics struct {
+	StorageID          string `json:"storage_id"`
+	Folders            int64  `json:"folders"`
+	Files              int64  `json:"files"`
+	OrphanFolders      int64  `json:"orphan_folders"`
+	OldestModification *int64 `json:"oldest_last_modified,omitempty"`
+	NewestModification *int64 `json:"newest_last_modified,omitempty"`
+}
+
+// FolderStatistics defines the number of files within a folder
+type FolderStatistics struct {
+	StorageID string `json:"storage_id"`
+	Path      string `json:"path"`
+	Files     int64  `json:"files"`
+}
+
+// GetStatistics returns the aggregates for the stored metadata. The folders,
+// the files, the orphan folders and the modification times are aggregated
+// for each storage using a single scan of each table and index, with routing
+// the results for each database are combined
+func (s *SQLStore) GetStatistics(options StatisticsOptions) (*Statistics, error) {
+	if options.LargestFolders <= 0 {
+		options.LargestFolders = defaultLargestFolders
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), maintenanceQueryTimeout)
+	defer cancel()
+
+	stats := &Statistics{}
+	if options.Estimate && options.StorageID == "" {
+		stats.Estimated = true
+		for _, handle := range s.getHandles("") {
+			if err := addEstimatedCounts(handle.WithContext(ctx), stats); err != nil {
+				return nil, err
+			}
+		}
+		return stats, nil
+	}
+	storages := make(map[string]*StorageStatistics)
+	for _, handle := range s.getHandles(options.StorageID) {
+		sess := handle.WithContext(ctx)
+		if err := addStorageStatistics(sess, options.StorageID, storages); err != nil {
+			return nil, err
+		}
+		folders, err := getLargestFolders(sess, options.StorageID, options.LargestFolders)
+		if err != nil {
+			return nil, err
+		}
+		stats.LargestFolders = append(stats.LargestFolders, folders...)
+	}
+	for _, storage := range storages {
+		stats.Storages = append(stats.Storages, *storage)
+		stats.Folders += storage.Folders
+		stats.Files += storage.Files
+		stats.OrphanFolders += storage.OrphanFolders
+		stats.OldestModification = minMTime(stats.OldestModification, storage.OldestModification)
+		stats.NewestModification = maxMTime(stats.NewestModification, storage.NewestModification)
+	}
+	sort.Slice(stats.Storages, func(i, j int) bool {
+		return stats.Storages[i].StorageID < stats.Storages[j].StorageID
+	})
+	sort.SliceStable(stats.LargestFolders, func(i, j int) bool {
+		return stats.LargestFolders[i].Files > stats.LargestFolders[j].Files
+	})
+	if len(stats.LargestFolders) > options.LargestFolders {
+		stats.LargestFolders = stats.LargestFolders[:options.LargestFolders]
+	}
+	return stats, nil
+}
+
+// addStorageStatistics adds the aggregates for the storages within a
+// database
+func addStorageStatistics(sess *gorm.DB, storageID string, storages map[string]*StorageStatistics) error {
+	getStorage := func(id string) *StorageStatistics {
+		storage, ok := storages[id]
+		if !ok {
+			storage = &StorageStatistics{StorageID: id}
+			storages[id] = storage
+		}
+		return storage
+	}
+	err := scanStatistics(sess, statsFoldersQuery, "WHERE storage_id = ?", storageID, func(rows *sql.Rows) error {
+		var id string
+		var folders int64
+		if err := rows.Scan(&id, &folders); err != nil {
+			return err
+		}
+		getStorage(id).Folders = folders
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	filter := "WHERE metadata_folders.storage_id = ?"
+	err = scanStatistics(sess, statsFilesQuery, filter, storageID, func(rows *sql.Rows) error {
+		var id string
+		var files int64
+		var oldest, newest sql.NullInt64
+		if err := rows.Scan(&id, &files, &oldest, &newest); err != nil {
+			return err
+		}
+		storage := getStorage(id)
+		storage.Files = files
+		if oldest.Valid && newest.Valid {
+			storage.OldestModification = &oldest.Int64
+			storage.NewestModification = &newest.Int64
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return scanStatistics(sess, statsOrphansQuery, "AND folders.storage_id = ?", storageID, func(rows *sql.Rows) error {
+		var id string
+		var orphans int64
+		if err := rows.Scan(&id, &orphans); err != nil {
+			return err
+		}
+		getStorage(id).OrphanFolders = orphans
+		return nil
+	})
+}
+
+// scanStatistics runs the specified aggregate query, the filter is applied if
+// a storage ID is set, and calls fn for each row
+func scanStatistics(sess *gorm.DB, query, filter, storageID string, fn func(rows *sql.Rows) error) error {
+	var args []any
+	if storageID != "" {
+		args = append(args, storageID)
+	} else {
+		filter = ""
+	}
+	rows, err := sess.Raw(fmt.Sprintf(query, filter), args...).Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		if err := fn(rows); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func getLargestFolders(sess *gorm.DB, storageID string, limit int) ([]FolderStatistics, error) {
+	var filter string
+	var args []any
+	if storageID != "" {
+		filter = "WHERE folder_id IN (SELECT id FROM metadata_folders WHERE storage_id = ?)"
+		args = append(args, storageID)
+	}
+	args = append(args, limit)
+	rows, err := sess.Raw(fmt.Sprintf(statsLargestFoldersQuery, filter), args...).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []FolderStatistics
+	for rows.Next() {
+		var folder FolderStatistics
+		if err := rows.Scan(&folder.StorageID, &folder.Path, &folder.Files); err != nil {
+			return nil, err
+		}
+		results = append(results, folder)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	// the derived table order is not preserved by the join
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Files > results[j].Files
+	})
+	return results, nil
+}
+
+// addEstimatedCounts adds the number of folders and files estimated by the
+// database statistics. CockroachDB does not expose the estimates in the
+// PostgreSQL catalog, so the rows are counted
+func addEstimatedCounts(sess *gorm.DB, stats *Statistics) error {
+	for _, table := range []string{(&Folder{}).TableName(), (&File{}).TableName()} {
+		count, err := getEstimatedCount(sess, table)
+		if err != nil {
+			return fmt.Errorf("unable to estimate the rows for table %q: %w", table, err)
+		}
+		if table == (&Folder{}).TableName() {
+			stats.Folders += count
+		} else {
+			stats.Files += count
+		}
+	}
+	return nil
+}
+
+func getEstimatedCount(sess *gorm.DB, table string) (int64, error) {
+	var query string
+	if _, ok := getCockroachPlugin(sess); !ok {
+		switch sess.Dialector.Name() {
+		case driverNamePostgreSQL:
+			query = statsPostgreSQLEstimateQuery
+		case driverNameMySQL:
+			query = statsMySQLEstimateQuery
+		}
+	}
+	if query != "" {
+		var count sql.NullInt64
+		if err := sess.Raw(query, table).Row().Scan(&count); err != nil {
+			return 0, err
+		}
+		// PostgreSQL reports -1 for the tables never analyzed
+		if count.Valid && count.Int64 >= 0 {
+			return count.Int64, nil
+		}
+	}
+	var count int64
+	err := sess.Table(table).Count(&count).Error
+	return count, err
+}
+
+func minMTime(a, b *int64) *int64 {
+	if a == nil || (b != nil && *b < *a) {
+		return b
+	}
+	return a
+}
+
+func maxMTime(a, b *int64) *int64 {
+	if a == nil || (b != nil && *b > *a) {
+		return b
+	}
+	return a
+}
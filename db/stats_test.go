@@ -0,0 +1,84 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatistics(t *testing.T) {
+	m := testMetadater
+	storageID := "s3://stats-bucket"
+	_, err := testStore.RemoveStorage(storageID)
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		err = m.SetModificationTime(storageID, fmt.Sprintf("/stats/large/file%d.txt", i), int64(1000+i))
+		assert.NoError(t, err)
+	}
+	for i := 0; i < 2; i++ {
+		err = m.SetModificationTime(storageID, fmt.Sprintf("/stats/medium/file%d.txt", i), int64(500+i))
+		assert.NoError(t, err)
+	}
+	err = m.SetModificationTime(storageID, "/stats/small/file.txt", 2000)
+	assert.NoError(t, err)
+	err = m.SetModificationTime(storageID, "/stats/empty/file.txt", 3000)
+	assert.NoError(t, err)
+	// the folder is left without files, it is an orphan until the cleanup
+	err = m.RemoveMetadata(storageID, "/stats/empty/file.txt")
+	assert.NoError(t, err)
+
+	stats, err := testStore.GetStatistics(StatisticsOptions{StorageID: storageID, LargestFolders: 2})
+	require.NoError(t, err)
+	assert.False(t, stats.Estimated)
+	// "/", "/stats" and four subfolders
+	assert.Equal(t, int64(6), stats.Folders)
+	assert.Equal(t, int64(6), stats.Files)
+	assert.Equal(t, int64(1), stats.OrphanFolders)
+	if assert.NotNil(t, stats.OldestModification) && assert.NotNil(t, stats.NewestModification) {
+		assert.Equal(t, int64(500), *stats.OldestModification)
+		assert.Equal(t, int64(2000), *stats.NewestModification)
+	}
+	if assert.Len(t, stats.Storages, 1) {
+		storage := stats.Storages[0]
+		assert.Equal(t, storageID, storage.StorageID)
+		assert.Equal(t, int64(6), storage.Folders)
+		assert.Equal(t, int64(6), storage.Files)
+		assert.Equal(t, int64(1), storage.OrphanFolders)
+	}
+	assert.Equal(t, []FolderStatistics{
+		{StorageID: storageID, Path: "/stats/large", Files: 3},
+		{StorageID: storageID, Path: "/stats/medium", Files: 2},
+	}, stats.LargestFolders)
+
+	stats, err = testStore.GetStatistics(StatisticsOptions{})
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, stats.Files, int64(6))
+	assert.GreaterOrEqual(t, len(stats.Storages), 1)
+	assert.LessOrEqual(t, len(stats.LargestFolders), defaultLargestFolders)
+
+	stats, err = testStore.GetStatistics(StatisticsOptions{Estimate: true})
+	require.NoError(t, err)
+	assert.True(t, stats.Estimated)
+	assert.Empty(t, stats.Storages)
+	assert.Empty(t, stats.LargestFolders)
+
+	_, err = testStore.RemoveStorage(storageID)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,354 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"gorm.io/gorm"
+
+	"github.com/sftpgo/sftpgo-plugin-metadata/logger"
+)
+
+// Supported rules to resolve the conflicts between files with the same path
+const (
+	// ConflictRuleNewer keeps the newest modification time
+	ConflictRuleNewer = "newer"
+	// ConflictRuleSource keeps the source modification time
+	ConflictRuleSource = "source"
+	// ConflictRuleTarget keeps the target modification time
+	ConflictRuleTarget = "target"
+)
+
+const (
+	storageBatchSize = 1000
+)
+
+// ValidateConflictRule returns an error if the specified conflict rule is not
+// supported
+func ValidateConflictRule(rule string) error {
+	switch rule {
+	case ConflictRuleNewer, ConflictRuleSource, ConflictRuleTarget:
+		return nil
+	default:
+		return fmt.Errorf("unsupported conflict rule %q, supported rules: %v", rule,
+			[]string{ConflictRuleNewer, ConflictRuleSource, ConflictRuleTarget})
+	}
+}
+
+// resolveConflict returns the modification time to keep and true if it
+// differs from the target one
+func resolveConflict(rule string, sourceMTime, targetMTime int64) (int64, bool) {
+	switch rule {
+	case ConflictRuleSource:
+		return sourceMTime, sourceMTime != targetMTime
+	case ConflictRuleTarget:
+		return targetMTime, false
+	default:
+		if sourceMTime > targetMTime {
+			return sourceMTime, true
+		}
+		return targetMTime, false
+	}
+}
+
+// StorageMergeResult defines the changes applied merging a storage into
+// another one
+type StorageMergeResult struct {
+	// Folders is the number of folders moved to the target storage
+	Folders int64
+	// MergedFolders is the number of folders merged into an existing target
+	// folder and then removed
+	MergedFolders int64
+	// Files is the number of files moved into an existing target folder
+	Files int64
+	// MergedFiles is the number of files merged into an existing target file,
+	// the modification time is chosen using the conflict rule
+	MergedFiles int64
+}
+
+// isChanged returns true if any folder or file was moved or merged
+func (r *StorageMergeResult) isChanged() bool {
+	return r.Folders > 0 || r.MergedFolders > 0 || r.Files > 0 || r.MergedFiles > 0
+}
+
+func (r *StorageMergeResult) add(other StorageMergeResult) {
+	r.Folders += other.Folders
+	r.MergedFolders += other.MergedFolders
+	r.Files += other.Files
+	r.MergedFiles += other.MergedFiles
+}
+
+// checkStorageIDs checks that the metadata can be moved from the source to
+// the target storage ID and returns the database handle to use
+func (s *SQLStore) checkStorageIDs(sourceID, targetID string) (*gorm.DB, error) {
+	if sourceID == "" || targetID == "" {
+		return nil, errors.New("the source and target storage IDs are required")
+	}
+	if sourceID == targetID {
+		return nil, errors.New("the source and target storage IDs must be different")
+	}
+	handle := s.getHandle(sourceID)
+	if s.getHandle(targetID) != handle {
+		return nil, fmt.Errorf("storage IDs %q and %q are routed to different databases", sourceID, targetID)
+	}
+	return handle, nil
+}
+
+// RenameStorage moves all the folders, and so all the files, from the source
+// to the target storage ID. The folders are updated in batches, the target
+// storage must not have any folder, use MergeStorage otherwise. Once done, a
+// resync event is published for both storage IDs. It returns the number of
+// moved folders
+func (s *SQLStore) RenameStorage(sourceID, targetID string) (int64, error) {
+	handle, err := s.checkStorageIDs(sourceID, targetID)
+	if err != nil {
+		return 0, err
+	}
+	defer s.invalidateFolderIDs()
+
+	var renamed int64
+	for {
+		n, err := renameStorageBatch(handle, sourceID, targetID, renamed == 0)
+		renamed += n
+		if n > 0 {
+			s.recordWrite(sourceID, "")
+			s.recordWrite(targetID, "")
+		}
+		if err != nil || n < storageBatchSize {
+			if renamed > 0 {
+				s.publishResync(handle, sourceID, targetID)
+			}
+			// an interrupted rename is recorded too, some folders were moved
+			if err == nil || renamed > 0 {
+				s.auditBulkOperation(AuditOperationRenameStorage, sourceID, "", map[string]any{
+					"target_storage_id": targetID,
+					"folders":           renamed,
+					"completed":         err == nil,
+				})
+			}
+			return renamed, err
+		}
+		logger.AppLogger.Debug("storage rename in progress", "source", sourceID, "target", targetID,
+			"folders", renamed)
+	}
+}
+
+// renameStorageBatch moves a batch of folders to the target storage ID. If
+// checkTarget is true an error is returned if the target storage has folders
+func renameStorageBatch(handle *gorm.DB, sourceID, targetID string, checkTarget bool) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), maintenanceQueryTimeout)
+	defer cancel()
+
+	sess := handle.WithContext(ctx)
+	if checkTarget {
+		var existing []int64
+		if err := sess.Model(&Folder{}).Where("storage_id = ?", targetID).Limit(1).Pluck("id", &existing).Error; err != nil {
+			return 0, err
+		}
+		if len(existing) > 0 {
+			return 0, fmt.Errorf("storage ID %q already has metadata, merge the storages instead", targetID)
+		}
+	}
+	// the renamed folders no longer match, so the first batch is always read
+	var ids []int64
+	err := sess.Model(&Folder{}).Where("storage_id = ?", sourceID).Order("id ASC").Limit(storageBatchSize).
+		Pluck("id", &ids).Error
+	if err != nil || len(ids) == 0 {
+		return 0, err
+	}
+	sess = sess.Model(&Folder{}).Where("id IN ?", ids).Update("storage_id", targetID)
+	return sess.RowsAffected, sess.Error
+}
+
+// MergeStorage moves all the metadata from the source to the target storage
+// ID. The folders existing only for the source storage are moved, the other
+// ones are merged into the target folders. Files existing in both folders are
+// merged using the specified conflict rule. Each folder is merged within its
+// own transaction, so an interrupted merge can be run again. Once done, a
+// resync event is published for both storage IDs
+func (s *SQLStore) MergeStorage(sourceID, targetID, rule string) (StorageMergeResult, error) {
+	var result StorageMergeResult
+	if err := ValidateConflictRule(rule); err != nil {
+		return result, err
+	}
+	handle, err := s.checkStorageIDs(sourceID, targetID)
+	if err != nil {
+		return result, err
+	}
+	defer s.invalidateFolderIDs()
+
+	for {
+		n, err := mergeStorageBatch(handle, sourceID, targetID, rule, &result)
+		if n > 0 {
+			s.recordWrite(sourceID, "")
+			s.recordWrite(targetID, "")
+		}
+		if err != nil || n < storageBatchSize {
+			if result.isChanged() {
+				s.publishResync(handle, sourceID, targetID)
+			}
+			if err == nil || result.isChanged() {
+				s.auditBulkOperation(AuditOperationMergeStorage, sourceID, "", map[string]any{
+					"target_storage_id": targetID,
+					"conflict_rule":     rule,
+					"folders":           result.Folders,
+					"merged_folders":    result.MergedFolders,
+					"files":             result.Files,
+					"merged_files":      result.MergedFiles,
+					"completed":         err == nil,
+				})
+			}
+			return result, err
+		}
+		logger.AppLogger.Debug("storage merge in progress", "source", sourceID, "target", targetID,
+			"folders", result.Folders, "merged folders", result.MergedFolders)
+	}
+}
+
+// mergeStorageBatch moves or merges a batch of source folders and returns the
+// number of processed folders
+func mergeStorageBatch(handle *gorm.DB, sourceID, targetID, rule string, result *StorageMergeResult) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), maintenanceQueryTimeout)
+	defer cancel()
+
+	sess := handle.WithContext(ctx)
+	// the processed folders no longer match, so the first batch is always read
+	var folders []Folder
+	if err := sess.Where("storage_id = ?", sourceID).Order("id ASC").Limit(storageBatchSize).Find(&folders).Error; err != nil {
+		return 0, err
+	}
+	if len(folders) == 0 {
+		return 0, nil
+	}
+	paths := make([]string, 0, len(folders))
+	for idx := range folders {
+		paths = append(paths, folders[idx].Path)
+	}
+	var targetFolders []Folder
+	if err := sess.Where("storage_id = ? AND path IN ?", targetID, paths).Find(&targetFolders).Error; err != nil {
+		return 0, err
+	}
+	targets := make(map[string]*Folder, len(targetFolders))
+	for idx := range targetFolders {
+		targets[targetFolders[idx].Path] = &targetFolders[idx]
+	}
+	var moveIDs []int64
+	for idx := range folders {
+		folder := &folders[idx]
+		target, ok := targets[folder.Path]
+		if !ok {
+			moveIDs = append(moveIDs, folder.ID)
+			continue
+		}
+		var folderResult StorageMergeResult
+		err := executeTx(sess, func(tx *gorm.DB) error {
+			folderResult = StorageMergeResult{}
+			return mergeFolder(tx, folder, target, rule, &folderResult)
+		})
+		if err != nil {
+			return 0, fmt.Errorf("unable to merge folder %q: %w", folder.Path, err)
+		}
+		result.add(folderResult)
+	}
+	if len(moveIDs) > 0 {
+		res := sess.Model(&Folder{}).Where("id IN ?", moveIDs).Update("storage_id", targetID)
+		if res.Error != nil {
+			return 0, res.Error
+		}
+		result.Folders += res.RowsAffected
+	}
+	return len(folders), nil
+}
+
+// mergeFolder moves the files from the source to the target folder, and then
+// removes the source folder. The target folder is listed if the source one is
+func mergeFolder(tx *gorm.DB, source, target *Folder, rule string, result *StorageMergeResult) error {
+	sourceFolderID, targetFolderID := source.ID, target.ID
+	for {
+		// the processed files no longer match, so the first batch is always read
+		var files []File
+		err := tx.Where("folder_id = ?", sourceFolderID).Order("id ASC").Limit(storageBatchSize).Find(&files).Error
+		if err != nil {
+			return err
+		}
+		if len(files) == 0 {
+			break
+		}
+		if err := mergeFiles(tx, files, targetFolderID, rule, result); err != nil {
+			return err
+		}
+	}
+	// the subfolders, moved or not yet processed, now belong to the target folder
+	err := tx.Model(&Folder{}).Where("parent_id = ?", sourceFolderID).Update("parent_id", targetFolderID).Error
+	if err != nil {
+		return err
+	}
+	if err := tx.Where("id = ?", sourceFolderID).Delete(&Folder{}).Error; err != nil {
+		return err
+	}
+	if target.Implicit && !source.Implicit {
+		if err := tx.Model(&Folder{}).Where("id = ?", targetFolderID).Update("implicit", false).Error; err != nil {
+			return err
+		}
+	}
+	result.MergedFolders++
+	return nil
+}
+
+func mergeFiles(tx *gorm.DB, files []File, targetFolderID int64, rule string, result *StorageMergeResult) error {
+	names := make([]string, 0, len(files))
+	for idx := range files {
+		names = append(names, files[idx].Name)
+	}
+	var existing []File
+	if err := tx.Where("folder_id = ? AND name IN ?", targetFolderID, names).Find(&existing).Error; err != nil {
+		return err
+	}
+	targetFiles := make(map[string]*File, len(existing))
+	for idx := range existing {
+		targetFiles[existing[idx].Name] = &existing[idx]
+	}
+	var moveIDs, deleteIDs []int64
+	for idx := range files {
+		file := &files[idx]
+		target, ok := targetFiles[file.Name]
+		if !ok {
+			moveIDs = append(moveIDs, file.ID)
+			continue
+		}
+		if mTime, update := resolveConflict(rule, file.LastModified, target.LastModified); update {
+			if err := tx.Model(&File{}).Where("id = ?", target.ID).Update("last_modified", mTime).Error; err != nil {
+				return err
+			}
+		}
+		deleteIDs = append(deleteIDs, file.ID)
+	}
+	if len(deleteIDs) > 0 {
+		if err := tx.Where("id IN ?", deleteIDs).Delete(&File{}).Error; err != nil {
+			return err
+		}
+		result.MergedFiles += int64(len(deleteIDs))
+	}
+	if len(moveIDs) > 0 {
+		if err := tx.Model(&File{}).Where("id IN ?", moveIDs).Update("folder_id", targetFolderID).Error; err != nil {
+			return err
+		}
+		result.Files += int64(len(moveIDs))
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRenameStorage(t *testing.T) {
+	m := testMetadater
+	sourceID := "s3://old-bucket"
+	targetID := "s3://new-bucket"
+	mTime := getTimeAsMsSinceEpoch(time.Now())
+	for i := 0; i < 5; i++ {
+		err := m.SetModificationTime(sourceID, fmt.Sprintf("/rename/folder%d/file.txt", i), mTime)
+		assert.NoError(t, err)
+	}
+
+	_, err := testStore.RenameStorage(sourceID, sourceID)
+	assert.Error(t, err)
+	_, err = testStore.RenameStorage("", targetID)
+	assert.Error(t, err)
+	renamed, err := testStore.RenameStorage(sourceID, targetID)
+	require.NoError(t, err)
+	// the "/rename" and "/" ancestors are renamed too
+	assert.Equal(t, int64(7), renamed)
+	folders, err := m.GetFolders(sourceID, 0, "")
+	assert.NoError(t, err)
+	assert.Len(t, folders, 0)
+	value, err := m.GetModificationTime(targetID, "/rename/folder3/file.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, mTime, value)
+	children, err := m.GetChildFolders(targetID, "/rename")
+	assert.NoError(t, err)
+	assert.Len(t, children, 5)
+	// the target storage has metadata now
+	err = m.SetModificationTime(sourceID, "/rename/file.txt", mTime)
+	assert.NoError(t, err)
+	_, err = testStore.RenameStorage(sourceID, targetID)
+	assert.ErrorContains(t, err, "merge")
+
+	_, err = testStore.RemoveStorage(sourceID)
+	assert.NoError(t, err)
+	_, err = testStore.RemoveStorage(targetID)
+	assert.NoError(t, err)
+}
+
+func TestMergeStorage(t *testing.T) {
+	m := testMetadater
+	sourceID := "s3://merge-source"
+	targetID := "s3://merge-target"
+	mTime := getTimeAsMsSinceEpoch(time.Now())
+
+	for _, rule := range []string{ConflictRuleNewer, ConflictRuleSource, ConflictRuleTarget} {
+		t.Run(rule, func(t *testing.T) {
+			files := map[string]int64{
+				"/merge/both/older.txt":  mTime - 1000,
+				"/merge/both/newer.txt":  mTime + 1000,
+				"/merge/both/source.txt": mTime,
+				"/merge/source/file.txt": mTime,
+			}
+			for p, value := range files {
+				err := m.SetModificationTime(sourceID, p, value)
+				require.NoError(t, err)
+			}
+			for _, p := range []string{"/merge/both/older.txt", "/merge/both/newer.txt", "/merge/both/target.txt"} {
+				err := m.SetModificationTime(targetID, p, mTime)
+				require.NoError(t, err)
+			}
+
+			result, err := testStore.MergeStorage(sourceID, targetID, rule)
+			require.NoError(t, err)
+			// "/merge/source"
+			assert.Equal(t, int64(1), result.Folders)
+			// "/", "/merge" and "/merge/both"
+			assert.Equal(t, int64(3), result.MergedFolders)
+			assert.Equal(t, int64(1), result.Files)
+			assert.Equal(t, int64(2), result.MergedFiles)
+
+			folders, err := m.GetFolders(sourceID, 0, "")
+			assert.NoError(t, err)
+			assert.Len(t, folders, 0)
+			times, err := m.GetModificationTimes(targetID, "/merge/both")
+			assert.NoError(t, err)
+			expected := map[string]int64{
+				"older.txt":  mTime,
+				"newer.txt":  mTime + 1000,
+				"source.txt": mTime,
+				"target.txt": mTime,
+			}
+			switch rule {
+			case ConflictRuleSource:
+				expected["older.txt"] = mTime - 1000
+			case ConflictRuleTarget:
+				expected["newer.txt"] = mTime
+			}
+			assert.Equal(t, expected, times)
+			value, err := m.GetModificationTime(targetID, "/merge/source/file.txt")
+			assert.NoError(t, err)
+			assert.Equal(t, mTime, value)
+			// the moved folder is a child of the merged target folder
+			children, err := m.GetChildFolders(targetID, "/merge")
+			assert.NoError(t, err)
+			assert.Equal(t, []string{"/merge/both", "/merge/source"}, children)
+
+			_, err = testStore.RemoveStorage(targetID)
+			assert.NoError(t, err)
+		})
+	}
+
+	_, err := testStore.MergeStorage(sourceID, targetID, "unknown")
+	assert.Error(t, err)
+	_, err = testStore.MergeStorage(sourceID, sourceID, ConflictRuleNewer)
+	assert.Error(t, err)
+}
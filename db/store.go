@@ -0,0 +1,219 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/sftpgo/sftpgo-plugin-metadata/logger"
+)
+
+// cleanupInterval defines how often the stores are cleaned up
+const cleanupInterval = 12 * time.Hour
+
+var (
+	// ErrNotFound is returned by the stores if the requested metadata does
+	// not exist
+	ErrNotFound = gorm.ErrRecordNotFound
+	// ErrUnsupported is returned by the Metadater for the operations not
+	// implemented by its store
+	ErrUnsupported = errors.New("operation not supported by the metadata store")
+)
+
+// Store defines the backend used by a Metadater to persist the metadata.
+// The paths are already normalized and the context carries the timeout for
+// the operation. Implementations must be safe for concurrent use
+type Store interface {
+	// SetModificationTime creates or updates the modification time for the
+	// specified object
+	SetModificationTime(ctx context.Context, storageID, objectPath string, mTime int64) error
+	// GetModificationTime returns the modification time for the specified
+	// object or ErrNotFound
+	GetModificationTime(ctx context.Context, storageID, objectPath string) (int64, error)
+	// GetModificationTimes returns the modification times for the files
+	// within the specified folder, the map is empty if the folder does not
+	// exist
+	GetModificationTimes(ctx context.Context, storageID, folderPath string) (map[string]int64, error)
+	// RemoveMetadata removes the metadata for the specified object or
+	// returns ErrNotFound
+	RemoveMetadata(ctx context.Context, storageID, objectPath string) error
+	// GetFolders returns, ordered by path, at most limit folders with
+	// metadata and path greater than from. An empty storage ID means all the
+	// storages and limit 0 means no limit
+	GetFolders(ctx context.Context, storageID string, limit int, from string) ([]string, error)
+	// Close releases the resources used by the store
+	Close() error
+}
+
+// BulkStore is implemented by the stores supporting bulk lookups. The
+// results are keyed by folder path and then by file name
+type BulkStore interface {
+	GetModificationTimesBulk(ctx context.Context, storageID string, folders []string) (map[string]map[string]int64, error)
+	GetModificationTimesByPrefix(ctx context.Context, storageID, prefix string) (map[string]map[string]int64, error)
+}
+
+// PrefixStore is implemented by the stores able to restrict the folder scans
+// to a prefix
+type PrefixStore interface {
+	// GetFoldersByPrefix is like GetFolders for a single storage but it only
+	// returns the prefix folder and its subfolders. An empty prefix means
+	// all the folders
+	GetFoldersByPrefix(ctx context.Context, storageID, prefix string, limit int, from string) ([]string, error)
+}
+
+// ListingStore is implemented by the stores supporting ordered listings of
+// the files within a folder
+type ListingStore interface {
+	// GetModificationTimesPage returns at most limit files, ordered by name,
+	// with name greater than after
+	GetModificationTimesPage(ctx context.Context, storageID, folderPath, after string, limit int) ([]FileModificationTime, error)
+	// IterateModificationTimes returns an iterator over all the files ordered
+	// by name, it must stop once ctx is done
+	IterateModificationTimes(ctx context.Context, storageID, folderPath string) (FileIterator, error)
+}
+
+// HierarchyStore is implemented by the stores able to navigate the folder
+// hierarchy
+type HierarchyStore interface {
+	// GetChildFolders returns the paths of the immediate subfolders ordered
+	// by name
+	GetChildFolders(ctx context.Context, storageID, folderPath string) ([]string, error)
+	// WalkFolders calls fn for the specified folder, if it exists, and for
+	// all its descendants, one level at a time and ordered by path within
+	// each level
+	WalkFolders(ctx context.Context, storageID, folderPath string, fn func(folderPath string) error) error
+}
+
+// CleanupStore is implemented by the stores requiring a periodic cleanup,
+// for example to remove the folders left without files
+type CleanupStore interface {
+	Cleanup(ctx context.Context) error
+}
+
+// FolderIDCache defines an optional cache, used by the SQL store, for the
+// IDs of the folders. A cached ID can refer to a removed folder, the store
+// must detect it
+type FolderIDCache interface {
+	GetFolderID(ctx context.Context, storageID, folderPath string) (int64, bool)
+	SetFolderID(ctx context.Context, storageID, folderPath string, folderID int64)
+	// InvalidateFolderIDs discards all the cached IDs, it is called after
+	// removing folders
+	InvalidateFolderIDs(ctx context.Context)
+}
+
+// Locker coordinates the processes sharing the same stores
+type Locker interface {
+	// TryLock acquires the named lock, if it is free. The lock is never
+	// released, it expires after ttl
+	TryLock(ctx context.Context, name string, ttl time.Duration) (bool, error)
+}
+
+// FileIterator iterates over the files returned by a ListingStore
+type FileIterator interface {
+	Next() bool
+	File() FileModificationTime
+	Err() error
+	Close() error
+}
+
+// Cache defines an optional cache, used by a Metadater, for the modification
+// times of the files within a folder. Cache failures must not be reported,
+// a failed lookup is a miss
+type Cache interface {
+	// GetModificationTimes returns the cached modification times for all the
+	// files within the specified folder. On a miss the returned version
+	// identifies the cached state for the folder, it must be read before the
+	// store and passed to SetModificationTimes
+	GetModificationTimes(ctx context.Context, storageID, folderPath string) (files map[string]int64, version string, ok bool)
+	// SetModificationTimes caches the modification times for all the files
+	// within the specified folder, read from the store after the version was
+	// returned. Nothing is cached if the folder was invalidated in the
+	// meantime, so a stale listing cannot replace a newer one
+	SetModificationTimes(ctx context.Context, storageID, folderPath, version string, files map[string]int64)
+	// Invalidate discards the cached data for the specified folder, for all
+	// the folders of the storage if folderPath is empty or for all the
+	// storages if storageID is empty too
+	Invalidate(ctx context.Context, storageID, folderPath string)
+}
+
+// StoreHooks defines the optional consumers of the mutations applied by a
+// store. The hooks are passed to each store, so stores with different hooks
+// can coexist in the same process
+type StoreHooks struct {
+	// AuditLog records the mutations, nil disables the audit log
+	AuditLog *AuditLog
+	// Changes delivers the change events to its consumers, nil means no
+	// consumers
+	Changes *ChangeDispatcher
+}
+
+// NewStore returns the store for the configured driver, the migrations for
+// the SQL databases are not applied
+func NewStore(config Config) (Store, error) {
+	switch config.Driver {
+	case driverNameBolt, driverNameMemory:
+	default:
+		return NewSQLStore(config)
+	}
+	if config.ChangeEvents || config.RoutingConfig != "" || len(config.ReplicaDSNs) > 0 {
+		return nil, fmt.Errorf("change events, routing and replicas are not supported for database driver %v",
+			config.Driver)
+	}
+	var dsn string
+	// the snapshot path is optional for the memory store
+	if config.Driver != driverNameMemory || config.DSN != "" || config.DSNFile != "" {
+		var err error
+		dsn, err = config.loadDSN()
+		if err != nil {
+			logger.AppLogger.Error("unable to load data source name", "error", err)
+			return nil, err
+		}
+	}
+	if config.Driver == driverNameMemory {
+		return NewMemoryStore(dsn, config.Hooks)
+	}
+	return NewKVStore(dsn, config.Hooks)
+}
+
+// ScheduleCleanup periodically cleans up the specified store, it never
+// returns. If a locker is set, the processes sharing the store coordinate
+// so that the store is cleaned up by a single process for each interval
+func ScheduleCleanup(store CleanupStore, locker Locker) {
+	for range time.Tick(cleanupInterval) {
+		if locker != nil {
+			// the lock expires before the next tick of this process
+			acquired, err := tryLock(locker, "cleanup", cleanupInterval-time.Minute)
+			if err != nil || !acquired {
+				logger.AppLogger.Debug("metadata store cleanup skipped", "error", err)
+				continue
+			}
+		}
+		logger.AppLogger.Debug("cleaning up metadata store")
+		err := store.Cleanup(context.Background())
+		logger.AppLogger.Info("metadata store cleanup completed", "error", err)
+	}
+}
+
+func tryLock(locker Locker, name string, ttl time.Duration) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultQueryTimeout)
+	defer cancel()
+
+	return locker.TryLock(ctx, name, ttl)
+}
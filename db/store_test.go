@@ -0,0 +1,250 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"context"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeStore is a minimal Store keeping the metadata in memory
+type fakeStore struct {
+	mu       sync.Mutex
+	files    map[string]map[string]int64
+	reads    int
+	deadline bool
+}
+
+func newFakeStore() *fakeStore {
+	return &fakeStore{
+		files: make(map[string]map[string]int64),
+	}
+}
+
+func (s *fakeStore) checkContext(ctx context.Context) {
+	_, ok := ctx.Deadline()
+	s.deadline = ok
+}
+
+func (s *fakeStore) SetModificationTime(ctx context.Context, storageID, objectPath string, mTime int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.checkContext(ctx)
+	key := storageID + path.Dir(objectPath)
+	if _, ok := s.files[key]; !ok {
+		s.files[key] = make(map[string]int64)
+	}
+	s.files[key][path.Base(objectPath)] = mTime
+	return nil
+}
+
+func (s *fakeStore) GetModificationTime(ctx context.Context, storageID, objectPath string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.checkContext(ctx)
+	s.reads++
+	mTime, ok := s.files[storageID+path.Dir(objectPath)][path.Base(objectPath)]
+	if !ok {
+		return 0, ErrNotFound
+	}
+	return mTime, nil
+}
+
+func (s *fakeStore) GetModificationTimes(ctx context.Context, storageID, folderPath string) (map[string]int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.checkContext(ctx)
+	s.reads++
+	result := make(map[string]int64)
+	for name, mTime := range s.files[storageID+folderPath] {
+		result[name] = mTime
+	}
+	return result, nil
+}
+
+func (s *fakeStore) RemoveMetadata(ctx context.Context, storageID, objectPath string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.checkContext(ctx)
+	files := s.files[storageID+path.Dir(objectPath)]
+	if _, ok := files[path.Base(objectPath)]; !ok {
+		return ErrNotFound
+	}
+	delete(files, path.Base(objectPath))
+	return nil
+}
+
+func (s *fakeStore) GetFolders(ctx context.Context, storageID string, limit int, from string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.checkContext(ctx)
+	var folders []string
+	for key := range s.files {
+		if folderPath, ok := strings.CutPrefix(key, storageID); ok && folderPath > from {
+			folders = append(folders, folderPath)
+		}
+	}
+	sort.Strings(folders)
+	if limit > 0 && len(folders) > limit {
+		folders = folders[:limit]
+	}
+	return folders, nil
+}
+
+func (s *fakeStore) Close() error {
+	return nil
+}
+
+// fakeCache is a Cache keeping the folder listings in memory, the version is
+// incremented by any invalidation
+type fakeCache struct {
+	mu      sync.Mutex
+	folders map[string]map[string]int64
+	version int
+}
+
+func (c *fakeCache) GetModificationTimes(_ context.Context, storageID, folderPath string) (map[string]int64, string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	files, ok := c.folders[storageID+folderPath]
+	return files, strconv.Itoa(c.version), ok
+}
+
+func (c *fakeCache) SetModificationTimes(_ context.Context, storageID, folderPath, version string,
+	files map[string]int64,
+) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if version == strconv.Itoa(c.version) {
+		c.folders[storageID+folderPath] = files
+	}
+}
+
+func (c *fakeCache) Invalidate(_ context.Context, storageID, folderPath string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.version++
+
+	for key := range c.folders {
+		if _, ok := strings.CutPrefix(key, storageID+folderPath); ok {
+			delete(c.folders, key)
+		}
+	}
+}
+
+func TestMetadaterWithFakeStore(t *testing.T) {
+	store := newFakeStore()
+	policy, err := ParseNormalizationPolicy("leading_slash,clean")
+	require.NoError(t, err)
+	m := NewMetadater(store, MetadaterConfig{PathPolicy: policy, QueryTimeout: time.Second})
+	storageID := "s3://fake-bucket"
+
+	err = m.SetModificationTime(storageID, "dir//file.txt", 100)
+	assert.NoError(t, err)
+	assert.True(t, store.deadline)
+	mTime, err := m.GetModificationTime(storageID, "/dir/./file.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(100), mTime)
+	times, err := m.GetModificationTimes(storageID, "dir/")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int64{"file.txt": 100}, times)
+	folders, err := m.GetFolders(storageID, 0, "")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/dir"}, folders)
+	err = m.RemoveMetadata(storageID, "dir/file.txt")
+	assert.NoError(t, err)
+	err = m.RemoveMetadata(storageID, "dir/file.txt")
+	checkNotFoundError(t, err)
+	_, err = m.GetModificationTime(storageID, "dir/file.txt")
+	checkNotFoundError(t, err)
+
+	// the optional operations are not supported by the fake store
+	_, err = m.GetModificationTimesBulk(storageID, []string{"/dir"})
+	assert.Equal(t, codes.Unimplemented, status.Code(err))
+	_, _, err = m.GetModificationTimesPage(storageID, "/dir", "", 10)
+	assert.Equal(t, codes.Unimplemented, status.Code(err))
+	_, err = m.IterateModificationTimes(context.Background(), storageID, "/dir")
+	assert.Equal(t, codes.Unimplemented, status.Code(err))
+	err = m.WalkFolders(storageID, "/dir", func(_ string) error { return nil })
+	assert.Equal(t, codes.Unimplemented, status.Code(err))
+}
+
+func TestMetadaterCache(t *testing.T) {
+	store := newFakeStore()
+	cache := &fakeCache{folders: make(map[string]map[string]int64)}
+	m := NewMetadater(store, MetadaterConfig{Cache: cache})
+	storageID := "s3://cache-bucket"
+
+	err := m.SetModificationTime(storageID, "/dir/file1.txt", 100)
+	assert.NoError(t, err)
+	times, err := m.GetModificationTimes(storageID, "/dir")
+	assert.NoError(t, err)
+	assert.Len(t, times, 1)
+	assert.Equal(t, 1, store.reads)
+	// the cached listing is used for the folder and for the files within it
+	_, err = m.GetModificationTimes(storageID, "/dir")
+	assert.NoError(t, err)
+	mTime, err := m.GetModificationTime(storageID, "/dir/file1.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(100), mTime)
+	_, err = m.GetModificationTime(storageID, "/dir/missing.txt")
+	checkNotFoundError(t, err)
+	assert.Equal(t, 1, store.reads)
+	// writes invalidate the cached folder
+	err = m.SetModificationTime(storageID, "/dir/file2.txt", 200)
+	assert.NoError(t, err)
+	mTime, err = m.GetModificationTime(storageID, "/dir/file2.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(200), mTime)
+	assert.Equal(t, 2, store.reads)
+	times, err = m.GetModificationTimes(storageID, "/dir")
+	assert.NoError(t, err)
+	assert.Len(t, times, 2)
+	err = m.RemoveMetadata(storageID, "/dir/file1.txt")
+	assert.NoError(t, err)
+	assert.Len(t, cache.folders, 0)
+	// the changes applied by other instances invalidate the cache too
+	_, err = m.GetModificationTimes(storageID, "/dir")
+	assert.NoError(t, err)
+	m.HandleChange(ChangeEvent{Operation: ChangeOperationSet, StorageID: storageID, FolderPath: "/dir",
+		Origin: "self", local: true})
+	assert.Len(t, cache.folders, 1)
+	m.HandleChange(ChangeEvent{Operation: ChangeOperationSet, StorageID: storageID, FolderPath: "/dir",
+		Origin: "other"})
+	assert.Len(t, cache.folders, 0)
+	_, err = m.GetModificationTimes(storageID, "/dir")
+	assert.NoError(t, err)
+	m.HandleChange(ChangeEvent{Operation: ChangeOperationResync})
+	assert.Len(t, cache.folders, 0)
+}
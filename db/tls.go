@@ -0,0 +1,165 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"slices"
+
+	mysqldriver "github.com/go-sql-driver/mysql"
+	"github.com/jackc/pgx/v5"
+
+	"github.com/sftpgo/sftpgo-plugin-metadata/logger"
+)
+
+const (
+	customTLSConfigName = "custom"
+)
+
+var (
+	customTLSOptions = []string{"root_cert", "client_cert", "client_key", "tls_mode", "min_tls_version", "server_name"}
+	tlsVersions      = map[string]uint16{
+		"1.0": tls.VersionTLS10,
+		"1.1": tls.VersionTLS11,
+		"1.2": tls.VersionTLS12,
+		"1.3": tls.VersionTLS13,
+	}
+)
+
+// getCustomTLSConfig parses the custom TLS configuration. It returns nil if
+// no custom TLS configuration is set
+func getCustomTLSConfig(config string) (*tls.Config, error) {
+	if config == "" {
+		return nil, nil
+	}
+	values, err := url.ParseQuery(config)
+	if err != nil {
+		logger.AppLogger.Error("unable to parse custom tls config", "value", config, "error", err)
+		return nil, fmt.Errorf("unable to parse tls config: %w", err)
+	}
+	for key := range values {
+		if !slices.Contains(customTLSOptions, key) {
+			return nil, fmt.Errorf("unsupported custom tls option %q, supported options: %v", key, customTLSOptions)
+		}
+	}
+	rootCert := values.Get("root_cert")
+	clientCert := values.Get("client_cert")
+	clientKey := values.Get("client_key")
+	tlsMode := values.Get("tls_mode")
+	minTLSVersion := values.Get("min_tls_version")
+
+	tlsConfig := &tls.Config{
+		ServerName: values.Get("server_name"),
+	}
+	if rootCert != "" {
+		rootCAs, err := x509.SystemCertPool()
+		if err != nil {
+			rootCAs = x509.NewCertPool()
+		}
+		rootCrt, err := os.ReadFile(rootCert)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load root certificate %q: %v", rootCert, err)
+		}
+		if !rootCAs.AppendCertsFromPEM(rootCrt) {
+			return nil, fmt.Errorf("unable to parse root certificate %q", rootCert)
+		}
+		tlsConfig.RootCAs = rootCAs
+	}
+	if (clientCert == "") != (clientKey == "") {
+		return nil, errors.New("client_cert and client_key must be set together")
+	}
+	if clientCert != "" {
+		cert := make([]tls.Certificate, 0, 1)
+		tlsCert, err := tls.LoadX509KeyPair(clientCert, clientKey)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load key pair %q, %q: %v", clientCert, clientKey, err)
+		}
+		cert = append(cert, tlsCert)
+		tlsConfig.Certificates = cert
+	}
+	switch tlsMode {
+	case "", "0":
+	case "1":
+		tlsConfig.InsecureSkipVerify = true
+	default:
+		return nil, fmt.Errorf("invalid tls_mode %q, supported values: 0, 1", tlsMode)
+	}
+	if minTLSVersion != "" {
+		version, ok := tlsVersions[minTLSVersion]
+		if !ok {
+			return nil, fmt.Errorf("invalid min_tls_version %q, supported values: 1.0, 1.1, 1.2, 1.3", minTLSVersion)
+		}
+		tlsConfig.MinVersion = version
+	}
+	return tlsConfig, nil
+}
+
+// handleCustomTLSConfig registers the custom TLS configuration, if any, with
+// the MySQL driver
+func handleCustomTLSConfig(config string) error {
+	tlsConfig, err := getCustomTLSConfig(config)
+	if err != nil || tlsConfig == nil {
+		return err
+	}
+	if err := mysqldriver.RegisterTLSConfig(customTLSConfigName, tlsConfig); err != nil {
+		return fmt.Errorf("unable to register tls config: %v", err)
+	}
+	return nil
+}
+
+// checkMySQLCustomTLSConfig returns an error if a custom TLS configuration
+// is set but the DSN does not use it, it would be silently ignored otherwise
+func checkMySQLCustomTLSConfig(config string, mysqlConfig *mysqldriver.Config) error {
+	if config == "" || mysqlConfig.TLSConfig == customTLSConfigName {
+		return nil
+	}
+	return fmt.Errorf("a custom tls config is set but the dsn does not use it, add \"tls=%s\" to the dsn",
+		customTLSConfigName)
+}
+
+// applyPostgreSQLCustomTLSConfig replaces the TLS configuration built from the
+// DSN with the custom one, if any
+func applyPostgreSQLCustomTLSConfig(config string, connConfig *pgx.ConnConfig) error {
+	tlsConfig, err := getCustomTLSConfig(config)
+	if err != nil || tlsConfig == nil {
+		return err
+	}
+	if connConfig.TLSConfig == nil {
+		return errors.New("a custom tls config is set but the dsn disables TLS, set sslmode to require, verify-ca or verify-full")
+	}
+	connConfig.TLSConfig = getHostTLSConfig(tlsConfig, connConfig.Host)
+	for _, fallback := range connConfig.Fallbacks {
+		if fallback.TLSConfig == nil {
+			return errors.New("a custom tls config is set but the dsn allows plaintext connections, set sslmode to require, verify-ca or verify-full")
+		}
+		fallback.TLSConfig = getHostTLSConfig(tlsConfig, fallback.Host)
+	}
+	return nil
+}
+
+// getHostTLSConfig returns a copy of the specified TLS configuration with the
+// server name set to host, if no server name override is configured
+func getHostTLSConfig(tlsConfig *tls.Config, host string) *tls.Config {
+	hostConfig := tlsConfig.Clone()
+	if hostConfig.ServerName == "" {
+		hostConfig.ServerName = host
+	}
+	return hostConfig
+}
@@ -0,0 +1,91 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"crypto/tls"
+	"testing"
+
+	mysqldriver "github.com/go-sql-driver/mysql"
+	"github.com/jackc/pgx/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCustomTLSConfig(t *testing.T) {
+	tlsConfig, err := getCustomTLSConfig("")
+	assert.NoError(t, err)
+	assert.Nil(t, tlsConfig)
+
+	tlsConfig, err = getCustomTLSConfig("tls_mode=1&min_tls_version=1.3&server_name=db.example.com")
+	require.NoError(t, err)
+	assert.True(t, tlsConfig.InsecureSkipVerify)
+	assert.Equal(t, uint16(tls.VersionTLS13), tlsConfig.MinVersion)
+	assert.Equal(t, "db.example.com", tlsConfig.ServerName)
+
+	for _, config := range []string{
+		"unknown_option=1",
+		"tls_mode=2",
+		"min_tls_version=1.4",
+		"client_cert=cert.pem",
+		"client_key=key.pem",
+		"root_cert=missing.pem",
+	} {
+		_, err = getCustomTLSConfig(config)
+		assert.Error(t, err, config)
+	}
+}
+
+func TestPostgreSQLCustomTLSConfig(t *testing.T) {
+	customTLS := "min_tls_version=1.2"
+
+	connConfig, err := pgx.ParseConfig("host=db1.example.com,db2.example.com user=sftpgo sslmode=require")
+	require.NoError(t, err)
+	err = applyPostgreSQLCustomTLSConfig(customTLS, connConfig)
+	require.NoError(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS12), connConfig.TLSConfig.MinVersion)
+	assert.False(t, connConfig.TLSConfig.InsecureSkipVerify)
+	assert.Equal(t, "db1.example.com", connConfig.TLSConfig.ServerName)
+	if assert.Len(t, connConfig.Fallbacks, 1) {
+		assert.Equal(t, "db2.example.com", connConfig.Fallbacks[0].TLSConfig.ServerName)
+	}
+
+	connConfig, err = pgx.ParseConfig("host=10.0.0.1 user=sftpgo sslmode=verify-full")
+	require.NoError(t, err)
+	err = applyPostgreSQLCustomTLSConfig(customTLS+"&server_name=db.example.com", connConfig)
+	require.NoError(t, err)
+	assert.Equal(t, "db.example.com", connConfig.TLSConfig.ServerName)
+
+	for _, sslMode := range []string{"disable", "allow", "prefer"} {
+		connConfig, err = pgx.ParseConfig("host=127.0.0.1 user=sftpgo sslmode=" + sslMode)
+		require.NoError(t, err)
+		err = applyPostgreSQLCustomTLSConfig(customTLS, connConfig)
+		assert.Error(t, err, sslMode)
+	}
+}
+
+func TestMySQLCustomTLSConfig(t *testing.T) {
+	err := handleCustomTLSConfig("tls_mode=1")
+	require.NoError(t, err)
+
+	mysqlConfig, err := mysqldriver.ParseDSN("sftpgo@tcp([127.0.0.1]:3306)/sftpgo_metadata?tls=custom")
+	require.NoError(t, err)
+	assert.NoError(t, checkMySQLCustomTLSConfig("tls_mode=1", mysqlConfig))
+
+	mysqlConfig, err = mysqldriver.ParseDSN("sftpgo@tcp([127.0.0.1]:3306)/sftpgo_metadata?tls=false")
+	require.NoError(t, err)
+	assert.Error(t, checkMySQLCustomTLSConfig("tls_mode=1", mysqlConfig))
+	assert.NoError(t, checkMySQLCustomTLSConfig("", mysqlConfig))
+}
@@ -0,0 +1,170 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"context"
+	"errors"
+	"path"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gorm.io/gorm"
+)
+
+const (
+	tracerName         = "github.com/sftpgo/sftpgo-plugin-metadata/db"
+	gormTracingPlugin  = "sftpgo:tracing"
+	gormCallbackBefore = "sftpgo:tracing_before"
+	gormCallbackAfter  = "sftpgo:tracing_after"
+	gormSpanKey        = "sftpgo:tracing_span"
+)
+
+// the global tracer provider is used, so the tracer is a no-op until it is configured
+var tracer = otel.Tracer(tracerName)
+
+// startSpan starts a span for a Metadater method
+func startSpan(method, storageID, objectPath string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	attrs = append(attrs,
+		attribute.String("metadata.method", method),
+		attribute.String("metadata.storage_id", storageID),
+		attribute.Int("metadata.path_depth", getPathDepth(objectPath)),
+	)
+	return tracer.Start(context.Background(), "Metadater."+method, trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attrs...))
+}
+
+// endSpan records the returned rows and the error, if any, and ends the span.
+// Not found errors are expected and so they are not recorded as span errors
+func endSpan(span trace.Span, rows int, err error) {
+	span.SetAttributes(attribute.Int("metadata.rows", rows))
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) && status.Code(err) != codes.NotFound {
+		span.RecordError(err)
+		span.SetStatus(otelcodes.Error, err.Error())
+	}
+	span.End()
+}
+
+// getAffectedRows returns the rows affected by a single object operation
+func getAffectedRows(err error) int {
+	if err != nil {
+		return 0
+	}
+	return 1
+}
+
+// getPathDepth returns the number of elements in the specified path
+func getPathDepth(p string) int {
+	p = strings.Trim(path.Clean("/"+p), "/")
+	if p == "" {
+		return 0
+	}
+	return strings.Count(p, "/") + 1
+}
+
+// tracingPlugin is a gorm plugin creating a span for each database statement
+// executed on behalf of a traced operation
+type tracingPlugin struct {
+	system string
+}
+
+func newTracingPlugin(driver string) *tracingPlugin {
+	system := driver
+	switch driver {
+	case driverNamePostgreSQL:
+		system = "postgresql"
+	case driverNameCockroachDB:
+		system = "cockroachdb"
+	}
+	return &tracingPlugin{
+		system: system,
+	}
+}
+
+func (p *tracingPlugin) Name() string {
+	return gormTracingPlugin
+}
+
+func (p *tracingPlugin) Initialize(db *gorm.DB) error {
+	callbacks := db.Callback()
+	registrations := []func() error{
+		func() error { return callbacks.Create().Before("*").Register(gormCallbackBefore, p.before) },
+		func() error { return callbacks.Create().After("*").Register(gormCallbackAfter, p.after) },
+		func() error { return callbacks.Query().Before("*").Register(gormCallbackBefore, p.before) },
+		func() error { return callbacks.Query().After("*").Register(gormCallbackAfter, p.after) },
+		func() error { return callbacks.Update().Before("*").Register(gormCallbackBefore, p.before) },
+		func() error { return callbacks.Update().After("*").Register(gormCallbackAfter, p.after) },
+		func() error { return callbacks.Delete().Before("*").Register(gormCallbackBefore, p.before) },
+		func() error { return callbacks.Delete().After("*").Register(gormCallbackAfter, p.after) },
+		func() error { return callbacks.Row().Before("*").Register(gormCallbackBefore, p.before) },
+		func() error { return callbacks.Row().After("*").Register(gormCallbackAfter, p.after) },
+		func() error { return callbacks.Raw().Before("*").Register(gormCallbackBefore, p.before) },
+		func() error { return callbacks.Raw().After("*").Register(gormCallbackAfter, p.after) },
+	}
+	for _, register := range registrations {
+		if err := register(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *tracingPlugin) before(db *gorm.DB) {
+	if db.Statement.Context == nil || !trace.SpanFromContext(db.Statement.Context).SpanContext().IsValid() {
+		// only trace statements executed on behalf of a traced operation
+		return
+	}
+	_, span := tracer.Start(db.Statement.Context, "gorm.statement", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("db.system", p.system)))
+	db.InstanceSet(gormSpanKey, span)
+}
+
+func (p *tracingPlugin) after(db *gorm.DB) {
+	val, ok := db.InstanceGet(gormSpanKey)
+	if !ok {
+		return
+	}
+	span, ok := val.(trace.Span)
+	if !ok {
+		return
+	}
+	statement := db.Statement.SQL.String()
+	statementType := getStatementType(statement)
+	span.SetName("gorm." + statementType)
+	span.SetAttributes(
+		attribute.String("db.operation", statementType),
+		attribute.String("db.statement", statement),
+		attribute.Int64("db.rows_affected", db.RowsAffected),
+	)
+	if db.Error != nil && !errors.Is(db.Error, gorm.ErrRecordNotFound) {
+		span.RecordError(db.Error)
+		span.SetStatus(otelcodes.Error, db.Error.Error())
+	}
+	span.End()
+}
+
+// getStatementType returns the SQL statement type, for example SELECT or INSERT
+func getStatementType(statement string) string {
+	fields := strings.Fields(statement)
+	if len(fields) == 0 {
+		return "UNKNOWN"
+	}
+	return strings.ToUpper(fields[0])
+}
@@ -0,0 +1,81 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	otel.SetTracerProvider(provider)
+	defer provider.Shutdown(context.Background()) //nolint:errcheck
+
+	m := testMetadater
+	storageID := "s3://tracing-bucket"
+	objectPath := "/user1/traced/file.txt"
+	err := m.SetModificationTime(storageID, objectPath, getTimeAsMsSinceEpoch(time.Now()))
+	assert.NoError(t, err)
+	_, err = m.GetModificationTime(storageID, "/user1/traced/missing.txt")
+	checkNotFoundError(t, err)
+	times, err := m.GetModificationTimes(storageID, "/user1/traced")
+	assert.NoError(t, err)
+	assert.Len(t, times, 1)
+	err = m.RemoveMetadata(storageID, objectPath)
+	assert.NoError(t, err)
+
+	var methodSpans []sdktrace.ReadOnlySpan
+	statements := 0
+	for _, span := range recorder.Ended() {
+		if span.Parent().IsValid() {
+			statements++
+			assert.Contains(t, span.Name(), "gorm.")
+			continue
+		}
+		methodSpans = append(methodSpans, span)
+	}
+	assert.Greater(t, statements, len(methodSpans))
+	require.Len(t, methodSpans, 4)
+
+	names := []string{"Metadater.SetModificationTime", "Metadater.GetModificationTime",
+		"Metadater.GetModificationTimes", "Metadater.RemoveMetadata"}
+	for idx, span := range methodSpans {
+		assert.Equal(t, names[idx], span.Name())
+		// not found errors are not recorded as span errors
+		assert.NotEqual(t, otelcodes.Error, span.Status().Code)
+		assert.Contains(t, span.Attributes(), attribute.String("metadata.storage_id", storageID))
+	}
+	assert.Contains(t, methodSpans[0].Attributes(), attribute.Int("metadata.path_depth", 3))
+	assert.Contains(t, methodSpans[2].Attributes(), attribute.Int("metadata.rows", 1))
+}
+
+func TestPathDepth(t *testing.T) {
+	assert.Equal(t, 0, getPathDepth(""))
+	assert.Equal(t, 0, getPathDepth("/"))
+	assert.Equal(t, 1, getPathDepth("/file.txt"))
+	assert.Equal(t, 2, getPathDepth("dir/file.txt"))
+	assert.Equal(t, 3, getPathDepth("/a/b/../c/d/"))
+}
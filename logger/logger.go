@@ -1,7 +1,12 @@
 package logger
 
 import (
+	"fmt"
+	"io"
+	"os"
+
 	"github.com/hashicorp/go-hclog"
+	"gopkg.in/natefinch/lumberjack.v2"
 )
 
 // AppLogger defines the global application logger
@@ -9,3 +14,51 @@ var AppLogger = hclog.New(&hclog.LoggerOptions{
 	DisableTime: true,
 	Level:       hclog.Debug,
 })
+
+// Config defines the logger configuration
+type Config struct {
+	// Level is the minimum level to log: trace, debug, info, warn, error
+	Level string
+	// JSON enables JSON formatted logs
+	JSON bool
+	// File is the path of the log file. If empty the logs are written to the
+	// standard error, they are captured by SFTPGo when running as plugin
+	File string
+	// MaxSize is the maximum size, in megabytes, of the log file before it is rotated
+	MaxSize int
+	// MaxBackups is the maximum number of rotated log files to retain, 0 means no limit
+	MaxBackups int
+	// MaxAge is the maximum number of days to retain rotated log files, 0 means no limit
+	MaxAge int
+	// Compress defines if the rotated log files must be compressed
+	Compress bool
+}
+
+// Initialize replaces AppLogger with a logger built from the given configuration
+func Initialize(config Config) error {
+	level := hclog.Debug
+	if config.Level != "" {
+		level = hclog.LevelFromString(config.Level)
+		if level == hclog.NoLevel {
+			return fmt.Errorf("invalid log level %q", config.Level)
+		}
+	}
+	var output io.Writer = os.Stderr
+	if config.File != "" {
+		output = &lumberjack.Logger{
+			Filename:   config.File,
+			MaxSize:    config.MaxSize,
+			MaxBackups: config.MaxBackups,
+			MaxAge:     config.MaxAge,
+			Compress:   config.Compress,
+		}
+	}
+	AppLogger = hclog.New(&hclog.LoggerOptions{
+		Output: output,
+		// the SFTPGo logs already include the time
+		DisableTime: config.File == "",
+		Level:       level,
+		JSONFormat:  config.JSON,
+	})
+	return nil
+}
@@ -0,0 +1,133 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+// Package tracing configures the OpenTelemetry trace exporters
+package tracing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+)
+
+// Supported exporters
+const (
+	ExporterNone = ""
+	ExporterOTLP = "otlp"
+	ExporterFile = "file"
+)
+
+const (
+	serviceName = "sftpgo-plugin-metadata"
+)
+
+// Config defines the tracing configuration
+type Config struct {
+	// Exporter defines where the spans are exported, empty means tracing disabled
+	Exporter string
+	// Endpoint is the OTLP gRPC collector endpoint, for example localhost:4317
+	Endpoint string
+	// Insecure disables TLS for the OTLP exporter
+	Insecure bool
+	// File is the path of the file the spans are written to, as JSON, using
+	// the file exporter
+	File string
+	// SamplerRatio is the fraction of the traces to sample, between 0 and 1.
+	// The sampling decision of the parent span, if any, is respected
+	SamplerRatio float64
+}
+
+// Initialize configures the global tracer provider. The returned function
+// flushes the pending spans and stops the provider, it must be called on exit
+func Initialize(config Config, version string) (func(context.Context) error, error) {
+	if config.Exporter == ExporterNone {
+		return func(_ context.Context) error { return nil }, nil
+	}
+	if config.SamplerRatio < 0 || config.SamplerRatio > 1 {
+		return nil, fmt.Errorf("invalid sampler ratio %v, it must be between 0 and 1", config.SamplerRatio)
+	}
+	exporter, err := newExporter(config)
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName(serviceName),
+		semconv.ServiceVersion(version),
+	))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.SamplerRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+func newExporter(config Config) (sdktrace.SpanExporter, error) {
+	switch config.Exporter {
+	case ExporterOTLP:
+		var options []otlptracegrpc.Option
+		if config.Endpoint != "" {
+			options = append(options, otlptracegrpc.WithEndpoint(config.Endpoint))
+		}
+		if config.Insecure {
+			options = append(options, otlptracegrpc.WithInsecure())
+		}
+		return otlptracegrpc.New(context.Background(), options...)
+	case ExporterFile:
+		if config.File == "" {
+			return nil, errors.New("the file exporter requires a file path")
+		}
+		f, err := os.OpenFile(config.File, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return nil, err
+		}
+		exporter, err := stdouttrace.New(stdouttrace.WithWriter(f))
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return &fileExporter{
+			SpanExporter: exporter,
+			file:         f,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported tracing exporter %q", config.Exporter)
+	}
+}
+
+// fileExporter closes the file on shutdown
+type fileExporter struct {
+	sdktrace.SpanExporter
+	file *os.File
+}
+
+func (e *fileExporter) Shutdown(ctx context.Context) error {
+	err := e.SpanExporter.Shutdown(ctx)
+	if errClose := e.file.Close(); err == nil {
+		err = errClose
+	}
+	return err
+}
@@ -0,0 +1,139 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webhook
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sftpgo/sftpgo-plugin-metadata/logger"
+)
+
+const (
+	queueFileExt = ".json"
+)
+
+// diskQueue is a bounded FIFO queue of event batches stored as files in a
+// directory, so the undelivered events survive restarts
+type diskQueue struct {
+	dir     string
+	maxSize int
+
+	mu    sync.Mutex
+	names []string
+	seq   uint64
+}
+
+func newDiskQueue(dir string, maxSize int) (*diskQueue, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	q := &diskQueue{
+		dir:     dir,
+		maxSize: maxSize,
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, queueFileExt) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, queueFileExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		q.names = append(q.names, name)
+		q.seq = max(q.seq, seq)
+	}
+	// the names are zero padded, so they are sorted by sequence
+	slices.Sort(q.names)
+	q.trim()
+	return q, nil
+}
+
+// push adds a batch to the queue, the oldest batches are removed if the
+// queue is full
+func (q *diskQueue) push(data []byte) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.seq++
+	name := fmt.Sprintf("%020d%s", q.seq, queueFileExt)
+	tmp := filepath.Join(q.dir, name+".tmp")
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(q.dir, name)); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	q.names = append(q.names, name)
+	q.trim()
+	return nil
+}
+
+// trim removes the oldest batches exceeding the maximum size
+func (q *diskQueue) trim() {
+	for len(q.names) > q.maxSize {
+		logger.AppLogger.Warn("webhook queue full, discarding the oldest events", "dir", q.dir, "batch", q.names[0])
+		os.Remove(filepath.Join(q.dir, q.names[0]))
+		q.names = q.names[1:]
+	}
+}
+
+// peek returns the oldest batch, an empty name means the queue is empty
+func (q *diskQueue) peek() (string, []byte, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.names) == 0 {
+		return "", nil, nil
+	}
+	name := q.names[0]
+	data, err := os.ReadFile(filepath.Join(q.dir, name))
+	return name, data, err
+}
+
+// remove deletes the specified batch, if it is still the oldest one. A batch
+// may have already been removed because the queue was full
+func (q *diskQueue) remove(name string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.names) == 0 || q.names[0] != name {
+		return
+	}
+	if err := os.Remove(filepath.Join(q.dir, name)); err != nil && !os.IsNotExist(err) {
+		logger.AppLogger.Warn("unable to remove queued webhook events", "batch", name, "error", err)
+	}
+	q.names = q.names[1:]
+}
+
+// len returns the number of queued batches
+func (q *diskQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return len(q.names)
+}
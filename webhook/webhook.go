@@ -0,0 +1,429 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+// Package webhook sends the metadata changes to HTTP endpoints
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sftpgo/sftpgo-plugin-metadata/db"
+	"github.com/sftpgo/sftpgo-plugin-metadata/logger"
+)
+
+// Webhook request headers
+const (
+	HeaderTimestamp = "X-SFTPGo-Metadata-Timestamp"
+	HeaderSignature = "X-SFTPGo-Metadata-Signature"
+)
+
+const (
+	defaultMaxQueueSize  = 1000
+	defaultBatchSize     = 100
+	defaultFlushInterval = 1
+	defaultTimeout       = 10
+	minRetryBackoff      = time.Second
+	maxRetryBackoff      = 5 * time.Minute
+)
+
+// Config defines the webhooks configuration
+type Config struct {
+	// QueueDir is the directory where the event batches are queued until they
+	// are delivered. Each endpoint uses its own subdirectory
+	QueueDir string `json:"queue_dir"`
+	// MaxQueueSize is the maximum number of batches queued for each endpoint,
+	// the oldest batches are discarded if the limit is exceeded. Default: 1000
+	MaxQueueSize int `json:"max_queue_size"`
+	// BatchSize is the maximum number of events sent in a single request.
+	// Default: 100
+	BatchSize int `json:"batch_size"`
+	// FlushInterval is the maximum time, in seconds, an event waits for its
+	// batch to be filled. Default: 1
+	FlushInterval int `json:"flush_interval"`
+	// Timeout is the HTTP request timeout in seconds. Default: 10
+	Timeout int `json:"timeout"`
+	// Endpoints defines the HTTP endpoints to send the events to
+	Endpoints []EndpointConfig `json:"endpoints"`
+}
+
+// EndpointConfig defines an HTTP endpoint
+type EndpointConfig struct {
+	URL string `json:"url"`
+	// Secret is used to sign the requests, it is ignored if SecretFile is set
+	Secret string `json:"secret"`
+	// SecretFile is the path to a file containing the secret
+	SecretFile string `json:"secret_file"`
+	// StorageIDs, if not empty, restricts the events to these storage IDs
+	StorageIDs []string `json:"storage_ids"`
+	// PathPrefixes, if not empty, restricts the events to the paths starting
+	// with any of these prefixes
+	PathPrefixes []string `json:"path_prefixes"`
+}
+
+// getQueueName returns the name of the queue subdirectory for the endpoint
+// at the specified index. The name includes a hash of the URL and of the
+// filters, so endpoints with the same URL never share a queue and the batches
+// queued for a changed endpoint are not sent to the new one. The secret is
+// not included, it can be rotated without losing the queued batches
+func (c *EndpointConfig) getQueueName(idx int) string {
+	h := sha256.New()
+	for _, values := range [][]string{{c.URL}, c.StorageIDs, c.PathPrefixes} {
+		for _, value := range values {
+			h.Write([]byte(value))
+			h.Write([]byte{0})
+		}
+		h.Write([]byte{1})
+	}
+	return strconv.Itoa(idx) + "-" + hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+func (c *EndpointConfig) match(event *Event) bool {
+	if len(c.StorageIDs) > 0 && !slices.Contains(c.StorageIDs, event.StorageID) {
+		return false
+	}
+	if len(c.PathPrefixes) > 0 && !slices.ContainsFunc(c.PathPrefixes, func(prefix string) bool {
+		return strings.HasPrefix(event.Path, prefix)
+	}) {
+		return false
+	}
+	return true
+}
+
+// Event defines a metadata change as sent to the endpoints
+type Event struct {
+	Operation string `json:"operation"`
+	StorageID string `json:"storage_id"`
+	Path      string `json:"path"`
+	// LastModified is the new modification time, as milliseconds since epoch,
+	// for set operations and nil for remove operations
+	LastModified *int64 `json:"last_modified,omitempty"`
+	// Timestamp is the change time as milliseconds since epoch
+	Timestamp int64 `json:"timestamp"`
+}
+
+// Batch defines the body of the webhook requests
+type Batch struct {
+	Events []Event `json:"events"`
+}
+
+// LoadConfig reads the webhooks configuration from the specified JSON file
+func LoadConfig(name string) (Config, error) {
+	var config Config
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return config, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&config); err != nil {
+		return config, fmt.Errorf("unable to parse webhooks config %q: %w", name, err)
+	}
+	return config, nil
+}
+
+func (c *Config) validate() error {
+	if len(c.Endpoints) == 0 {
+		return errors.New("no webhook endpoint defined")
+	}
+	if c.QueueDir == "" {
+		return errors.New("the webhooks queue directory is required")
+	}
+	if c.MaxQueueSize <= 0 {
+		c.MaxQueueSize = defaultMaxQueueSize
+	}
+	if c.BatchSize <= 0 {
+		c.BatchSize = defaultBatchSize
+	}
+	if c.FlushInterval <= 0 {
+		c.FlushInterval = defaultFlushInterval
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = defaultTimeout
+	}
+	for idx := range c.Endpoints {
+		ep := &c.Endpoints[idx]
+		u, err := url.Parse(ep.URL)
+		if err != nil {
+			return fmt.Errorf("invalid webhook url %q: %w", ep.URL, err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("invalid webhook url %q: unsupported scheme", ep.URL)
+		}
+		if ep.SecretFile != "" {
+			secret, err := os.ReadFile(ep.SecretFile)
+			if err != nil {
+				return fmt.Errorf("unable to read webhook secret file %q: %w", ep.SecretFile, err)
+			}
+			ep.Secret = strings.TrimRight(string(secret), "\r\n")
+		}
+	}
+	return nil
+}
+
+// Manager dispatches the metadata changes to the configured endpoints, it
+// implements db.ChangeConsumer
+type Manager struct {
+	endpoints []*endpoint
+	done      chan struct{}
+	wg        sync.WaitGroup
+}
+
+// NewManager returns a Manager for the specified configuration and starts
+// delivering the queued events, if any
+func NewManager(config Config) (*Manager, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	m := &Manager{
+		done: make(chan struct{}),
+	}
+	client := &http.Client{
+		Timeout: time.Duration(config.Timeout) * time.Second,
+	}
+	for idx, epConfig := range config.Endpoints {
+		queue, err := newDiskQueue(filepath.Join(config.QueueDir, epConfig.getQueueName(idx)), config.MaxQueueSize)
+		if err != nil {
+			return nil, err
+		}
+		m.endpoints = append(m.endpoints, &endpoint{
+			config:        epConfig,
+			client:        client,
+			queue:         queue,
+			batchSize:     config.BatchSize,
+			flushInterval: time.Duration(config.FlushInterval) * time.Second,
+			flush:         make(chan struct{}, 1),
+			queued:        make(chan struct{}, 1),
+			done:          m.done,
+		})
+	}
+	for _, ep := range m.endpoints {
+		m.wg.Add(2)
+		go func(ep *endpoint) {
+			defer m.wg.Done()
+			ep.batchLoop()
+		}(ep)
+		go func(ep *endpoint) {
+			defer m.wg.Done()
+			ep.sendLoop()
+		}(ep)
+	}
+	return m, nil
+}
+
+// HandleChange implements db.ChangeConsumer. The SFTPGo metadata plugin
+// interface has no rename operation, a renamed file is received as a set for
+// the new path and a remove for the old one, so no rename event is sent
+func (m *Manager) HandleChange(change db.ChangeEvent) {
+	if change.Operation != db.ChangeOperationSet && change.Operation != db.ChangeOperationRemove {
+		return
+	}
+	event := Event{
+		Operation: change.Operation,
+		StorageID: change.StorageID,
+		Path:      path.Join(change.FolderPath, change.FileName),
+		Timestamp: time.Now().UnixMilli(),
+	}
+	if change.Operation == db.ChangeOperationSet {
+		mTime := change.LastModified
+		event.LastModified = &mTime
+	}
+	for _, ep := range m.endpoints {
+		if ep.config.match(&event) {
+			ep.add(event)
+		}
+	}
+}
+
+// Close stops the delivery, the pending events are queued on disk so they
+// will be sent on the next start
+func (m *Manager) Close() {
+	close(m.done)
+	m.wg.Wait()
+}
+
+type endpoint struct {
+	config        EndpointConfig
+	client        *http.Client
+	queue         *diskQueue
+	batchSize     int
+	flushInterval time.Duration
+	// flush is signaled when a batch is full
+	flush chan struct{}
+	// queued is signaled when a batch is queued
+	queued chan struct{}
+	done   chan struct{}
+
+	mu      sync.Mutex
+	pending []Event
+}
+
+func (e *endpoint) add(event Event) {
+	e.mu.Lock()
+	e.pending = append(e.pending, event)
+	full := len(e.pending) >= e.batchSize
+	e.mu.Unlock()
+
+	if full {
+		signal(e.flush)
+	}
+}
+
+func (e *endpoint) batchLoop() {
+	ticker := time.NewTicker(e.flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-e.done:
+			e.enqueuePending()
+			return
+		case <-ticker.C:
+		case <-e.flush:
+		}
+		e.enqueuePending()
+	}
+}
+
+// enqueuePending moves the pending events to the disk queue
+func (e *endpoint) enqueuePending() {
+	e.mu.Lock()
+	pending := e.pending
+	e.pending = nil
+	e.mu.Unlock()
+
+	for len(pending) > 0 {
+		n := min(len(pending), e.batchSize)
+		data, err := json.Marshal(&Batch{Events: pending[:n]})
+		if err == nil {
+			err = e.queue.push(data)
+		}
+		if err != nil {
+			logger.AppLogger.Error("unable to queue webhook events", "url", e.config.URL, "events", n, "error", err)
+		}
+		pending = pending[n:]
+	}
+	signal(e.queued)
+}
+
+func (e *endpoint) sendLoop() {
+	backoff := minRetryBackoff
+	for {
+		name, data, err := e.queue.peek()
+		if err != nil {
+			logger.AppLogger.Error("unable to read queued webhook events", "url", e.config.URL, "error", err)
+			e.queue.remove(name)
+			continue
+		}
+		if name == "" {
+			select {
+			case <-e.done:
+				return
+			case <-e.queued:
+			}
+			continue
+		}
+		retry, err := e.send(data)
+		if err == nil || !retry {
+			if err != nil {
+				logger.AppLogger.Error("webhook events discarded", "url", e.config.URL, "error", err)
+			}
+			e.queue.remove(name)
+			backoff = minRetryBackoff
+			continue
+		}
+		logger.AppLogger.Warn("unable to send webhook events", "url", e.config.URL, "retry_in", backoff, "error", err)
+		select {
+		case <-e.done:
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxRetryBackoff)
+	}
+}
+
+// send posts the batch and returns whether a failed request can be retried
+func (e *endpoint) send(body []byte) (bool, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		select {
+		case <-e.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "sftpgo-plugin-metadata")
+	req.Header.Set(HeaderTimestamp, timestamp)
+	if e.config.Secret != "" {
+		req.Header.Set(HeaderSignature, "sha256="+Sign(e.config.Secret, timestamp, body))
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024)) //nolint:errcheck
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	err = fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	// other client errors will fail again
+	retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests ||
+		resp.StatusCode == http.StatusRequestTimeout
+	return retry, err
+}
+
+// Sign returns the hex encoded HMAC-SHA256 of the timestamp and the body,
+// separated by a dot, using the specified secret
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,229 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package webhook
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sftpgo/sftpgo-plugin-metadata/db"
+)
+
+type testReceiver struct {
+	mu       sync.Mutex
+	secret   string
+	failures int
+	batches  []Batch
+	received chan struct{}
+}
+
+func (r *testReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	timestamp := req.Header.Get(HeaderTimestamp)
+	if req.Header.Get(HeaderSignature) != "sha256="+Sign(r.secret, timestamp, body) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.failures > 0 {
+		r.failures--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	var batch Batch
+	if err := json.Unmarshal(body, &batch); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	r.batches = append(r.batches, batch)
+	w.WriteHeader(http.StatusNoContent)
+	r.received <- struct{}{}
+}
+
+func (r *testReceiver) getBatches() []Batch {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.batches
+}
+
+func TestWebhooks(t *testing.T) {
+	receiver := &testReceiver{
+		secret:   "webhook secret",
+		failures: 1,
+		received: make(chan struct{}, 10),
+	}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	secretFile := filepath.Join(t.TempDir(), "secret")
+	err := os.WriteFile(secretFile, []byte(receiver.secret+"\n"), 0600)
+	require.NoError(t, err)
+
+	m, err := NewManager(Config{
+		QueueDir:  t.TempDir(),
+		BatchSize: 3,
+		Endpoints: []EndpointConfig{
+			{
+				URL:          server.URL,
+				SecretFile:   secretFile,
+				StorageIDs:   []string{"s3://bucket"},
+				PathPrefixes: []string{"/user1/", "/user2/"},
+			},
+		},
+	})
+	require.NoError(t, err)
+	defer m.Close()
+
+	m.HandleChange(db.ChangeEvent{Operation: db.ChangeOperationSet, StorageID: "s3://bucket", FolderPath: "/user1",
+		FileName: "file1.txt", LastModified: 100})
+	m.HandleChange(db.ChangeEvent{Operation: db.ChangeOperationSet, StorageID: "s3://other", FolderPath: "/user1",
+		FileName: "file1.txt", LastModified: 100})
+	m.HandleChange(db.ChangeEvent{Operation: db.ChangeOperationSet, StorageID: "s3://bucket", FolderPath: "/user3",
+		FileName: "file1.txt", LastModified: 100})
+	m.HandleChange(db.ChangeEvent{Operation: db.ChangeOperationResync})
+	m.HandleChange(db.ChangeEvent{Operation: db.ChangeOperationSet, StorageID: "s3://bucket", FolderPath: "/user1",
+		FileName: "epoch.txt", LastModified: 0})
+	m.HandleChange(db.ChangeEvent{Operation: db.ChangeOperationRemove, StorageID: "s3://bucket", FolderPath: "/user2/dir",
+		FileName: "file2.txt"})
+
+	// the first attempt fails and it is retried after a backoff
+	select {
+	case <-receiver.received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook not received")
+	}
+	batches := receiver.getBatches()
+	require.Len(t, batches, 1)
+	require.Len(t, batches[0].Events, 3)
+	assert.Equal(t, db.ChangeOperationSet, batches[0].Events[0].Operation)
+	assert.Equal(t, "/user1/file1.txt", batches[0].Events[0].Path)
+	if assert.NotNil(t, batches[0].Events[0].LastModified) {
+		assert.Equal(t, int64(100), *batches[0].Events[0].LastModified)
+	}
+	// a zero modification time is sent for set operations
+	assert.Equal(t, "/user1/epoch.txt", batches[0].Events[1].Path)
+	if assert.NotNil(t, batches[0].Events[1].LastModified) {
+		assert.Equal(t, int64(0), *batches[0].Events[1].LastModified)
+	}
+	assert.Equal(t, db.ChangeOperationRemove, batches[0].Events[2].Operation)
+	assert.Equal(t, "/user2/dir/file2.txt", batches[0].Events[2].Path)
+	assert.Nil(t, batches[0].Events[2].LastModified)
+	assert.Greater(t, batches[0].Events[2].Timestamp, int64(0))
+	assert.Eventually(t, func() bool {
+		return m.endpoints[0].queue.len() == 0
+	}, time.Second, 50*time.Millisecond)
+}
+
+func TestDiskQueue(t *testing.T) {
+	dir := t.TempDir()
+	q, err := newDiskQueue(dir, 2)
+	require.NoError(t, err)
+	for _, data := range []string{"1", "2", "3"} {
+		err = q.push([]byte(data))
+		require.NoError(t, err)
+	}
+	// the oldest batch is discarded
+	assert.Equal(t, 2, q.len())
+	name, data, err := q.peek()
+	require.NoError(t, err)
+	assert.Equal(t, "2", string(data))
+	// the queued batches survive restarts
+	q, err = newDiskQueue(dir, 2)
+	require.NoError(t, err)
+	assert.Equal(t, 2, q.len())
+	q.remove(name)
+	_, data, err = q.peek()
+	require.NoError(t, err)
+	assert.Equal(t, "3", string(data))
+	err = q.push([]byte("4"))
+	require.NoError(t, err)
+	name, _, err = q.peek()
+	require.NoError(t, err)
+	q.remove(name)
+	name, data, err = q.peek()
+	require.NoError(t, err)
+	assert.Equal(t, "4", string(data))
+	q.remove(name)
+	name, _, err = q.peek()
+	require.NoError(t, err)
+	assert.Empty(t, name)
+}
+
+func TestQueueNames(t *testing.T) {
+	queueDir := t.TempDir()
+	m, err := NewManager(Config{
+		QueueDir: queueDir,
+		Endpoints: []EndpointConfig{
+			{URL: "http://localhost", StorageIDs: []string{"s3://bucket1"}},
+			{URL: "http://localhost", StorageIDs: []string{"s3://bucket2"}},
+		},
+	})
+	require.NoError(t, err)
+	m.Close()
+	// endpoints with the same URL have their own queue
+	entries, err := os.ReadDir(queueDir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 2)
+
+	config := EndpointConfig{URL: "http://localhost", PathPrefixes: []string{"/a"}}
+	name := config.getQueueName(0)
+	assert.NotEqual(t, name, config.getQueueName(1))
+	config.Secret = "rotated secret"
+	assert.Equal(t, name, config.getQueueName(0))
+	// the filters are hashed as distinct values
+	assert.NotEqual(t, name, (&EndpointConfig{URL: "http://localhost", StorageIDs: []string{"/a"}}).getQueueName(0))
+	assert.NotEqual(t, name, (&EndpointConfig{URL: "http://localhost", PathPrefixes: []string{"/", "a"}}).getQueueName(0))
+}
+
+func TestConfig(t *testing.T) {
+	_, err := NewManager(Config{})
+	assert.Error(t, err)
+	_, err = NewManager(Config{Endpoints: []EndpointConfig{{URL: "http://localhost"}}})
+	assert.Error(t, err)
+	_, err = NewManager(Config{QueueDir: t.TempDir(), Endpoints: []EndpointConfig{{URL: "ftp://localhost"}}})
+	assert.Error(t, err)
+	_, err = NewManager(Config{QueueDir: t.TempDir(), Endpoints: []EndpointConfig{{URL: "http://localhost",
+		SecretFile: filepath.Join(t.TempDir(), "missing")}}})
+	assert.Error(t, err)
+
+	configFile := filepath.Join(t.TempDir(), "webhooks.json")
+	err = os.WriteFile(configFile, []byte(`{"queue_dir":"/tmp","endpoints":[{"url":"https://example.com"}]}`), 0600)
+	require.NoError(t, err)
+	config, err := LoadConfig(configFile)
+	require.NoError(t, err)
+	assert.Equal(t, "/tmp", config.QueueDir)
+	assert.Len(t, config.Endpoints, 1)
+	err = os.WriteFile(configFile, []byte(`{"unknown":1}`), 0600)
+	require.NoError(t, err)
+	_, err = LoadConfig(configFile)
+	assert.Error(t, err)
+}